@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/couchdb-repl/service"
+)
+
+var (
+	cmdBackup = &cobra.Command{
+		Use:   "backup",
+		Short: "Back up the replicated databases of a server to local files",
+		Long:  "Write the documents (with attachments) of every replicated database of a server into a gzip compressed, newline-delimited JSON archive per database and record the archives in the manifest of the backup directory.",
+		Run:   cmdBackupRun,
+	}
+	backupFlags service.BackupOptions
+)
+
+func init() {
+	addTopologyFlags(cmdBackup.Flags())
+	cmdBackup.Flags().StringVar(&backupFlags.Directory, "dir", "", "Directory the archives & manifest are written to")
+	cmdBackup.Flags().StringVar(&backupFlags.Server, "server", "", "Host or name of the server to back up (default the first server-url)")
+	cmdBackup.Flags().BoolVar(&backupFlags.Incremental, "incremental", false, "Only back up the changes since the last backup of the server in --dir")
+	cmdBackup.Flags().IntVar(&backupFlags.BatchSize, "batch-size", service.DefaultBackupBatchSize, "Number of changes read per request")
+	cmdMain.AddCommand(cmdBackup)
+}
+
+func cmdBackupRun(cmd *cobra.Command, args []string) {
+	logger := setupCommandLogging()
+	assertServerArgs()
+	assertArgIsSet(backupFlags.Directory, "--dir")
+	parseTopologyArgs()
+	config, deps := parseServiceArgs(logger)
+	archives, err := service.NewService(config, deps).Backup(backupFlags)
+	if err != nil {
+		Exitf("Backup failed: %s\n", err.Error())
+	}
+	logger.Infof("Wrote %d archives to '%s'", len(archives), backupFlags.Directory)
+}
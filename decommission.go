@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/couchdb-repl/service"
+)
+
+var (
+	cmdDecommission = &cobra.Command{
+		Use:   "decommission",
+		Short: "Remove a server from the replication topology",
+		Long:  "Verify that all data of a server has been replicated to the other servers, remove all replication documents to or from that server and print the topology of the remaining servers.",
+		Run:   cmdDecommissionRun,
+	}
+	decommissionFlags service.DecommissionOptions
+)
+
+func init() {
+	addTopologyFlags(cmdDecommission.Flags())
+	cmdDecommission.Flags().StringVar(&decommissionFlags.Server, "server", "", "Host, name or URL of the server to remove (must be one of the server-url servers)")
+	cmdDecommission.Flags().BoolVar(&decommissionFlags.RemoveUsers, "remove-users", false, "Remove the replicator & editor users from the removed server")
+	cmdDecommission.Flags().BoolVar(&decommissionFlags.Force, "force", false, "Skip the verification that all data has been replicated to the remaining servers")
+	cmdDecommission.Flags().StringVar(&appFlags.output, "output", outputText, "Format of the remaining topology printed to stdout (text|json)")
+	cmdMain.AddCommand(cmdDecommission)
+}
+
+func cmdDecommissionRun(cmd *cobra.Command, args []string) {
+	logger := setupCommandLogging()
+	assertServerArgs()
+	assertArgIsSet(decommissionFlags.Server, "--server")
+	if appFlags.output != outputText && appFlags.output != outputJSON {
+		Exitf("--output must be '%s' or '%s'\n", outputText, outputJSON)
+	}
+	decommissionFlags.Server = serverHost(decommissionFlags.Server)
+	parseTopologyArgs()
+	config, deps := parseServiceArgs(logger)
+	topology, err := service.NewService(config, deps).Decommission(decommissionFlags)
+	if err != nil {
+		Exitf("Decommission failed: %s\n", err.Error())
+	}
+	printTopology(topology)
+	logger.Infof("Decommissioned '%s'", decommissionFlags.Server)
+}
+
+// printTopology prints the given topology to stdout, using the --output format.
+func printTopology(topology []service.TopologyEdge) {
+	if appFlags.output == outputJSON {
+		if topology == nil {
+			topology = []service.TopologyEdge{}
+		}
+		encoded, err := json.MarshalIndent(topology, "", "  ")
+		if err != nil {
+			Exitf("Cannot encode topology: %s\n", err.Error())
+		}
+		fmt.Println(string(encoded))
+		return
+	}
+	for _, e := range topology {
+		fmt.Println(e.String())
+	}
+}
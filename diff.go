@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/couchdb-repl/service"
+)
+
+const (
+	// exitCodeDrift is the exit code of the diff command when drift is found
+	exitCodeDrift = 2
+)
+
+var (
+	cmdDiff = &cobra.Command{
+		Use:   "diff",
+		Short: "Compare the live state of all servers with the desired replication setup",
+		Long:  "Compare the users, roles, database security and replication documents of all servers with the desired replication setup, without changing anything. Exits with code 2 when drift is found.",
+		Run:   cmdDiffRun,
+	}
+)
+
+func init() {
+	addTopologyFlags(cmdDiff.Flags())
+	cmdDiff.Flags().StringVar(&appFlags.output, "output", outputText, "Format of the drift printed to stdout (text|json)")
+	cmdMain.AddCommand(cmdDiff)
+}
+
+func cmdDiffRun(cmd *cobra.Command, args []string) {
+	logger := setupCommandLogging()
+	assertServerArgs()
+	if appFlags.output != outputText && appFlags.output != outputJSON {
+		Exitf("--output must be '%s' or '%s'\n", outputText, outputJSON)
+	}
+	parseTopologyArgs()
+	config, deps := parseServiceArgs(logger)
+	drifts, err := service.NewService(config, deps).Diff()
+	if err != nil {
+		Exitf("Diff failed: %s\n", err.Error())
+	}
+	if appFlags.output == outputJSON {
+		if drifts == nil {
+			drifts = []service.Drift{}
+		}
+		encoded, err := json.MarshalIndent(drifts, "", "  ")
+		if err != nil {
+			Exitf("Cannot encode drift: %s\n", err.Error())
+		}
+		fmt.Println(string(encoded))
+	} else {
+		for _, d := range drifts {
+			fmt.Println(d.String())
+		}
+	}
+	if len(drifts) > 0 {
+		logger.Warningf("Found %d differences", len(drifts))
+		os.Exit(exitCodeDrift)
+	}
+	logger.Info("No differences found")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/couchdb-repl/service"
+)
+
+var (
+	cmdJoin = &cobra.Command{
+		Use:   "join",
+		Short: "Add a new server to an existing replication topology",
+		Long:  "Discover the replication topology from the replication documents of an existing server, prepare & seed the new server and create the replications to and from the new server.",
+		Run:   cmdJoinRun,
+	}
+	joinFlags struct {
+		peer string
+	}
+)
+
+func init() {
+	cmdJoin.Flags().StringVar(&joinFlags.peer, "peer", "", "URL of a server that is already part of the topology")
+	cmdJoin.Flags().StringVar(&appFlags.placement, "placement", string(service.PlacementPull), "Where the replication jobs of the new server run: on the target (pull) or on the source (push)")
+	cmdJoin.Flags().DurationVar(&appFlags.SeedTimeout, "seed-timeout", service.DefaultSeedTimeout, "Maximum time to wait for the seeding of a single database")
+	cmdJoin.Flags().DurationVar(&appFlags.SeedPollInterval, "seed-poll-interval", service.DefaultSeedPollInterval, "Time between checks of the progress of seeding")
+	cmdJoin.Flags().StringVar(&appFlags.output, "output", outputText, "Format of the resulting topology printed to stdout (text|json)")
+	cmdMain.AddCommand(cmdJoin)
+}
+
+func cmdJoinRun(cmd *cobra.Command, args []string) {
+	logger := setupCommandLogging()
+	assertServerArgs()
+	assertArgIsSet(joinFlags.peer, "--peer")
+	if len(appFlags.serverURLs) != 1 {
+		Exitf("--server-url must be set exactly once, to the URL of the new server\n")
+	}
+	if appFlags.output != outputText && appFlags.output != outputJSON {
+		Exitf("--output must be '%s' or '%s'\n", outputText, outputJSON)
+	}
+	placement, err := service.ParsePlacement(appFlags.placement)
+	if err != nil {
+		Exitf("--placement: %s\n", err.Error())
+	}
+	appFlags.DefaultPlacement = placement
+	peerURL, err := url.Parse(joinFlags.peer)
+	if err != nil {
+		Exitf("Failed to parse peer '%s': %s\n", joinFlags.peer, err.Error())
+	}
+	appFlags.allowOtherServers = true
+	config, deps := parseServiceArgs(logger)
+	opts := service.JoinOptions{Peer: service.Server{URL: *peerURL}}
+	for _, srv := range appFlags.otherServers {
+		if srv.URL.Host == peerURL.Host {
+			srv.URL = *peerURL
+			opts.Peer = srv
+		} else {
+			opts.Servers = append(opts.Servers, srv)
+		}
+	}
+	topology, err := service.NewService(config, deps).Join(opts)
+	if err != nil {
+		Exitf("Join failed: %s\n", err.Error())
+	}
+	printTopology(topology)
+	logger.Infof("Joined '%s'", config.Servers[0].URL.Host)
+}
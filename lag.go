@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/couchdb-repl/service"
+)
+
+var (
+	cmdLag = &cobra.Command{
+		Use:   "lag",
+		Short: "Measure the replication lag between all servers",
+		Long:  "Write a timestamped canary document on every server in every replicated database and measure how long it takes to appear on the other servers. Exits with code 2 when a canary does not arrive within the timeout.",
+		Run:   cmdLagRun,
+	}
+	lagFlags service.LagOptions
+)
+
+func init() {
+	addTopologyFlags(cmdLag.Flags())
+	cmdLag.Flags().DurationVar(&lagFlags.Timeout, "timeout", service.DefaultLagTimeout, "Maximum time to wait for a canary document to arrive")
+	cmdLag.Flags().DurationVar(&lagFlags.PollInterval, "poll-interval", service.DefaultLagPollInterval, "Time between checks for arrived canary documents")
+	cmdLag.Flags().StringVar(&appFlags.output, "output", outputText, "Format of the measurements printed to stdout (text|json)")
+	cmdMain.AddCommand(cmdLag)
+}
+
+func cmdLagRun(cmd *cobra.Command, args []string) {
+	logger := setupCommandLogging()
+	assertServerArgs()
+	if appFlags.output != outputText && appFlags.output != outputJSON {
+		Exitf("--output must be '%s' or '%s'\n", outputText, outputJSON)
+	}
+	parseTopologyArgs()
+	config, deps := parseServiceArgs(logger)
+	measurements, err := service.NewService(config, deps).Lag(lagFlags)
+	if err != nil {
+		Exitf("Measuring lag failed: %s\n", err.Error())
+	}
+	if appFlags.output == outputJSON {
+		encoded, err := encodeLag(measurements)
+		if err != nil {
+			Exitf("Cannot encode measurements: %s\n", err.Error())
+		}
+		fmt.Println(string(encoded))
+	} else {
+		printLagMatrix(measurements)
+	}
+	for _, m := range measurements {
+		if !m.Arrived {
+			logger.Warningf("Not all canary documents arrived within %s", lagFlags.Timeout)
+			os.Exit(exitCodeDrift)
+		}
+	}
+}
+
+// printLagMatrix prints a table per database to stdout, with a row per source server
+// and a column per target server.
+func printLagMatrix(measurements []service.LagMeasurement) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i := 0; i < len(measurements); {
+		dbName := measurements[i].Database
+		var hosts []string
+		seen := make(map[string]bool)
+		lags := make(map[string]string)
+		for ; i < len(measurements) && measurements[i].Database == dbName; i++ {
+			m := measurements[i]
+			for _, host := range []string{m.Source, m.Target} {
+				if !seen[host] {
+					seen[host] = true
+					hosts = append(hosts, host)
+				}
+			}
+			lag := fmt.Sprintf("%dms", m.LagMS)
+			if !m.Arrived {
+				lag = "timeout"
+			}
+			lags[m.Source+"->"+m.Target] = lag
+		}
+		fmt.Fprintf(w, "%s", dbName)
+		for _, target := range hosts {
+			fmt.Fprintf(w, "\t%s", target)
+		}
+		fmt.Fprintln(w)
+		for _, source := range hosts {
+			fmt.Fprintf(w, "%s", source)
+			for _, target := range hosts {
+				lag, found := lags[source+"->"+target]
+				if !found {
+					lag = "-"
+				}
+				fmt.Fprintf(w, "\t%s", lag)
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+// encodeLag returns the given measurements as indented JSON.
+func encodeLag(measurements []service.LagMeasurement) ([]byte, error) {
+	if measurements == nil {
+		measurements = []service.LagMeasurement{}
+	}
+	return json.MarshalIndent(measurements, "", "  ")
+}
+
+// writeLag writes the measurements of the replication lag to the lag file (if any).
+func writeLag(measurements []service.LagMeasurement) error {
+	if appFlags.lagFile == "" {
+		return nil
+	}
+	encoded, err := encodeLag(measurements)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(appFlags.lagFile, append(encoded, '\n'), 0644)
+}
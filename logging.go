@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/pulcy/couchdb-repl/service"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// setupLogging configures the backend, level and format of all loggers.
+func setupLogging(level, format string) error {
+	logLevel, err := logging.LogLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level '%s'", level)
+	}
+	var backend logging.Backend
+	switch strings.ToLower(format) {
+	case logFormatText:
+		backend = logging.NewBackendFormatter(
+			logging.NewLogBackend(os.Stderr, "", log.LstdFlags),
+			logging.MustStringFormatter("%{level:.4s} %{message}"))
+	case logFormatJSON:
+		backend = logging.NewBackendFormatter(
+			logging.NewLogBackend(os.Stderr, "", 0),
+			jsonFormatter{})
+	default:
+		return fmt.Errorf("invalid log format '%s', expected '%s' or '%s'", format, logFormatText, logFormatJSON)
+	}
+	leveled := logging.SetBackend(backend)
+	leveled.SetLevel(logLevel, "")
+	return nil
+}
+
+// jsonFormatter formats log records as single line JSON objects.
+// The structured fields added by the service are included as top-level keys.
+type jsonFormatter struct{}
+
+type jsonRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Module  string `json:"module"`
+	Message string `json:"message"`
+	service.LogFields
+}
+
+func (jsonFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	rec := jsonRecord{
+		Time:   r.Time.UTC().Format(time.RFC3339Nano),
+		Level:  strings.ToLower(r.Level.String()),
+		Module: r.Module,
+	}
+	if len(r.Args) == 2 {
+		if fields, ok := r.Args[1].(service.LogFields); ok {
+			rec.Message = fmt.Sprint(r.Args[0])
+			rec.LogFields = fields
+		}
+	}
+	if rec.Message == "" {
+		rec.Message = r.Message()
+	}
+	encoded, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encoded)
+	return err
+}
+
+// setupCommandLogging configures logging for a command and returns its logger.
+func setupCommandLogging() *logging.Logger {
+	if err := setupLogging(appFlags.logLevel, appFlags.logFormat); err != nil {
+		Exitf("%s\n", err.Error())
+	}
+	return logging.MustGetLogger(projectName)
+}
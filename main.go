@@ -2,11 +2,13 @@ package main
 
 import (
 	"fmt"
-	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/op/go-logging"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
 	"github.com/pulcy/couchdb-repl/service"
 )
@@ -19,39 +21,258 @@ var (
 
 var (
 	cmdMain = cobra.Command{
+		Use: projectName,
 		Run: cmdMainRun,
 	}
 	appFlags struct {
 		service.ServiceConfig
-		serverURLs []string
+		serverURLs   []string
+		placement    string
+		edges        []string
+		pairs        []string
+		mappings     []string
+		serverAdmins []string
+		serverRepls  []string
+		serverDbs    []string
+		dbPatterns   []string
+		excludeDbs   []string
+		seeds        []string
+		dbLabels     []string
+		rules        []string
+		designDir    string
+		schemas      []string
+		filters      stringList
+		filterMode   string
+		watch        bool
+		client       string
+		output       string
+		reportFile   string
+		lagFile      string
+		logLevel     string
+		logFormat    string
+		pingInterval time.Duration
+		retry        service.RetryPolicy
+		// otherServers have server specific settings, but are not given in server-url
+		otherServers      []service.Server
+		allowOtherServers bool
+		retryTries        struct {
+			user     int
+			security int
+			database int
+			document int
+		}
 	}
 )
 
 func init() {
+	cmdMain.PersistentFlags().StringVar(&appFlags.logLevel, "log-level", "info", "Minimum level of log messages (critical|error|warning|notice|info|debug)")
+	cmdMain.PersistentFlags().StringVar(&appFlags.logFormat, "log-format", logFormatText, "Format of log messages (text|json)")
 	defaultAdminCouchDBUser := os.Getenv("COUCHDB_ADMIN_USERNAME")
 	defaultAdminCouchDBPassword := os.Getenv("COUCHDB_ADMIN_PASSWORD")
 	defaultReplicatorCouchDBUser := os.Getenv("COUCHDB_REPLICATOR_USERNAME")
 	defaultReplicatorCouchDBPassword := os.Getenv("COUCHDB_REPLICATOR_PASSWORD")
 	defaultEditorCouchDBUser := os.Getenv("COUCHDB_USERNAME")
 	defaultEditorCouchDBPassword := os.Getenv("COUCHDB_PASSWORD")
-	cmdMain.Flags().StringVar(&appFlags.AdminUser.UserName, "admin-user", defaultAdminCouchDBUser, "Admin user of databases")
-	cmdMain.Flags().StringVar(&appFlags.AdminUser.Password, "admin-password", defaultAdminCouchDBPassword, "Admin password of databases")
-	cmdMain.Flags().StringVar(&appFlags.EditorUser.UserName, "editor-user", defaultEditorCouchDBUser, "Editor user of databases")
-	cmdMain.Flags().StringVar(&appFlags.EditorUser.Password, "editor-password", defaultEditorCouchDBPassword, "Editor password of databases")
-	cmdMain.Flags().StringVar(&appFlags.ReplicatorUser.UserName, "replicator-user", defaultReplicatorCouchDBUser, "Replicator user of databases")
-	cmdMain.Flags().StringVar(&appFlags.ReplicatorUser.Password, "replicator-password", defaultReplicatorCouchDBPassword, "Replicator password of databases")
-	cmdMain.Flags().StringSliceVar(&appFlags.serverURLs, "server-url", nil, "URLs of the servers to configure")
-	cmdMain.Flags().StringSliceVar(&appFlags.DatabaseNames, "db", nil, "Names of a database to replicate")
+	cmdMain.PersistentFlags().StringVar(&appFlags.AdminUser.UserName, "admin-user", defaultAdminCouchDBUser, "Admin user of databases")
+	cmdMain.PersistentFlags().StringVar(&appFlags.AdminUser.Password, "admin-password", defaultAdminCouchDBPassword, "Admin password of databases")
+	cmdMain.PersistentFlags().StringVar(&appFlags.EditorUser.UserName, "editor-user", defaultEditorCouchDBUser, "Editor user of databases")
+	cmdMain.PersistentFlags().StringVar(&appFlags.EditorUser.Password, "editor-password", defaultEditorCouchDBPassword, "Editor password of databases")
+	cmdMain.PersistentFlags().StringVar(&appFlags.ReplicatorUser.UserName, "replicator-user", defaultReplicatorCouchDBUser, "Replicator user of databases")
+	cmdMain.PersistentFlags().StringVar(&appFlags.ReplicatorUser.Password, "replicator-password", defaultReplicatorCouchDBPassword, "Replicator password of databases")
+	cmdMain.PersistentFlags().StringSliceVar(&appFlags.serverURLs, "server-url", nil, "URLs of the servers to configure")
+	addTopologyFlags(cmdMain.Flags())
+	cmdMain.Flags().BoolVar(&appFlags.watch, "watch", false, "Keep running and configure replication for newly created databases matching --db-pattern or --all-dbs")
+	cmdMain.Flags().DurationVar(&appFlags.LagInterval, "lag-interval", 0, "Time between replication lag measurements with --watch (0 disables measurements)")
+	cmdMain.Flags().StringVar(&appFlags.lagFile, "lag-file", "", "Path of a file the JSON replication lag measurements are written to with --lag-interval")
+	cmdMain.PersistentFlags().StringSliceVar(&appFlags.serverAdmins, "server-admin", nil, "Admin user of a specific server, formatted as 'host=username:password'")
+	cmdMain.PersistentFlags().StringSliceVar(&appFlags.serverRepls, "server-replicator", nil, "Replicator user of a specific server, formatted as 'host=username:password'")
+	addServerFlags(cmdMain.PersistentFlags())
+	cmdMain.PersistentFlags().StringVar(&appFlags.client, "client", "legacy", "Client used to access the database servers (legacy|http), legacy supports CouchDB 1.x only")
+	cmdMain.Flags().StringSliceVar(&appFlags.seeds, "seed", nil, "Copy the data of a new (empty) server from a single peer before creating continuous replications, formatted as 'host=peer-host'")
+	cmdMain.Flags().DurationVar(&appFlags.SeedTimeout, "seed-timeout", service.DefaultSeedTimeout, "Maximum time to wait for the seeding of a single database")
+	cmdMain.Flags().DurationVar(&appFlags.SeedPollInterval, "seed-poll-interval", service.DefaultSeedPollInterval, "Time between checks of the progress of seeding")
+	cmdMain.Flags().StringVar(&appFlags.output, "output", outputText, "Format of the result printed at the end of every run (text|json)")
+	cmdMain.PersistentFlags().StringVar(&appFlags.reportFile, "report-file", "", "Path of a file the JSON report of every run is written to")
+	defaultRetry := service.DefaultRetryPolicy()
+	defaultPing := service.DefaultPingPolicy()
+	cmdMain.PersistentFlags().DurationVar(&appFlags.RequestTimeout, "request-timeout", service.DefaultRequestTimeout, "Timeout of a single request to a database server")
+	cmdMain.PersistentFlags().DurationVar(&appFlags.Retry.Ping.Timeout, "ping-timeout", defaultPing.Timeout, "Maximum time to wait for a database server to become available")
+	cmdMain.PersistentFlags().DurationVar(&appFlags.pingInterval, "ping-interval", defaultPing.InitialDelay, "Time between attempts to reach a database server")
+	cmdMain.PersistentFlags().IntVar(&appFlags.retryTries.user, "user-retries", defaultRetry.MaxTries, "Maximum number of attempts to configure a user")
+	cmdMain.PersistentFlags().IntVar(&appFlags.retryTries.security, "security-retries", defaultRetry.MaxTries, "Maximum number of attempts to configure database security")
+	cmdMain.PersistentFlags().IntVar(&appFlags.retryTries.database, "database-retries", defaultRetry.MaxTries, "Maximum number of attempts to list, create or inspect a database")
+	cmdMain.PersistentFlags().IntVar(&appFlags.retryTries.document, "document-retries", defaultRetry.MaxTries, "Maximum number of attempts to write a replication document")
+	cmdMain.PersistentFlags().DurationVar(&appFlags.retry.InitialDelay, "retry-delay", defaultRetry.InitialDelay, "Delay before the first retry of a failed operation")
+	cmdMain.PersistentFlags().DurationVar(&appFlags.retry.MaxDelay, "retry-max-delay", defaultRetry.MaxDelay, "Maximum delay between retries of a failed operation (0 means unbounded)")
+	cmdMain.PersistentFlags().Float64Var(&appFlags.retry.Multiplier, "retry-backoff", defaultRetry.Multiplier, "Factor by which the delay between retries grows (1 means constant delay)")
+	cmdMain.PersistentFlags().Float64Var(&appFlags.retry.Jitter, "retry-jitter", defaultRetry.Jitter, "Fraction (0-1) of the retry delay that is randomized")
+	cmdMain.PersistentFlags().DurationVar(&appFlags.retry.Timeout, "retry-timeout", defaultRetry.Timeout, "Maximum time spent retrying a single operation")
 }
 
+// stringList is a flag that can be given multiple times. Unlike a string slice flag,
+// its values are not split on commas.
+type stringList []string
+
+func (l *stringList) String() string     { return "[" + strings.Join(*l, ", ") + "]" }
+func (l *stringList) Type() string       { return "stringList" }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
 func main() {
 	cmdMain.Execute()
 }
 
 func cmdMainRun(cmd *cobra.Command, args []string) {
-	logger := logging.MustGetLogger(projectName)
+	logger := setupCommandLogging()
 
 	// Validate arguments
+	assertServerArgs()
+	if appFlags.output != outputText && appFlags.output != outputJSON {
+		Exitf("--output must be '%s' or '%s'\n", outputText, outputJSON)
+	}
+
+	parseTopologyArgs()
+
+	// Setup service
+	config, deps := parseServiceArgs(logger)
+	service := service.NewService(config, deps)
+
+	// Log version
+	logger.Infof("Starting %s, version %s build %s", projectName, projectVersion, projectBuild)
+
+	// Running replication setup
+	if appFlags.watch {
+		if err := service.Watch(); err != nil {
+			Exitf("Watching failed: %s\n", err.Error())
+		}
+		return
+	}
+	if err := service.Run(); err != nil {
+		Exitf("Replication setup failed: %s\n", err.Error())
+	}
+	logger.Info("Replication setup succeeded")
+
+	// We're done
+}
+
+// addTopologyFlags adds the flags that select the databases and the replication topology to the given flag set.
+func addTopologyFlags(flags *pflag.FlagSet) {
+	flags.StringSliceVar(&appFlags.DatabaseNames, "db", nil, "Names of a database to replicate")
+	flags.StringSliceVar(&appFlags.dbPatterns, "db-pattern", nil, "Replicate all databases matching a glob pattern (e.g. 'tenant_*') or a regular expression enclosed in slashes")
+	flags.BoolVar(&appFlags.AllDatabases, "all-dbs", false, "Replicate all (non-system) databases found on any server")
+	flags.StringSliceVar(&appFlags.excludeDbs, "exclude-db", nil, "Exclude databases matching a glob pattern or a regular expression enclosed in slashes from --db-pattern, --all-dbs and --peruser-dbs")
+	flags.BoolVar(&appFlags.PerUserDatabases, "peruser-dbs", false, "Replicate the per-user databases (created by couch_peruser) of all users found on any server")
+	flags.StringVar(&appFlags.PerUserPrefix, "peruser-prefix", service.DefaultPerUserPrefix, "Prefix of per-user databases")
+	flags.StringSliceVar(&appFlags.mappings, "map", nil, "Replicate a database into a (differently named) database on another server, formatted as 'db@source-host->db@target-host'")
+	flags.StringSliceVar(&appFlags.serverDbs, "server-db", nil, "Name of a database on a specific server, formatted as 'host=db:name'")
+	flags.StringVar(&appFlags.placement, "placement", string(service.PlacementPull), "Where replication jobs run by default: on the target (pull) or on the source (push)")
+	flags.StringSliceVar(&appFlags.edges, "edge", nil, "Placement of the replication from one server to another, formatted as 'source-host->target-host=pull|push'")
+	flags.StringSliceVar(&appFlags.pairs, "pair", nil, "Run the replications in both directions between two servers on the first, formatted as 'host<->peer-host'")
+	flags.StringSliceVar(&appFlags.dbLabels, "db-label", nil, "Label of all databases matching a glob pattern or a regular expression enclosed in slashes, formatted as 'pattern=key=value'")
+	flags.StringVar(&appFlags.designDir, "design-dir", "", "Directory with a directory of design documents (JSON files or couchapp-style directories) per database")
+	flags.StringSliceVar(&appFlags.schemas, "schema", nil, "Reject writes of documents that do not match a JSON-Schema file on all servers, formatted as 'db=path'")
+	flags.Var(&appFlags.filters, "filter", "Only replicate the documents of the databases matching a glob pattern or a regular expression enclosed in slashes that match an expression, formatted as 'pattern:expression' (e.g. 'orders:type in [order, invoice] && region == $target.region')")
+	flags.StringVar(&appFlags.filterMode, "filter-mode", string(service.FilterModeSelector), "How filters are passed to CouchDB: as Mango selector (selector, CouchDB 2.0+) or as JavaScript filter function (js)")
+	flags.StringSliceVar(&appFlags.rules, "rule", nil, "Replicate the databases selected by labels between the servers selected by labels, formatted as 'key=value&...@key=value&...' ('*' selects all)")
+}
+
+// parseTopologyArgs validates and parses the arguments that select the databases and the replication topology
+// into the service configuration.
+func parseTopologyArgs() {
+	if len(appFlags.DatabaseNames) == 0 && len(appFlags.mappings) == 0 && len(appFlags.dbPatterns) == 0 && !appFlags.AllDatabases && !appFlags.PerUserDatabases {
+		Exitf("--db, --db-pattern, --all-dbs, --peruser-dbs or --map must be set\n")
+	}
+	placement, err := service.ParsePlacement(appFlags.placement)
+	if err != nil {
+		Exitf("--placement: %s\n", err.Error())
+	}
+	appFlags.DefaultPlacement = placement
+	for _, edge := range appFlags.edges {
+		e, err := service.ParseEdgePlacement(edge)
+		if err != nil {
+			Exitf("--edge: %s\n", err.Error())
+		}
+		appFlags.EdgePlacements = append(appFlags.EdgePlacements, e)
+	}
+	for _, pair := range appFlags.pairs {
+		p, err := service.ParseServerPair(pair)
+		if err != nil {
+			Exitf("--pair: %s\n", err.Error())
+		}
+		appFlags.Pairs = append(appFlags.Pairs, p)
+	}
+
+	for _, mapping := range appFlags.mappings {
+		m, err := service.ParseDatabaseMapping(mapping)
+		if err != nil {
+			Exitf("--map: %s\n", err.Error())
+		}
+		appFlags.DatabaseMappings = append(appFlags.DatabaseMappings, m)
+	}
+	for _, pattern := range appFlags.dbPatterns {
+		p, err := service.ParseDatabasePattern(pattern)
+		if err != nil {
+			Exitf("--db-pattern: %s\n", err.Error())
+		}
+		appFlags.DatabasePatterns = append(appFlags.DatabasePatterns, p)
+	}
+	for _, pattern := range appFlags.excludeDbs {
+		p, err := service.ParseDatabasePattern(pattern)
+		if err != nil {
+			Exitf("--exclude-db: %s\n", err.Error())
+		}
+		appFlags.ExcludeDatabases = append(appFlags.ExcludeDatabases, p)
+	}
+	for _, override := range appFlags.serverDbs {
+		o, err := service.ParseDatabaseOverride(override)
+		if err != nil {
+			Exitf("--server-db: %s\n", err.Error())
+		}
+		appFlags.DatabaseOverrides = append(appFlags.DatabaseOverrides, o)
+	}
+	for _, label := range appFlags.dbLabels {
+		l, err := service.ParseDatabaseLabel(label)
+		if err != nil {
+			Exitf("--db-label: %s\n", err.Error())
+		}
+		appFlags.DatabaseLabels = append(appFlags.DatabaseLabels, l)
+	}
+	if appFlags.designDir != "" {
+		docs, err := service.LoadDesignDocuments(appFlags.designDir)
+		if err != nil {
+			Exitf("--design-dir: %s\n", err.Error())
+		}
+		appFlags.DesignDocuments = docs
+	}
+	for _, filter := range appFlags.filters {
+		f, err := service.ParseReplicationFilter(filter)
+		if err != nil {
+			Exitf("--filter: %s\n", err.Error())
+		}
+		appFlags.Filters = append(appFlags.Filters, f)
+	}
+	filterMode, err := service.ParseFilterMode(appFlags.filterMode)
+	if err != nil {
+		Exitf("--filter-mode: %s\n", err.Error())
+	}
+	appFlags.FilterMode = filterMode
+	for _, schema := range appFlags.schemas {
+		v, err := service.ParseValidationSchema(schema)
+		if err != nil {
+			Exitf("--schema: %s\n", err.Error())
+		}
+		appFlags.ValidationSchemas = append(appFlags.ValidationSchemas, v)
+	}
+	for _, rule := range appFlags.rules {
+		r, err := service.ParseReplicationRule(rule)
+		if err != nil {
+			Exitf("--rule: %s\n", err.Error())
+		}
+		appFlags.Rules = append(appFlags.Rules, r)
+	}
+}
+
+// assertServerArgs validates the arguments needed to access the servers.
+func assertServerArgs() {
 	assertArgIsSet(appFlags.AdminUser.UserName, "--admin-user")
 	assertArgIsSet(appFlags.AdminUser.Password, "--admin-password")
 	assertArgIsSet(appFlags.EditorUser.UserName, "--editor-user")
@@ -61,46 +282,86 @@ func cmdMainRun(cmd *cobra.Command, args []string) {
 	if len(appFlags.serverURLs) == 0 {
 		Exitf("--server-url must be set\n")
 	}
-	if len(appFlags.DatabaseNames) == 0 {
-		Exitf("--db must be set\n")
+	if appFlags.RequestTimeout <= 0 {
+		Exitf("--request-timeout must be positive\n")
+	}
+	if appFlags.retry.Jitter < 0 || appFlags.retry.Jitter > 1 {
+		Exitf("--retry-jitter must be between 0 and 1\n")
+	}
+}
+
+// parseServiceArgs parses the arguments needed to access the servers (servers, credentials, client & retries)
+// into the service configuration and builds the service dependencies.
+func parseServiceArgs(logger *logging.Logger) (service.ServiceConfig, service.ServiceDependencies) {
+	clientFactory, err := service.ParseClientFactory(appFlags.client)
+	if err != nil {
+		Exitf("--client: %s\n", err.Error())
+	}
+	servers, others := parseServers(appFlags.serverURLs)
+	if len(others) > 0 && !appFlags.allowOtherServers {
+		Exitf("Server specific settings given for '%s', which is not a server-url\n", others[0].URL.Host)
 	}
+	appFlags.Servers = servers
+	appFlags.otherServers = others
 
-	// Parse URLs
-	for _, serverURL := range appFlags.serverURLs {
-		couchUrl, err := url.Parse(serverURL)
+	for _, seed := range appFlags.seeds {
+		sd, err := service.ParseSeed(seed)
 		if err != nil {
-			Exitf("Failed to parse server-url '%s': %#v", serverURL, err)
+			Exitf("--seed: %s\n", err.Error())
 		}
-		appFlags.ServiceConfig.ServerURLs = append(appFlags.ServiceConfig.ServerURLs, *couchUrl)
+		appFlags.Seeds = append(appFlags.Seeds, sd)
 	}
 
-	// Setup service
-	service := service.NewService(appFlags.ServiceConfig, service.ServiceDependencies{
-		Logger: logger,
-	})
-
-	// Log version
-	logger.Infof("Starting %s, version %s build %s", projectName, projectVersion, projectBuild)
-
-	// Running replication setup
-	if err := service.Run(); err != nil {
-		Exitf("Replication setup failed: %s\n", err.Error())
+	// Build retry policies
+	appFlags.Retry.Ping.InitialDelay = appFlags.pingInterval
+	appFlags.Retry.Ping.Multiplier = 1
+	appFlags.Retry.Ping.MaxTries = 1
+	if appFlags.pingInterval > 0 {
+		appFlags.Retry.Ping.MaxTries += int(appFlags.Retry.Ping.Timeout / appFlags.pingInterval)
 	}
-	logger.Info("Replication setup succeeded")
+	appFlags.Retry.User = retryPolicy(appFlags.retryTries.user)
+	appFlags.Retry.Security = retryPolicy(appFlags.retryTries.security)
+	appFlags.Retry.Database = retryPolicy(appFlags.retryTries.database)
+	appFlags.Retry.Document = retryPolicy(appFlags.retryTries.document)
 
-	// We're done
+	deps := service.ServiceDependencies{
+		Logger:        logger,
+		ClientFactory: clientFactory,
+		ReportHandler: func(report service.Report) {
+			if err := writeReport(report); err != nil {
+				logger.Errorf("Failed to write report: %s", err.Error())
+			}
+		},
+		LagHandler: func(measurements []service.LagMeasurement) {
+			if err := writeLag(measurements); err != nil {
+				logger.Errorf("Failed to write lag measurements: %s", err.Error())
+			}
+		},
+	}
+	return appFlags.ServiceConfig, deps
 }
 
 func showUsage(cmd *cobra.Command, args []string) {
 	cmd.Usage()
 }
 
+// Exitf prints the given message to stderr, with all credentials redacted, and exits the process.
 func Exitf(format string, args ...interface{}) {
-	fmt.Printf(format, args...)
-	fmt.Println()
+	fmt.Fprint(os.Stderr, service.Redact(fmt.Sprintf(format, args...)))
+	fmt.Fprintln(os.Stderr)
 	os.Exit(1)
 }
 
+// retryPolicy returns the retry policy configured by the retry flags, with given maximum number of attempts.
+func retryPolicy(maxTries int) service.RetryPolicy {
+	p := appFlags.retry
+	p.MaxTries = maxTries
+	if p.MaxTries < 1 {
+		p.MaxTries = 1
+	}
+	return p
+}
+
 func assertArgIsSet(arg, argKey string) {
 	if arg == "" {
 		Exitf("%s must be set\n", argKey)
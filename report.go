@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pulcy/couchdb-repl/service"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// writeReport writes the report of a run to the report file (if any)
+// and prints it to stdout when the JSON output format is selected.
+func writeReport(report service.Report) error {
+	encoded, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if appFlags.reportFile != "" {
+		if err := ioutil.WriteFile(appFlags.reportFile, append(encoded, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	if appFlags.output == outputJSON {
+		fmt.Println(string(encoded))
+	}
+	return nil
+}
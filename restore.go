@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/couchdb-repl/service"
+)
+
+var (
+	cmdRestore = &cobra.Command{
+		Use:   "restore",
+		Short: "Restore backups into a server",
+		Long:  "Load the archives of a backup directory into a server, keeping the revisions of all documents. Every database is restored from its last full backup, followed by its later incremental backups.",
+		Run:   cmdRestoreRun,
+	}
+	restoreFlags service.RestoreOptions
+)
+
+func init() {
+	addTopologyFlags(cmdRestore.Flags())
+	cmdRestore.Flags().StringVar(&restoreFlags.Directory, "dir", "", "Backup directory holding the manifest & archives")
+	cmdRestore.Flags().StringVar(&restoreFlags.Server, "server", "", "Host or name of the server to restore into (default the first server-url)")
+	cmdRestore.Flags().StringVar(&restoreFlags.TargetDatabase, "target-db", "", "Name of the database to restore into (requires a single --db)")
+	cmdRestore.Flags().IntVar(&restoreFlags.BatchSize, "batch-size", service.DefaultRestoreBatchSize, "Number of documents per _bulk_docs request")
+	cmdRestore.Flags().IntVar(&restoreFlags.Concurrency, "concurrency", service.DefaultRestoreConcurrency, "Number of concurrent _bulk_docs requests")
+	cmdRestore.Flags().StringVar(&restoreFlags.Checkpoint, "checkpoint", "", "File recording the progress of the restore, used to resume a failed restore")
+	cmdMain.AddCommand(cmdRestore)
+}
+
+func cmdRestoreRun(cmd *cobra.Command, args []string) {
+	logger := setupCommandLogging()
+	assertServerArgs()
+	assertArgIsSet(restoreFlags.Directory, "--dir")
+	parseTopologyArgs()
+	// --db selects the databases of the backup to restore, all of them with any other topology flag
+	restoreFlags.Databases = appFlags.DatabaseNames
+	if restoreFlags.TargetDatabase != "" && len(restoreFlags.Databases) != 1 {
+		Exitf("--target-db requires a single --db\n")
+	}
+	config, deps := parseServiceArgs(logger)
+	if err := service.NewService(config, deps).Restore(restoreFlags); err != nil {
+		Exitf("Restore failed: %s\n", err.Error())
+	}
+	logger.Info("Restore succeeded")
+}
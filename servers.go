@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/pulcy/couchdb-repl/service"
+)
+
+var (
+	serverFlags struct {
+		names       []string
+		labels      []string
+		caCerts     []string
+		clientCerts []string
+		insecureTLS []string
+		flavors     []string
+		apiKeys     []string
+	}
+)
+
+// addServerFlags adds the flags with server specific settings to the given flag set.
+func addServerFlags(flags *pflag.FlagSet) {
+	flags.StringSliceVar(&serverFlags.names, "server-name", nil, "Name of a specific server that can be used instead of its host, formatted as 'host=name'")
+	flags.StringSliceVar(&serverFlags.labels, "server-label", nil, "Label of a specific server, formatted as 'host=key=value'")
+	flags.StringSliceVar(&serverFlags.caCerts, "server-ca-cert", nil, "PEM file with the CA certificates used to verify a specific server, formatted as 'host=path'")
+	flags.StringSliceVar(&serverFlags.clientCerts, "server-client-cert", nil, "PEM files of the client certificate & key used for a specific server, formatted as 'host=cert-path:key-path'")
+	flags.StringSliceVar(&serverFlags.insecureTLS, "server-insecure-tls", nil, "Host of a server whose certificate is not verified")
+	flags.StringSliceVar(&serverFlags.flavors, "server-flavor", nil, "Kind of endpoint of a specific server (couchdb|cloudant|pouchdb), formatted as 'host=flavor'")
+	flags.StringSliceVar(&serverFlags.apiKeys, "server-api-key", nil, "API key used as admin & replicator user of a specific server (e.g. Cloudant), formatted as 'host=key:secret'")
+}
+
+// serverHost returns the host of the given server argument, which is either a host, a server name,
+// or a URL as given in server-url.
+func serverHost(value string) string {
+	if u, err := url.Parse(value); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return value
+}
+
+// parseServers builds the server descriptors from the given server URLs and the server specific flags.
+// Servers that only appear in server specific flags are returned separately, without URL scheme.
+func parseServers(serverURLs []string) ([]service.Server, []service.Server) {
+	var servers []*service.Server
+	byHost := make(map[string]*service.Server)
+	for _, serverURL := range serverURLs {
+		couchUrl, err := url.Parse(serverURL)
+		if err != nil {
+			Exitf("Failed to parse server-url '%s': %s\n", serverURL, err.Error())
+		}
+		srv := &service.Server{URL: *couchUrl}
+		servers = append(servers, srv)
+		byHost[couchUrl.Host] = srv
+	}
+	var others []*service.Server
+	server := func(host string) *service.Server {
+		srv, found := byHost[host]
+		if !found {
+			srv = &service.Server{URL: url.URL{Host: host}}
+			others = append(others, srv)
+			byHost[host] = srv
+		}
+		return srv
+	}
+
+	for _, admin := range appFlags.serverAdmins {
+		host, user, err := service.ParseServerUser(admin)
+		if err != nil {
+			Exitf("--server-admin: %s\n", err.Error())
+		}
+		server(host).AdminUser = user
+	}
+	for _, repl := range appFlags.serverRepls {
+		host, user, err := service.ParseServerUser(repl)
+		if err != nil {
+			Exitf("--server-replicator: %s\n", err.Error())
+		}
+		server(host).ReplicatorUser = user
+	}
+	for _, value := range serverFlags.apiKeys {
+		host, key, err := service.ParseServerUser(value)
+		if err != nil {
+			Exitf("--server-api-key: %s\n", err.Error())
+		}
+		srv := server(host)
+		if srv.AdminUser.UserName == "" {
+			srv.AdminUser = key
+		}
+		if srv.ReplicatorUser.UserName == "" {
+			srv.ReplicatorUser = key
+		}
+	}
+	for _, value := range serverFlags.flavors {
+		host, name, err := service.ParseServerOption(value)
+		if err != nil {
+			Exitf("--server-flavor: %s\n", err.Error())
+		}
+		flavor, err := service.ParseFlavor(name)
+		if err != nil {
+			Exitf("--server-flavor: %s\n", err.Error())
+		}
+		server(host).Flavor = flavor
+	}
+	for _, value := range serverFlags.names {
+		host, name, err := service.ParseServerOption(value)
+		if err != nil {
+			Exitf("--server-name: %s\n", err.Error())
+		}
+		server(host).Name = name
+	}
+	for _, value := range serverFlags.labels {
+		host, key, labelValue, err := service.ParseServerLabel(value)
+		if err != nil {
+			Exitf("--server-label: %s\n", err.Error())
+		}
+		srv := server(host)
+		if srv.Labels == nil {
+			srv.Labels = make(map[string]string)
+		}
+		srv.Labels[key] = labelValue
+	}
+	for _, value := range serverFlags.caCerts {
+		host, path, err := service.ParseServerOption(value)
+		if err != nil {
+			Exitf("--server-ca-cert: %s\n", err.Error())
+		}
+		server(host).TLS.CAFile = path
+	}
+	for _, value := range serverFlags.clientCerts {
+		host, paths, err := service.ParseServerOption(value)
+		parts := strings.SplitN(paths, ":", 2)
+		if err != nil || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			Exitf("--server-client-cert: expected 'host=cert-path:key-path', got '%s'\n", value)
+		}
+		srv := server(host)
+		srv.TLS.CertFile, srv.TLS.KeyFile = parts[0], parts[1]
+	}
+	for _, host := range serverFlags.insecureTLS {
+		server(host).TLS.InsecureSkipVerify = true
+	}
+
+	var result, otherResult []service.Server
+	for _, srv := range servers {
+		result = append(result, *srv)
+	}
+	for _, srv := range others {
+		otherResult = append(otherResult, *srv)
+	}
+	return result, otherResult
+}
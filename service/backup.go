@@ -0,0 +1,270 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	// BackupManifestName is the name of the manifest in a backup directory.
+	BackupManifestName = "manifest.json"
+	// DefaultBackupBatchSize is the default number of changes read per request.
+	DefaultBackupBatchSize = 1000
+)
+
+// BackupOptions specify which server is backed up and where the archives are written.
+type BackupOptions struct {
+	Directory   string // Directory the archives & manifest are written to
+	Server      string // Host or name of the server to back up (default the first server)
+	Incremental bool   // Only back up the changes since the last backup of the same server
+	BatchSize   int    // Number of changes read per request (default DefaultBackupBatchSize)
+}
+
+// BackupManifest describes all archives of a backup directory, in the order they were written.
+type BackupManifest struct {
+	Archives []BackupArchive `json:"archives"`
+}
+
+// BackupArchive is a gzip compressed file with one JSON document (including attachments) per line,
+// holding the documents of a single database that changed after a given update sequence.
+// Incremental archives also hold the deleted documents.
+type BackupArchive struct {
+	File        string    `json:"file"`     // Path relative to the backup directory
+	Database    string    `json:"database"` // Logical name of the database
+	Server      string    `json:"server"`   // Host of the server the documents were read from
+	Incremental bool      `json:"incremental"`
+	Since       string    `json:"since"`    // Update sequence the archive starts after ("0" for full backups)
+	LastSeq     string    `json:"last_seq"` // Update sequence to start the next incremental backup from
+	Documents   int       `json:"documents"`
+	Created     time.Time `json:"created"`
+}
+
+// ReadBackupManifest reads the manifest of the given backup directory.
+// An empty manifest is returned if the directory does not contain a manifest.
+func ReadBackupManifest(dir string) (BackupManifest, error) {
+	var manifest BackupManifest
+	data, err := ioutil.ReadFile(filepath.Join(dir, BackupManifestName))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return manifest, maskAny(err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, maskAny(errgo.Notef(err, "cannot decode backup manifest: %s", err.Error()))
+	}
+	return manifest, nil
+}
+
+// lastArchive returns the most recent archive of the given database, read from the server with given host.
+func (m BackupManifest) lastArchive(dbName, host string) (BackupArchive, bool) {
+	for i := len(m.Archives) - 1; i >= 0; i-- {
+		if a := m.Archives[i]; a.Database == dbName && a.Server == host {
+			return a, true
+		}
+	}
+	return BackupArchive{}, false
+}
+
+// archiveCount returns the number of archives of the given database.
+func (m BackupManifest) archiveCount(dbName string) int {
+	count := 0
+	for _, a := range m.Archives {
+		if a.Database == dbName {
+			count++
+		}
+	}
+	return count
+}
+
+// write stores the manifest in the given backup directory.
+func (m BackupManifest) write(dir string) error {
+	encoded, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return maskAny(err)
+	}
+	f, err := ioutil.TempFile(dir, ".manifest-")
+	if err != nil {
+		return maskAny(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(encoded, '\n')); err != nil {
+		f.Close()
+		return maskAny(err)
+	}
+	if err := f.Close(); err != nil {
+		return maskAny(err)
+	}
+	return maskAny(os.Rename(f.Name(), filepath.Join(dir, BackupManifestName)))
+}
+
+// Backup writes the documents of all replicated databases of a single server into an archive per
+// database in the backup directory and adds these archives to the manifest of that directory.
+// Incremental backups only contain the documents changed since the last backup of the same server,
+// databases without changes are skipped. The written archives are returned.
+func (s *service) Backup(opts BackupOptions) ([]BackupArchive, error) {
+	if err := s.validateTopology(); err != nil {
+		return nil, maskAny(err)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBackupBatchSize
+	}
+	if len(s.Servers) == 0 {
+		return nil, maskAny(errgo.New("no servers to back up"))
+	}
+	server := s.Servers[0]
+	if opts.Server != "" {
+		var found bool
+		if server, found = s.server(opts.Server); !found {
+			return nil, maskAny(errgo.Newf("unknown server '%s', expected one of the server hosts", opts.Server))
+		}
+	}
+	host := server.URL.Host
+
+	// Only the backed up server is needed, databases are only discovered on that server
+	conn, err := s.connect(s.log(LogFields{Server: host, Operation: "backup"}), server)
+	if err != nil {
+		return nil, maskAny(RedactError(err))
+	}
+	conns := map[string]*serverConn{server.URL.String(): conn}
+	if err := s.discoverDatabases(conns); err != nil {
+		return nil, maskAny(RedactError(err))
+	}
+
+	if err := os.MkdirAll(opts.Directory, 0755); err != nil {
+		return nil, maskAny(err)
+	}
+	manifest, err := ReadBackupManifest(opts.Directory)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	var archives []BackupArchive
+	for _, name := range s.replicatedDatabases() {
+		if !s.isStoredOn(host, name) {
+			continue
+		}
+		log := s.log(LogFields{Server: host, Database: name, Operation: "backup"})
+		archive := BackupArchive{
+			File:     fmt.Sprintf("%s.%04d.ndjson.gz", url.QueryEscape(name), manifest.archiveCount(name)+1),
+			Database: name,
+			Server:   host,
+			Since:    "0",
+		}
+		if opts.Incremental {
+			if last, found := manifest.lastArchive(name, host); found {
+				archive.Incremental = true
+				archive.Since = last.LastSeq
+			} else {
+				log.Infof("No previous backup of '%s', making a full backup", name)
+			}
+		}
+		written, err := s.backupDatabase(log, conn, opts, &archive)
+		if isCouchNotFound(err) {
+			log.Warningf("Database '%s' does not exist, skipping", name)
+			continue
+		} else if err != nil {
+			return archives, maskAny(RedactError(errgo.Notef(err, "cannot back up '%s': %s", name, err.Error())))
+		}
+		if !written {
+			log.Infof("No changes in '%s' since the last backup", name)
+			continue
+		}
+		manifest.Archives = append(manifest.Archives, archive)
+		if err := manifest.write(opts.Directory); err != nil {
+			return archives, maskAny(errgo.Notef(err, "cannot write backup manifest: %s", err.Error()))
+		}
+		log.Infof("Backed up %d documents of '%s' into '%s'", archive.Documents, name, archive.File)
+		archives = append(archives, archive)
+	}
+	return archives, nil
+}
+
+// isStoredOn returns true if the database with given (logical) name is stored on the server with given host.
+func (s *service) isStoredOn(host, dbName string) bool {
+	for _, u := range s.serversOf(dbName) {
+		if u.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// backupDatabase streams the changes of a database since archive.Since into the file of the given archive,
+// completing the archive with the number of documents and the last sequence.
+// It returns false (and leaves no file) if an incremental backup has no changes.
+func (s *service) backupDatabase(log fieldLogger, conn *serverConn, opts BackupOptions, archive *BackupArchive) (bool, error) {
+	dbName := s.databaseName(conn.URL.Host, archive.Database)
+	f, err := ioutil.TempFile(opts.Directory, ".backup-")
+	if err != nil {
+		return false, maskAny(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	encoder := json.NewEncoder(gz)
+	seq := archive.Since
+	for {
+		var docs []map[string]interface{}
+		var rows int
+		next := seq
+		if err := s.Retry.Document.do(log, func() error {
+			var err error
+			docs, rows, next, err = conn.Admin.Changes(dbName, seq, opts.BatchSize)
+			return maskAny(err)
+		}); err != nil {
+			return false, maskAny(err)
+		}
+		for _, doc := range docs {
+			if deleted, _ := doc["_deleted"].(bool); deleted && !archive.Incremental {
+				continue
+			}
+			if err := encoder.Encode(doc); err != nil {
+				return false, maskAny(err)
+			}
+			archive.Documents++
+		}
+		// A page can be short when changes have no document, only a page without changes (or one that
+		// does not move the sequence) is the end
+		done := rows == 0 || next == seq
+		seq = next
+		if done {
+			break
+		}
+	}
+	archive.LastSeq = seq
+	archive.Created = time.Now().UTC()
+	if archive.Incremental && archive.Documents == 0 {
+		return false, nil
+	}
+	if err := gz.Close(); err != nil {
+		return false, maskAny(err)
+	}
+	if err := f.Close(); err != nil {
+		return false, maskAny(err)
+	}
+	if err := os.Rename(f.Name(), filepath.Join(opts.Directory, archive.File)); err != nil {
+		return false, maskAny(err)
+	}
+	return true, nil
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readArchive returns the documents of the given archive, by ID.
+func readArchive(t *testing.T, dir string, archive BackupArchive) map[string]map[string]interface{} {
+	f, err := os.Open(filepath.Join(dir, archive.File))
+	if err != nil {
+		t.Fatalf("Cannot open archive: %s", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Cannot decompress archive: %s", err)
+	}
+	docs := make(map[string]map[string]interface{})
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			t.Fatalf("Invalid line '%s': %s", scanner.Text(), err)
+		}
+		docs[doc["_id"].(string)] = doc
+	}
+	return docs
+}
+
+func TestBackup(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1", "db2")
+	defer closeFakeCouches(servers)
+	for _, id := range []string{"a", "b", "c"} {
+		servers[1].PutDoc("db1", id, map[string]interface{}{"value": id})
+	}
+	dir, err := ioutil.TempDir("", "couchdb-repl-backup")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestService(servers, "db1", "db2")
+	opts := BackupOptions{Directory: dir, Server: servers[1].Host(), BatchSize: 2}
+	archives, err := s.Backup(opts)
+	if err != nil {
+		t.Fatalf("Backup failed: %s", err)
+	}
+	if len(archives) != 2 || archives[0].Database != "db1" || archives[0].Documents != 3 || archives[0].Incremental {
+		t.Fatalf("Unexpected archives %+v", archives)
+	}
+	if docs := readArchive(t, dir, archives[0]); len(docs) != 3 || docs["b"]["value"] != "b" {
+		t.Errorf("Unexpected documents %v", docs)
+	}
+	// A short page is not the end, only a page without changes is
+	if pages := servers[1].Requests("GET", "/db1/_changes"); len(pages) != 3 {
+		t.Errorf("Expected 3 pages of changes, got %v", pages)
+	}
+
+	// Incremental backup only contains the changes, including deletions
+	servers[1].PutDoc("db1", "d", map[string]interface{}{"value": "d"})
+	servers[1].DeleteDoc("db1", "a")
+	opts.Incremental = true
+	archives, err = s.Backup(opts)
+	if err != nil {
+		t.Fatalf("Incremental backup failed: %s", err)
+	}
+	if len(archives) != 1 || !archives[0].Incremental || archives[0].Since != "3" || archives[0].File != "db1.0002.ndjson.gz" {
+		t.Fatalf("Unexpected incremental archives %+v", archives)
+	}
+	docs := readArchive(t, dir, archives[0])
+	if len(docs) != 2 || docs["d"]["value"] != "d" || docs["a"]["_deleted"] != true {
+		t.Errorf("Unexpected incremental documents %v", docs)
+	}
+
+	manifest, err := ReadBackupManifest(dir)
+	if err != nil {
+		t.Fatalf("ReadBackupManifest failed: %s", err)
+	}
+	if len(manifest.Archives) != 3 || manifest.Archives[2].LastSeq != "5" {
+		t.Errorf("Unexpected manifest %+v", manifest)
+	}
+}
+
+func TestBackupWithOtherServerDown(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	servers[1].PutDoc("db1", "a", map[string]interface{}{"value": "a"})
+	dir, err := ioutil.TempDir("", "couchdb-repl-backup")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestService(servers, "db1")
+	servers[0].Close()
+	archives, err := s.Backup(BackupOptions{Directory: dir, Server: servers[1].Host()})
+	if err != nil {
+		t.Fatalf("Backup failed: %s", err)
+	}
+	if len(archives) != 1 || archives[0].Documents != 1 {
+		t.Errorf("Unexpected archives %+v", archives)
+	}
+}
+
+func TestBackupStopsAtPageWithoutChanges(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	servers[1].opaqueSeqs = true
+	for _, id := range []string{"a", "b", "c"} {
+		servers[1].PutDoc("db1", id, map[string]interface{}{"value": id})
+	}
+	dir, err := ioutil.TempDir("", "couchdb-repl-backup")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestService(servers, "db1")
+	archives, err := s.Backup(BackupOptions{Directory: dir, Server: servers[1].Host(), BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Backup failed: %s", err)
+	}
+	if len(archives) != 1 || archives[0].Documents != 3 {
+		t.Errorf("Unexpected archives %+v", archives)
+	}
+	// The sequence of the page without changes differs from the given one, but it is the end
+	if pages := servers[1].Requests("GET", "/db1/_changes"); len(pages) != 3 {
+		t.Errorf("Expected 3 pages of changes, got %v", pages)
+	}
+}
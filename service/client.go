@@ -0,0 +1,217 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	usersDbName   = "_users"
+	userDocPrefix = "org.couchdb.user:"
+)
+
+var (
+	// NotSupportedError is the cause of errors returned by clients that do not support an operation.
+	NotSupportedError = errgo.New("operation not supported by client")
+)
+
+// CouchClient is the interface through which the service accesses a single CouchDB server,
+// authenticated as a single user.
+type CouchClient interface {
+	// Ping checks that the server is alive.
+	Ping() error
+	// ServerInfo returns the welcome message of the server.
+	ServerInfo() (ServerInfo, error)
+
+	// ListDatabases returns the names of all databases.
+	ListDatabases() ([]string, error)
+	// CreateDatabase creates a database. It fails with 412 if the database already exists.
+	CreateDatabase(name string) error
+	// DeleteDatabase deletes a database.
+	DeleteDatabase(name string) error
+	// DatabaseInfo returns the document count & update sequence of a database.
+	DatabaseInfo(name string) (DatabaseInfo, error)
+	// DatabaseUpdates waits (at most timeout) for databases to be created, updated or deleted
+	// since the given sequence ("now" for new events only).
+	// It returns the events and the sequence to use for the next call.
+	DatabaseUpdates(since string, timeout time.Duration) ([]DatabaseEvent, string, error)
+
+	// GetUser reads the user with given name.
+	GetUser(name string) (UserDocument, error)
+	// AddUser creates a user with given name, password and roles.
+	AddUser(name, password string, roles []string) error
+	// GrantRoles adds the given roles to an existing user, preserving all other fields.
+	GrantRoles(name string, roles []string) error
+	// DeleteUser removes the user with given name.
+	DeleteUser(name string) error
+
+	// GetSecurity reads the security object of a database.
+	GetSecurity(dbName string) (Security, error)
+	// SaveSecurity replaces the security object of a database.
+	SaveSecurity(dbName string, sec Security) error
+
+	// ReadDocument reads a document into the given value and returns its revision.
+	ReadDocument(dbName, id string, doc interface{}) (string, error)
+	// SaveDocument stores a document, updating revision rev (empty for new documents), and returns the new revision.
+	SaveDocument(dbName, id, rev string, doc interface{}) (string, error)
+	// DeleteDocument deletes revision rev of a document.
+	DeleteDocument(dbName, id, rev string) error
+	// ListDocumentIDs returns the IDs of all documents of a database, including design documents.
+	ListDocumentIDs(dbName string) ([]string, error)
+	// ListDocuments returns (at most limit) documents of a database ordered by ID, starting at the given ID ("" for the first),
+	// including design documents, and the ID to start the next call at ("" when there are no more documents).
+	// Attachments are only included as stubs.
+	ListDocuments(dbName, startID string, limit int) ([]map[string]interface{}, string, error)
+	// Changes returns (at most limit) documents of a database that changed since the given sequence ("0" for all),
+	// including their attachments and deleted documents, the number of changes read and the sequence to use for the next call.
+	// Changes without a document are left out, so fewer documents than limit does not mean there are no more changes.
+	Changes(dbName, since string, limit int) ([]map[string]interface{}, int, string, error)
+	// BulkDocs stores the given documents in a single request. When newEdits is false, the documents are
+	// stored with their given revisions instead of getting new revisions.
+	BulkDocs(dbName string, docs []map[string]interface{}, newEdits bool) error
+
+	// ActiveTasks returns the tasks running on the server.
+	ActiveTasks() ([]ActiveTask, error)
+	// SchedulerDocs returns the state of all replications of the _replicator database (CouchDB 2.x and up).
+	SchedulerDocs() ([]SchedulerDoc, error)
+}
+
+// ClientFactory creates a client for the given server, authenticated as the given user.
+type ClientFactory func(server Server, user UserInfo, timeout time.Duration) (CouchClient, error)
+
+// ParseClientFactory returns the factory of the client with given name (http|legacy).
+func ParseClientFactory(name string) (ClientFactory, error) {
+	switch name {
+	case "http":
+		return NewHTTPClient, nil
+	case "legacy":
+		return NewLegacyClient, nil
+	default:
+		return nil, maskAny(errgo.Newf("unknown client '%s', expected 'http' or 'legacy'", name))
+	}
+}
+
+// ServerInfo is the welcome message of a server.
+type ServerInfo struct {
+	CouchDB string `json:"couchdb"`
+	Version string `json:"version"`
+	Vendor  struct {
+		Name    string `json:"name,omitempty"`
+		Version string `json:"version,omitempty"`
+	} `json:"vendor,omitempty"`
+}
+
+// DatabaseInfo holds information about a database.
+type DatabaseInfo struct {
+	DocCount  int64  `json:"doc_count"`
+	UpdateSeq string `json:"update_seq"` // Opaque in CouchDB 2.x and up
+}
+
+// DatabaseEvent is an event of the _db_updates feed.
+type DatabaseEvent struct {
+	DbName string `json:"db_name"`
+	Type   string `json:"type"` // created|updated|deleted
+}
+
+// UserDocument is a document of the _users database.
+type UserDocument struct {
+	ID       string   `json:"_id,omitempty"`
+	Rev      string   `json:"_rev,omitempty"`
+	Name     string   `json:"name"`
+	Password string   `json:"password,omitempty"`
+	Roles    []string `json:"roles"`
+	Type     string   `json:"type"`
+}
+
+// SecurityGroup is the members or admins section of a security object.
+type SecurityGroup struct {
+	Names []string `json:"names,omitempty"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+// Security is the security object of a database.
+type Security struct {
+	Members SecurityGroup `json:"members"`
+	Admins  SecurityGroup `json:"admins"`
+	// Cloudant maps API keys to their permissions (Cloudant only)
+	Cloudant map[string][]string `json:"cloudant,omitempty"`
+}
+
+// ActiveTask is an entry of _active_tasks.
+type ActiveTask struct {
+	Type        string `json:"type"`
+	DocID       string `json:"doc_id,omitempty"`
+	Database    string `json:"database,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Target      string `json:"target,omitempty"`
+	Continuous  bool   `json:"continuous,omitempty"`
+	Progress    int    `json:"progress,omitempty"`
+	DocsRead    int64  `json:"docs_read,omitempty"`
+	DocsWritten int64  `json:"docs_written,omitempty"`
+}
+
+// SchedulerDoc is the state of a single replication document, as reported by _scheduler/docs.
+type SchedulerDoc struct {
+	DocID      string `json:"doc_id"`
+	State      string `json:"state"`
+	Source     string `json:"source"`
+	Target     string `json:"target"`
+	ErrorCount int    `json:"error_count,omitempty"`
+	// Info holds the reason of failed replications (a string or an object, depending on the version).
+	Info json.RawMessage `json:"info,omitempty"`
+}
+
+// CouchError is the error returned by clients for every non-successful response of a server.
+type CouchError struct {
+	StatusCode int
+	Method     string
+	URL        string
+	ErrorCode  string
+	Reason     string
+}
+
+func (e *CouchError) Error() string {
+	return fmt.Sprintf("%d: %s %s - %s %s", e.StatusCode, e.Method, e.URL, e.ErrorCode, e.Reason)
+}
+
+// couchStatus returns the HTTP status of the given error, or 0 if it is not a CouchError.
+func couchStatus(err error) int {
+	if cerr, ok := errgo.Cause(err).(*CouchError); ok {
+		return cerr.StatusCode
+	}
+	return 0
+}
+
+func isCouchNotFound(err error) bool {
+	return couchStatus(err) == http.StatusNotFound
+}
+
+func isCouchConflict(err error) bool {
+	return couchStatus(err) == http.StatusConflict
+}
+
+func isCouchPreconditionFailed(err error) bool {
+	return couchStatus(err) == http.StatusPreconditionFailed
+}
+
+func isNotSupported(err error) bool {
+	return errgo.Cause(err) == NotSupportedError
+}
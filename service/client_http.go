@@ -0,0 +1,481 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	// bulkRequestTimeout is added to the request timeout for requests that transfer many documents
+	// (_changes pages with documents & attachments, _bulk_docs).
+	bulkRequestTimeout = 5 * time.Minute
+)
+
+// httpClient implements CouchClient directly on top of net/http.
+// It supports CouchDB 1.x, 2.x and 3.x.
+type httpClient struct {
+	baseURL url.URL
+	user    UserInfo
+	client  *http.Client
+}
+
+// NewHTTPClient creates a CouchClient for the given server, using net/http.
+func NewHTTPClient(server Server, user UserInfo, timeout time.Duration) (CouchClient, error) {
+	base := server.URL
+	base.User = nil
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawQuery = ""
+	client := &http.Client{Timeout: timeout}
+	tlsConfig, err := server.TLS.Config()
+	if err != nil {
+		return nil, maskAny(errgo.Notef(err, "invalid TLS settings: %s", err.Error()))
+	}
+	if tlsConfig != nil {
+		client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
+	return &httpClient{
+		baseURL: base,
+		user:    user,
+		client:  client,
+	}, nil
+}
+
+// escapePath escapes all segments of the given path, except for the slash of design documents.
+func escapePath(segments ...string) string {
+	var escaped []string
+	for _, s := range segments {
+		if strings.HasPrefix(s, "_design/") || strings.HasPrefix(s, "_local/") {
+			parts := strings.SplitN(s, "/", 2)
+			escaped = append(escaped, parts[0]+"/"+escapeSegment(parts[1]))
+		} else {
+			escaped = append(escaped, escapeSegment(s))
+		}
+	}
+	return "/" + strings.Join(escaped, "/")
+}
+
+// escapeSegment escapes a single path segment.
+func escapeSegment(segment string) string {
+	return strings.Replace(url.QueryEscape(segment), "+", "%20", -1)
+}
+
+// bulkClient returns a client like the client of c, with a timeout suitable for requests that transfer many documents.
+func (c *httpClient) bulkClient() *http.Client {
+	return &http.Client{Transport: c.client.Transport, Timeout: c.client.Timeout + bulkRequestTimeout}
+}
+
+// request performs a request and decodes the JSON response into result (if not nil).
+// The headers of the response are returned.
+func (c *httpClient) request(method, path string, query url.Values, headers map[string]string, body interface{}, result interface{}) (http.Header, error) {
+	return c.requestWithTimeout(c.client, method, path, query, headers, body, result)
+}
+
+func (c *httpClient) requestWithTimeout(client *http.Client, method, path string, query url.Values, headers map[string]string, body interface{}, result interface{}) (http.Header, error) {
+	u := c.baseURL
+	u.Opaque = ""
+	rawPath := c.baseURL.Path + path
+	if len(query) > 0 {
+		u.RawQuery = query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	// Keep escaped path segments (e.g. %2F in document IDs) intact
+	req.URL.Opaque = "//" + u.Host + rawPath
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if c.user.UserName != "" {
+		req.SetBasicAuth(c.user.UserName, c.user.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		cerr := &CouchError{
+			StatusCode: resp.StatusCode,
+			Method:     method,
+			URL:        c.baseURL.Host + path,
+		}
+		if method != "HEAD" {
+			var reply struct {
+				Error  string `json:"error"`
+				Reason string `json:"reason"`
+			}
+			if data, err := ioutil.ReadAll(resp.Body); err == nil {
+				json.Unmarshal(data, &reply)
+			}
+			cerr.ErrorCode, cerr.Reason = reply.Error, reply.Reason
+		}
+		return resp.Header, maskAny(cerr)
+	}
+	if result != nil && method != "HEAD" {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return resp.Header, maskAny(err)
+		}
+	} else {
+		io.Copy(ioutil.Discard, resp.Body)
+	}
+	return resp.Header, nil
+}
+
+// revision returns the document revision from the ETag header.
+func revision(header http.Header) string {
+	return strings.Trim(header.Get("ETag"), `"`)
+}
+
+func (c *httpClient) Ping() error {
+	_, err := c.request("HEAD", "/", nil, nil, nil, nil)
+	return maskAny(err)
+}
+
+func (c *httpClient) ServerInfo() (ServerInfo, error) {
+	var info ServerInfo
+	if _, err := c.request("GET", "/", nil, nil, nil, &info); err != nil {
+		return ServerInfo{}, maskAny(err)
+	}
+	return info, nil
+}
+
+func (c *httpClient) ListDatabases() ([]string, error) {
+	var names []string
+	if _, err := c.request("GET", "/_all_dbs", nil, nil, nil, &names); err != nil {
+		return nil, maskAny(err)
+	}
+	return names, nil
+}
+
+func (c *httpClient) CreateDatabase(name string) error {
+	_, err := c.request("PUT", escapePath(name), nil, nil, nil, nil)
+	return maskAny(err)
+}
+
+func (c *httpClient) DeleteDatabase(name string) error {
+	_, err := c.request("DELETE", escapePath(name), nil, nil, nil, nil)
+	return maskAny(err)
+}
+
+func (c *httpClient) DatabaseInfo(name string) (DatabaseInfo, error) {
+	var info struct {
+		DocCount  int64           `json:"doc_count"`
+		UpdateSeq json.RawMessage `json:"update_seq"` // Number in CouchDB 1.x, string in 2.x and up
+	}
+	if _, err := c.request("GET", escapePath(name), nil, nil, nil, &info); err != nil {
+		return DatabaseInfo{}, maskAny(err)
+	}
+	return DatabaseInfo{DocCount: info.DocCount, UpdateSeq: sequence(info.UpdateSeq, "")}, nil
+}
+
+// sequence returns the given raw update sequence as a string, or def if it is missing.
+// Sequences are numbers in CouchDB 1.x, which are kept as written (never in exponent notation),
+// and opaque strings in 2.x and up.
+func sequence(raw json.RawMessage, def string) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return def
+	}
+	var seq string
+	if err := json.Unmarshal(raw, &seq); err != nil {
+		return string(raw)
+	}
+	return seq
+}
+
+func (c *httpClient) DatabaseUpdates(since string, timeout time.Duration) ([]DatabaseEvent, string, error) {
+	q := url.Values{}
+	q.Set("feed", "longpoll")
+	q.Set("timeout", fmt.Sprintf("%d", timeout/time.Millisecond))
+	q.Set("since", since)
+	// CouchDB 1.x returns a single event, CouchDB 2.x and up returns a list of results.
+	var resp struct {
+		DatabaseEvent
+		Results []DatabaseEvent `json:"results"`
+		LastSeq json.RawMessage `json:"last_seq"`
+	}
+	client := &http.Client{Transport: c.client.Transport, Timeout: c.client.Timeout + timeout}
+	if _, err := c.requestWithTimeout(client, "GET", "/_db_updates", q, nil, nil, &resp); err != nil {
+		return nil, since, maskAny(err)
+	}
+	events := resp.Results
+	if resp.DbName != "" {
+		events = append(events, resp.DatabaseEvent)
+	}
+	return events, sequence(resp.LastSeq, since), nil
+}
+
+func (c *httpClient) GetUser(name string) (UserDocument, error) {
+	var user UserDocument
+	if _, err := c.request("GET", escapePath(usersDbName, userDocPrefix+name), nil, nil, nil, &user); err != nil {
+		return UserDocument{}, maskAny(err)
+	}
+	return user, nil
+}
+
+func (c *httpClient) AddUser(name, password string, roles []string) error {
+	user := UserDocument{
+		Name:     name,
+		Password: password,
+		Roles:    roles,
+		Type:     "user",
+	}
+	_, err := c.SaveDocument(usersDbName, userDocPrefix+name, "", user)
+	return maskAny(err)
+}
+
+func (c *httpClient) GrantRoles(name string, roles []string) error {
+	// Read the user as a generic document to preserve all fields
+	var user map[string]interface{}
+	rev, err := c.ReadDocument(usersDbName, userDocPrefix+name, &user)
+	if err != nil {
+		return maskAny(err)
+	}
+	current, _ := user["roles"].([]interface{})
+	changed := false
+	for _, r := range roles {
+		found := false
+		for _, x := range current {
+			if x == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			current = append(current, r)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	user["roles"] = current
+	if _, err := c.SaveDocument(usersDbName, userDocPrefix+name, rev, user); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+func (c *httpClient) DeleteUser(name string) error {
+	user, err := c.GetUser(name)
+	if err != nil {
+		return maskAny(err)
+	}
+	return maskAny(c.DeleteDocument(usersDbName, userDocPrefix+name, user.Rev))
+}
+
+func (c *httpClient) GetSecurity(dbName string) (Security, error) {
+	var sec Security
+	if _, err := c.request("GET", escapePath(dbName, "_security"), nil, nil, nil, &sec); err != nil {
+		return Security{}, maskAny(err)
+	}
+	return sec, nil
+}
+
+func (c *httpClient) SaveSecurity(dbName string, sec Security) error {
+	_, err := c.request("PUT", escapePath(dbName, "_security"), nil, nil, sec, nil)
+	return maskAny(err)
+}
+
+func (c *httpClient) ReadDocument(dbName, id string, doc interface{}) (string, error) {
+	header, err := c.request("GET", escapePath(dbName, id), nil, nil, nil, doc)
+	if err != nil {
+		return "", maskAny(err)
+	}
+	return revision(header), nil
+}
+
+func (c *httpClient) SaveDocument(dbName, id, rev string, doc interface{}) (string, error) {
+	var headers map[string]string
+	if rev != "" {
+		headers = map[string]string{"If-Match": rev}
+	}
+	var result struct {
+		Rev string `json:"rev"`
+	}
+	header, err := c.request("PUT", escapePath(dbName, id), nil, headers, doc, &result)
+	if err != nil {
+		return "", maskAny(err)
+	}
+	if result.Rev != "" {
+		return result.Rev, nil
+	}
+	return revision(header), nil
+}
+
+func (c *httpClient) DeleteDocument(dbName, id, rev string) error {
+	q := url.Values{}
+	q.Set("rev", rev)
+	_, err := c.request("DELETE", escapePath(dbName, id), q, nil, nil, nil)
+	return maskAny(err)
+}
+
+func (c *httpClient) ListDocumentIDs(dbName string) ([]string, error) {
+	var resp struct {
+		Rows []struct {
+			ID string `json:"id"`
+		} `json:"rows"`
+	}
+	if _, err := c.request("GET", escapePath(dbName, "_all_docs"), nil, nil, nil, &resp); err != nil {
+		return nil, maskAny(err)
+	}
+	ids := make([]string, 0, len(resp.Rows))
+	for _, row := range resp.Rows {
+		ids = append(ids, row.ID)
+	}
+	return ids, nil
+}
+
+func (c *httpClient) ListDocuments(dbName, startID string, limit int) ([]map[string]interface{}, string, error) {
+	q := url.Values{}
+	q.Set("include_docs", "true")
+	q.Set("attachments", "false")
+	if startID != "" {
+		startKey, err := json.Marshal(startID)
+		if err != nil {
+			return nil, "", maskAny(err)
+		}
+		q.Set("startkey", string(startKey))
+	}
+	if limit > 0 {
+		// Read one more row to find the start of the next call
+		q.Set("limit", strconv.Itoa(limit+1))
+	}
+	var resp struct {
+		Rows []struct {
+			ID  string                 `json:"id"`
+			Doc map[string]interface{} `json:"doc"`
+		} `json:"rows"`
+	}
+	if _, err := c.request("GET", escapePath(dbName, "_all_docs"), q, nil, nil, &resp); err != nil {
+		return nil, "", maskAny(err)
+	}
+	next := ""
+	if limit > 0 && len(resp.Rows) > limit {
+		next = resp.Rows[limit].ID
+		resp.Rows = resp.Rows[:limit]
+	}
+	docs := make([]map[string]interface{}, 0, len(resp.Rows))
+	for _, row := range resp.Rows {
+		if row.Doc != nil {
+			docs = append(docs, row.Doc)
+		}
+	}
+	return docs, next, nil
+}
+
+func (c *httpClient) Changes(dbName, since string, limit int) ([]map[string]interface{}, int, string, error) {
+	q := url.Values{}
+	q.Set("include_docs", "true")
+	q.Set("attachments", "true")
+	q.Set("style", "main_only")
+	q.Set("since", since)
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var resp struct {
+		Results []struct {
+			ID      string `json:"id"`
+			Deleted bool   `json:"deleted"`
+			Changes []struct {
+				Rev string `json:"rev"`
+			} `json:"changes"`
+			Doc map[string]interface{} `json:"doc"`
+		} `json:"results"`
+		LastSeq json.RawMessage `json:"last_seq"` // Number in CouchDB 1.x, string in 2.x and up
+	}
+	if _, err := c.requestWithTimeout(c.bulkClient(), "GET", escapePath(dbName, "_changes"), q, nil, nil, &resp); err != nil {
+		return nil, 0, since, maskAny(err)
+	}
+	docs := make([]map[string]interface{}, 0, len(resp.Results))
+	for _, r := range resp.Results {
+		doc := r.Doc
+		if doc == nil && r.Deleted && len(r.Changes) > 0 {
+			// CouchDB 1.x does not include the tombstone of deleted documents
+			doc = map[string]interface{}{"_id": r.ID, "_rev": r.Changes[0].Rev, "_deleted": true}
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, len(resp.Results), sequence(resp.LastSeq, since), nil
+}
+
+func (c *httpClient) BulkDocs(dbName string, docs []map[string]interface{}, newEdits bool) error {
+	body := map[string]interface{}{"docs": docs, "new_edits": newEdits}
+	var results []struct {
+		ID     string `json:"id"`
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}
+	if _, err := c.requestWithTimeout(c.bulkClient(), "POST", escapePath(dbName, "_bulk_docs"), nil, nil, body, &results); err != nil {
+		return maskAny(err)
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			return maskAny(errgo.Newf("cannot store document '%s': %s %s", r.ID, r.Error, r.Reason))
+		}
+	}
+	return nil
+}
+
+func (c *httpClient) ActiveTasks() ([]ActiveTask, error) {
+	var tasks []ActiveTask
+	if _, err := c.request("GET", "/_active_tasks", nil, nil, nil, &tasks); err != nil {
+		return nil, maskAny(err)
+	}
+	return tasks, nil
+}
+
+func (c *httpClient) SchedulerDocs() ([]SchedulerDoc, error) {
+	var resp struct {
+		Docs []SchedulerDoc `json:"docs"`
+	}
+	if _, err := c.request("GET", escapePath("_scheduler", "docs", replicatorDbName), nil, nil, nil, &resp); err != nil {
+		if isCouchNotFound(err) || couchStatus(err) == http.StatusBadRequest {
+			// CouchDB 1.x has no scheduler
+			return nil, maskAny(errgo.WithCausef(nil, NotSupportedError, "scheduler is not supported by server"))
+		}
+		return nil, maskAny(err)
+	}
+	return resp.Docs, nil
+}
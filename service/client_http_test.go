@@ -0,0 +1,88 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEscapePath(t *testing.T) {
+	tests := map[string][]string{
+		"/db":                          {"db"},
+		"/a%2Fb/doc%20id":              {"a/b", "doc id"},
+		"/db/_design/my%2Fddoc":        {"db", "_design/my/ddoc"},
+		"/_users/org.couchdb.user%3Ax": {usersDbName, userDocPrefix + "x"},
+	}
+	for expected, segments := range tests {
+		if path := escapePath(segments...); path != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, path)
+		}
+	}
+}
+
+func TestSequence(t *testing.T) {
+	tests := map[string]string{
+		`1234567`:        "1234567",
+		`"12-g1AAAA"`:    "12-g1AAAA",
+		`null`:           "default",
+		``:               "default",
+		`12345678901234`: "12345678901234",
+	}
+	for raw, expected := range tests {
+		if seq := sequence(json.RawMessage(raw), "default"); seq != expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", expected, raw, seq)
+		}
+	}
+}
+
+func TestHTTPClientDocuments(t *testing.T) {
+	fc := newFakeCouch(t, "db1")
+	defer fc.Close()
+
+	client, err := NewHTTPClient(Server{URL: fc.URL()}, UserInfo{UserName: testAdminName, Password: testAdminPass}, time.Second*5)
+	if err != nil {
+		t.Fatalf("NewHTTPClient failed: %s", err)
+	}
+	rev, err := client.SaveDocument("db1", "a/b", "", map[string]interface{}{"value": 1})
+	if err != nil {
+		t.Fatalf("SaveDocument failed: %s", err)
+	}
+	var doc map[string]interface{}
+	if readRev, err := client.ReadDocument("db1", "a/b", &doc); err != nil {
+		t.Fatalf("ReadDocument failed: %s", err)
+	} else if readRev != rev {
+		t.Errorf("Expected revision '%s', got '%s'", rev, readRev)
+	}
+	if _, err := client.SaveDocument("db1", "a/b", "", map[string]interface{}{"value": 2}); !isCouchConflict(err) {
+		t.Errorf("Expected conflict, got %v", err)
+	}
+	if err := client.DeleteDocument("db1", "a/b", rev); err != nil {
+		t.Fatalf("DeleteDocument failed: %s", err)
+	}
+	if _, err := client.ReadDocument("db1", "a/b", &doc); !isCouchNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+	if err := client.CreateDatabase("db1"); !isCouchPreconditionFailed(err) {
+		t.Errorf("Expected precondition failed, got %v", err)
+	}
+
+	anonymous, _ := NewHTTPClient(Server{URL: fc.URL()}, UserInfo{}, time.Second*5)
+	if _, err := anonymous.GetSecurity("db1"); couchStatus(err) != http.StatusUnauthorized {
+		t.Errorf("Expected unauthorized, got %v", err)
+	}
+}
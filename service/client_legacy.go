@@ -0,0 +1,197 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/juju/errgo"
+	"github.com/rhinoman/couchdb-go"
+)
+
+// legacyClient implements CouchClient using the rhinoman/couchdb-go client.
+// It supports the CouchDB 1.x API only.
+type legacyClient struct {
+	conn *couchdb.Connection
+	auth couchdb.Auth
+}
+
+// NewLegacyClient creates a CouchClient for the given server, based on the rhinoman/couchdb-go client.
+// TLS settings are not supported.
+func NewLegacyClient(server Server, user UserInfo, timeout time.Duration) (CouchClient, error) {
+	if !server.TLS.IsDefault() {
+		return nil, maskAny(errgo.WithCausef(nil, NotSupportedError, "TLS settings are not supported by the legacy client"))
+	}
+	serverURL := server.URL
+	host, port, err := net.SplitHostPort(serverURL.Host)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	portNr, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	var conn *couchdb.Connection
+	if serverURL.Scheme == "https" {
+		conn, err = couchdb.NewSSLConnection(host, portNr, timeout)
+	} else {
+		conn, err = couchdb.NewConnection(host, portNr, timeout)
+	}
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return &legacyClient{
+		conn: conn,
+		auth: &couchdb.BasicAuth{Username: user.UserName, Password: user.Password},
+	}, nil
+}
+
+// legacyError converts errors of the rhinoman client into CouchErrors.
+func legacyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if cerr, ok := err.(*couchdb.Error); ok {
+		return maskAny(&CouchError{
+			StatusCode: cerr.StatusCode,
+			Method:     cerr.Method,
+			URL:        cerr.URL,
+			ErrorCode:  cerr.ErrorCode,
+			Reason:     cerr.Reason,
+		})
+	}
+	return maskAny(err)
+}
+
+func (c *legacyClient) Ping() error {
+	return legacyError(c.conn.Ping())
+}
+
+func (c *legacyClient) ServerInfo() (ServerInfo, error) {
+	return ServerInfo{}, maskAny(errgo.WithCausef(nil, NotSupportedError, "server info is not supported"))
+}
+
+func (c *legacyClient) ListDatabases() ([]string, error) {
+	names, err := c.conn.GetDBList()
+	return names, legacyError(err)
+}
+
+func (c *legacyClient) CreateDatabase(name string) error {
+	return legacyError(c.conn.CreateDB(name, c.auth))
+}
+
+func (c *legacyClient) DeleteDatabase(name string) error {
+	return legacyError(c.conn.DeleteDB(name, c.auth))
+}
+
+func (c *legacyClient) DatabaseUpdates(since string, timeout time.Duration) ([]DatabaseEvent, string, error) {
+	return nil, since, maskAny(errgo.WithCausef(nil, NotSupportedError, "database updates are not supported"))
+}
+
+func (c *legacyClient) GetUser(name string) (UserDocument, error) {
+	var user UserDocument
+	rev, err := c.conn.GetUser(name, &user, c.auth)
+	if err != nil {
+		return UserDocument{}, legacyError(err)
+	}
+	user.Rev = rev
+	return user, nil
+}
+
+func (c *legacyClient) AddUser(name, password string, roles []string) error {
+	_, err := c.conn.AddUser(name, password, roles, c.auth)
+	return legacyError(err)
+}
+
+func (c *legacyClient) GrantRoles(name string, roles []string) error {
+	for _, r := range roles {
+		if _, err := c.conn.GrantRole(name, r, c.auth); err != nil {
+			return legacyError(err)
+		}
+	}
+	return nil
+}
+
+func (c *legacyClient) DeleteUser(name string) error {
+	user, err := c.GetUser(name)
+	if err != nil {
+		return maskAny(err)
+	}
+	_, err = c.conn.DeleteUser(name, user.Rev, c.auth)
+	return legacyError(err)
+}
+
+func (c *legacyClient) GetSecurity(dbName string) (Security, error) {
+	sec, err := c.conn.SelectDB(dbName, c.auth).GetSecurity()
+	if err != nil {
+		return Security{}, legacyError(err)
+	}
+	return Security{
+		Members: SecurityGroup{Names: sec.Members.Users, Roles: sec.Members.Roles},
+		Admins:  SecurityGroup{Names: sec.Admins.Users, Roles: sec.Admins.Roles},
+	}, nil
+}
+
+func (c *legacyClient) SaveSecurity(dbName string, sec Security) error {
+	return legacyError(c.conn.SelectDB(dbName, c.auth).SaveSecurity(couchdb.Security{
+		Members: couchdb.Members{Users: sec.Members.Names, Roles: sec.Members.Roles},
+		Admins:  couchdb.Members{Users: sec.Admins.Names, Roles: sec.Admins.Roles},
+	}))
+}
+
+func (c *legacyClient) ReadDocument(dbName, id string, doc interface{}) (string, error) {
+	rev, err := c.conn.SelectDB(dbName, c.auth).Read(id, doc, nil)
+	return rev, legacyError(err)
+}
+
+func (c *legacyClient) SaveDocument(dbName, id, rev string, doc interface{}) (string, error) {
+	newRev, err := c.conn.SelectDB(dbName, c.auth).Save(doc, id, rev)
+	return newRev, legacyError(err)
+}
+
+func (c *legacyClient) DeleteDocument(dbName, id, rev string) error {
+	_, err := c.conn.SelectDB(dbName, c.auth).Delete(id, rev)
+	return legacyError(err)
+}
+
+func (c *legacyClient) DatabaseInfo(name string) (DatabaseInfo, error) {
+	return DatabaseInfo{}, maskAny(errgo.WithCausef(nil, NotSupportedError, "database info is not supported"))
+}
+
+func (c *legacyClient) ListDocumentIDs(dbName string) ([]string, error) {
+	return nil, maskAny(errgo.WithCausef(nil, NotSupportedError, "listing documents is not supported"))
+}
+
+func (c *legacyClient) ListDocuments(dbName, startID string, limit int) ([]map[string]interface{}, string, error) {
+	return nil, "", maskAny(errgo.WithCausef(nil, NotSupportedError, "listing documents is not supported"))
+}
+
+func (c *legacyClient) Changes(dbName, since string, limit int) ([]map[string]interface{}, int, string, error) {
+	return nil, 0, since, maskAny(errgo.WithCausef(nil, NotSupportedError, "changes are not supported"))
+}
+
+func (c *legacyClient) BulkDocs(dbName string, docs []map[string]interface{}, newEdits bool) error {
+	return maskAny(errgo.WithCausef(nil, NotSupportedError, "bulk documents are not supported"))
+}
+
+func (c *legacyClient) ActiveTasks() ([]ActiveTask, error) {
+	return nil, maskAny(errgo.WithCausef(nil, NotSupportedError, "active tasks are not supported"))
+}
+
+func (c *legacyClient) SchedulerDocs() ([]SchedulerDoc, error) {
+	return nil, maskAny(errgo.WithCausef(nil, NotSupportedError, "scheduler is not supported"))
+}
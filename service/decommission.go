@@ -0,0 +1,250 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// DecommissionOptions specify how a server is removed from the topology.
+type DecommissionOptions struct {
+	Server      string // Host of the server to remove
+	RemoveUsers bool   // Remove the replicator & editor users from the server
+	Force       bool   // Skip the verification that all data has been replicated out of the server
+}
+
+// Decommission removes a server from the topology. It verifies that all data of the server has been
+// replicated to the remaining servers, removes all replication documents created by this tool that
+// replicate to or from the server and optionally removes the users on the server.
+// The topology of the remaining servers is returned.
+func (s *service) Decommission(opts DecommissionOptions) ([]TopologyEdge, error) {
+	s.startReport()
+	topology, err := s.decommission(opts)
+	s.finishReport(err)
+	return topology, maskAny(err)
+}
+
+func (s *service) decommission(opts DecommissionOptions) ([]TopologyEdge, error) {
+	if err := s.validateTopology(); err != nil {
+		return nil, maskAny(err)
+	}
+	server, found := s.serverURL(opts.Server)
+	if !found {
+		return nil, maskAny(errgo.Newf("unknown server '%s', expected one of the server hosts", opts.Server))
+	}
+	if len(s.Servers) < 2 {
+		return nil, maskAny(errgo.Newf("cannot decommission '%s', it is the only server", opts.Server))
+	}
+
+	conns := make(map[string]*serverConn)
+	for _, srv := range s.Servers {
+		u := srv.URL
+		log := s.log(LogFields{Server: u.Host, Operation: "decommission"})
+		conn, err := s.connect(log, srv)
+		if err != nil {
+			return nil, maskAny(RedactError(err))
+		}
+		if err := requireHTTPClient(conn, "decommissioning"); err != nil {
+			return nil, maskAny(err)
+		}
+		conns[u.String()] = conn
+	}
+	if err := s.discoverDatabases(conns); err != nil {
+		return nil, maskAny(RedactError(err))
+	}
+
+	if opts.Force {
+		s.log(LogFields{Server: server.Host, Operation: "decommission"}).Warningf("Skipping verification of replicated data")
+	} else if err := s.verifyReplicatedOut(server, conns); err != nil {
+		return nil, maskAny(RedactError(err))
+	}
+
+	for _, srv := range s.Servers {
+		u := srv.URL
+		if err := s.removeReplications(conns[u.String()], server); err != nil {
+			return nil, maskAny(RedactError(errgo.Notef(err, "cannot remove replications of '%s' on '%s': %s", server.Host, u.Host, err.Error())))
+		}
+	}
+	if opts.RemoveUsers {
+		conn := conns[server.String()]
+		log := s.log(LogFields{Server: server.Host, Operation: "decommission"})
+		for _, name := range []string{s.replicatorUser(server.Host).UserName, s.EditorUser.UserName} {
+			name := name
+			if err := s.record(log, KindUser, name, s.Retry.User, func() (ActionResult, error) {
+				if err := conn.Admin.DeleteUser(name); isCouchNotFound(err) {
+					return ActionUnchanged, nil
+				} else if err != nil {
+					return "", maskAny(err)
+				}
+				return ActionDeleted, nil
+			}); err != nil {
+				return nil, maskAny(RedactError(errgo.Notef(err, "cannot remove user '%s': %s", name, err.Error())))
+			}
+		}
+	}
+
+	return s.withoutServer(server.Host).topology(), nil
+}
+
+// verifyReplicatedOut checks that every database of the given server that is replicated to another server
+// has been replicated completely: the target contains at least as many documents as the source and the
+// source has not been changed while checking.
+// Edges of filtered or mapped databases cannot be verified by their document counts, they are skipped with a warning.
+func (s *service) verifyReplicatedOut(server url.URL, conns map[string]*serverConn) error {
+	source := conns[server.String()]
+	updateSeqs := make(map[string]string)
+	for _, e := range s.edges() {
+		if e.Source.Host != server.Host {
+			continue
+		}
+		log := s.log(LogFields{Server: server.Host, Database: e.SourceDatabase, Edge: e.String(), Operation: "decommission"})
+		if reason := s.unverifiableReason(e); reason != "" {
+			log.Warningf("Cannot verify replication %s: %s", e.String(), reason)
+			continue
+		}
+		var sourceInfo, targetInfo DatabaseInfo
+		if err := s.Retry.Database.do(log, func() error {
+			var err error
+			if sourceInfo, err = source.Admin.DatabaseInfo(e.SourceDatabase); err != nil {
+				return maskAny(err)
+			}
+			targetInfo, err = conns[e.Target.String()].Admin.DatabaseInfo(e.TargetDatabase)
+			return maskAny(err)
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "cannot verify replication %s: %s", e.String(), err.Error()))
+		}
+		if targetInfo.DocCount < sourceInfo.DocCount {
+			return maskAny(errgo.Newf("replication %s is not complete: %d of %d documents replicated", e.String(), targetInfo.DocCount, sourceInfo.DocCount))
+		}
+		if _, found := updateSeqs[e.SourceDatabase]; !found {
+			updateSeqs[e.SourceDatabase] = sourceInfo.UpdateSeq
+		}
+		log.Debugf("Replication %s is complete (%d documents)", e.String(), sourceInfo.DocCount)
+	}
+
+	// Data written during the verification may not have been replicated
+	for dbName, updateSeq := range updateSeqs {
+		log := s.log(LogFields{Server: server.Host, Database: dbName, Operation: "decommission"})
+		var info DatabaseInfo
+		if err := s.Retry.Database.do(log, func() error {
+			var err error
+			info, err = source.Admin.DatabaseInfo(dbName)
+			return maskAny(err)
+		}); err != nil {
+			return maskAny(err)
+		}
+		if info.UpdateSeq != updateSeq {
+			return maskAny(errgo.Newf("database '%s' on '%s' is still being changed", dbName, server.Host))
+		}
+	}
+	return nil
+}
+
+// unverifiableReason returns why the completeness of the given edge cannot be verified by comparing
+// document counts, or an empty string if it can.
+func (s *service) unverifiableReason(e edge) string {
+	if s.filterOf(e.Database) != nil {
+		return "only part of the documents are replicated (filtered)"
+	}
+	if e.SourceDatabase != e.TargetDatabase {
+		return fmt.Sprintf("'%s' is mapped to '%s', which may hold documents of other databases", e.SourceDatabase, e.TargetDatabase)
+	}
+	return ""
+}
+
+// removeReplications removes all replication documents created by this tool from the given server
+// that replicate to or from the decommissioned server. On the decommissioned server itself,
+// all replication documents created by this tool are removed.
+func (s *service) removeReplications(conn *serverConn, server url.URL) error {
+	log := s.log(LogFields{Server: conn.URL.Host, Database: replicatorDbName, Operation: "decommission"})
+	var ids []string
+	if err := s.Retry.Document.do(log, func() error {
+		var err error
+		ids, err = conn.Admin.ListDocumentIDs(replicatorDbName)
+		return maskAny(err)
+	}); err != nil {
+		return maskAny(err)
+	}
+	self := conn.URL.Host == server.Host
+	for _, id := range ids {
+		if !managedDocumentID.MatchString(id) && !strings.HasPrefix(id, seedDocumentPrefix) {
+			continue
+		}
+		id := id
+		if err := s.record(log, KindDocument, id, s.Retry.Document, func() (ActionResult, error) {
+			var doc map[string]interface{}
+			rev, err := conn.Admin.ReadDocument(replicatorDbName, id, &doc)
+			if isCouchNotFound(err) {
+				return ActionUnchanged, nil
+			} else if err != nil {
+				return "", maskAny(err)
+			}
+			if !self && endpointHost(doc["source"]) != server.Host && endpointHost(doc["target"]) != server.Host {
+				return ActionUnchanged, nil
+			}
+			log.Infof("Removing replication document '%s'", id)
+			if err := conn.Admin.DeleteDocument(replicatorDbName, id, rev); err != nil && !isCouchNotFound(err) {
+				return "", maskAny(err)
+			}
+			return ActionDeleted, nil
+		}); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// endpointHost returns the host of the source or target of a replication document,
+// or an empty string for local databases.
+func endpointHost(endpoint interface{}) string {
+	if u := endpointURL(endpoint); u != nil {
+		return u.Host
+	}
+	return ""
+}
+
+// withoutServer returns a copy of the service from which the given server is removed.
+func (s *service) withoutServer(host string) *service {
+	result := *s
+	result.Servers = nil
+	for _, srv := range s.Servers {
+		if srv.URL.Host != host {
+			result.Servers = append(result.Servers, srv)
+		}
+	}
+	result.EdgePlacements = nil
+	for _, e := range s.EdgePlacements {
+		if e.Source != host && e.Target != host {
+			result.EdgePlacements = append(result.EdgePlacements, e)
+		}
+	}
+	result.Pairs = nil
+	for _, p := range s.Pairs {
+		if p.Host != host && p.Peer != host {
+			result.Pairs = append(result.Pairs, p)
+		}
+	}
+	result.DatabaseMappings = nil
+	for _, m := range s.DatabaseMappings {
+		if m.SourceServer != host && m.TargetServer != host {
+			result.DatabaseMappings = append(result.DatabaseMappings, m)
+		}
+	}
+	return &result
+}
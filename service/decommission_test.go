@@ -0,0 +1,90 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+)
+
+func TestDecommission(t *testing.T) {
+	servers := startFakeCouches(t, 3, "db1")
+	defer closeFakeCouches(servers)
+	s := newTestService(servers, "db1")
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	old := servers[2]
+	old.PutDoc("db1", "doc1", map[string]interface{}{"value": 1})
+	oldURL := old.URL()
+	unmanaged := map[string]interface{}{"source": oldURL.String() + "/db1", "target": "db1"}
+	servers[0].PutDoc(replicatorDbName, "manual", unmanaged)
+
+	// The data of the old server has not been replicated yet
+	opts := DecommissionOptions{Server: old.Host(), RemoveUsers: true}
+	if _, err := s.Decommission(opts); err == nil {
+		t.Fatalf("Expected Decommission to fail before data is replicated")
+	}
+	if docs := servers[0].Docs(replicatorDbName); len(docs) != 3 {
+		t.Errorf("Expected no replication documents to be removed, got %d", len(docs))
+	}
+
+	servers[0].PutDoc("db1", "doc1", map[string]interface{}{"value": 1})
+	servers[1].PutDoc("db1", "doc1", map[string]interface{}{"value": 1})
+	topology, err := s.Decommission(opts)
+	if err != nil {
+		t.Fatalf("Decommission failed: %s", err)
+	}
+	if len(topology) != 2 {
+		t.Errorf("Expected 2 remaining edges, got %v", topology)
+	}
+	for _, e := range topology {
+		if e.Source == old.Host() || e.Target == old.Host() {
+			t.Errorf("Expected decommissioned server to be removed from topology, got %s", e)
+		}
+	}
+	// Unmanaged documents are left alone
+	if docs := servers[0].Docs(replicatorDbName); len(docs) != 2 {
+		t.Errorf("Expected 1 replication document and the unmanaged document on first server, got %v", docs)
+	}
+	if docs := servers[1].Docs(replicatorDbName); len(docs) != 1 {
+		t.Errorf("Expected 1 replication document on second server, got %v", docs)
+	}
+	if docs := old.Docs(replicatorDbName); len(docs) != 0 {
+		t.Errorf("Expected no replication documents on decommissioned server, got %v", docs)
+	}
+	if roles := old.UserRoles(testReplName); len(roles) != 0 {
+		t.Errorf("Expected replicator user to be removed, got roles %v", roles)
+	}
+}
+
+func TestDecommissionSkipsFilteredDatabases(t *testing.T) {
+	servers := startFakeCouches(t, 2, "orders", "users")
+	defer closeFakeCouches(servers)
+	s := newFilterTestService(t, servers, `orders:type == order`)
+	old := servers[1]
+	old.PutDoc("orders", "note1", map[string]interface{}{"type": "note"})
+	old.PutDoc("users", "user1", map[string]interface{}{"name": "user1"})
+
+	// Unfiltered databases are still verified
+	opts := DecommissionOptions{Server: old.Host()}
+	if _, err := s.Decommission(opts); err == nil {
+		t.Fatalf("Expected Decommission to fail before unfiltered data is replicated")
+	}
+	// Filtered documents are never replicated, so the filtered database is not verified
+	servers[0].PutDoc("users", "user1", map[string]interface{}{"name": "user1"})
+	if _, err := s.Decommission(opts); err != nil {
+		t.Fatalf("Decommission failed: %s", err)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	designDocPrefix = "_design/"
+)
+
+// DesignDocument is a design document that is installed in a replicated database on all servers.
+type DesignDocument struct {
+	Database string                 // Name of the database as given in DatabaseNames (or discovered)
+	ID       string                 // ID of the document, including the `_design/` prefix
+	Fields   map[string]interface{} // Content of the document, without `_id` & `_rev`
+}
+
+// LoadDesignDocuments loads all design documents from the given directory.
+// The directory contains a directory per database, which contains the design documents of that database,
+// either as JSON file (`<name>.json`) or as couchapp-style directory (`<name>/`).
+// In a couchapp-style directory, every directory becomes an object and every file a field named after
+// the file without extension. JSON files are decoded, all other files are used as strings.
+func LoadDesignDocuments(dir string) ([]DesignDocument, error) {
+	dbDirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	var result []DesignDocument
+	for _, dbDir := range dbDirs {
+		if !dbDir.IsDir() || isHidden(dbDir.Name()) {
+			continue
+		}
+		dbName := dbDir.Name()
+		entries, err := ioutil.ReadDir(filepath.Join(dir, dbName))
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, dbName, entry.Name())
+			var fields map[string]interface{}
+			var name string
+			if isHidden(entry.Name()) {
+				continue
+			} else if entry.IsDir() {
+				name = entry.Name()
+				if fields, err = loadCouchappDir(path); err != nil {
+					return nil, maskAny(err)
+				}
+			} else if filepath.Ext(entry.Name()) == ".json" {
+				name = strings.TrimSuffix(entry.Name(), ".json")
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					return nil, maskAny(err)
+				}
+				if err := json.Unmarshal(data, &fields); err != nil {
+					return nil, maskAny(errgo.Notef(err, "invalid design document '%s': %s", path, err.Error()))
+				}
+			} else {
+				continue
+			}
+			id := designDocPrefix + name
+			if docID, ok := fields["_id"].(string); ok {
+				if !strings.HasPrefix(docID, designDocPrefix) {
+					return nil, maskAny(errgo.Newf("design document '%s' has invalid _id '%s'", path, docID))
+				}
+				id = docID
+			}
+			delete(fields, "_id")
+			delete(fields, "_rev")
+			result = append(result, DesignDocument{Database: dbName, ID: id, Fields: fields})
+		}
+	}
+	return result, nil
+}
+
+// loadCouchappDir loads a directory of a couchapp-style design document into an object.
+func loadCouchappDir(dir string) (map[string]interface{}, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	result := make(map[string]interface{})
+	for _, entry := range entries {
+		if isHidden(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			value, err := loadCouchappDir(path)
+			if err != nil {
+				return nil, maskAny(err)
+			}
+			result[entry.Name()] = value
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		ext := filepath.Ext(entry.Name())
+		key := strings.TrimSuffix(entry.Name(), ext)
+		if ext == ".json" {
+			var value interface{}
+			if err := json.Unmarshal(data, &value); err != nil {
+				return nil, maskAny(errgo.Notef(err, "invalid JSON in '%s': %s", path, err.Error()))
+			}
+			result[key] = value
+		} else {
+			result[key] = strings.TrimSpace(string(data))
+		}
+	}
+	return result, nil
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// installDesignDocuments creates or updates all design documents of the databases
+// that are replicated on the given server.
+func (s *service) installDesignDocuments(conn *serverConn) error {
+	host := conn.URL.Host
+	for _, d := range s.designDocuments() {
+		if !s.isReplicatedOn(host, d.Database) {
+			continue
+		}
+		d := d
+		dbName := s.databaseName(host, d.Database)
+		log := s.log(LogFields{Server: host, Database: dbName, Operation: "install-design-document"})
+		if err := s.record(log, KindDesign, d.ID, s.Retry.Document, func() (ActionResult, error) {
+			return s.updateOrCreate(log, conn.Admin, dbName, d.ID, d.Fields)
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "failed to install design document '%s' in '%s': %s", d.ID, dbName, err.Error()))
+		}
+	}
+	return nil
+}
+
+// designDocuments returns all design documents to install, including the documents generated
+// from ValidationSchemas and Filters.
+func (s *service) designDocuments() []DesignDocument {
+	result := append([]DesignDocument{}, s.DesignDocuments...)
+	result = append(result, s.filterDesignDocuments()...)
+	for _, v := range s.ValidationSchemas {
+		result = append(result, v.DesignDocument())
+	}
+	return result
+}
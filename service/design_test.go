@@ -0,0 +1,109 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %s", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+}
+
+func TestLoadDesignDocuments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "couchdb-repl")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "db1", "app.json"), `{"_id": "_design/app", "_rev": "1-x", "views": {"all": {"map": "function(doc) { emit(doc._id) }"}}}`)
+	writeTestFile(t, filepath.Join(dir, "db1", "couchapp", "views", "byName", "map.js"), "function(doc) { emit(doc.name) }\n")
+	writeTestFile(t, filepath.Join(dir, "db1", "couchapp", "validate_doc_update.js"), "function(newDoc) {}\n")
+	writeTestFile(t, filepath.Join(dir, "db1", "couchapp", "options.json"), `{"local_seq": true}`)
+	writeTestFile(t, filepath.Join(dir, "db1", ".hidden.json"), `{`)
+
+	docs, err := LoadDesignDocuments(dir)
+	if err != nil {
+		t.Fatalf("LoadDesignDocuments failed: %s", err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("Expected 2 design documents, got %d", len(docs))
+	}
+	if d := docs[0]; d.Database != "db1" || d.ID != "_design/app" || d.Fields["_rev"] != nil || d.Fields["_id"] != nil {
+		t.Errorf("Unexpected JSON design document %+v", d)
+	}
+	d := docs[1]
+	if d.ID != "_design/couchapp" || d.Fields["validate_doc_update"] != "function(newDoc) {}" {
+		t.Errorf("Unexpected couchapp design document %+v", d)
+	}
+	if views, _ := d.Fields["views"].(map[string]interface{}); views["byName"].(map[string]interface{})["map"] != "function(doc) { emit(doc.name) }" {
+		t.Errorf("Unexpected views %+v", d.Fields["views"])
+	}
+	if options, _ := d.Fields["options"].(map[string]interface{}); options["local_seq"] != true {
+		t.Errorf("Unexpected options %+v", d.Fields["options"])
+	}
+}
+
+func TestRunInstallsDesignDocuments(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	s := newTestService(servers, "db1")
+	s.DesignDocuments = []DesignDocument{{
+		Database: "db1",
+		ID:       "_design/app",
+		Fields:   map[string]interface{}{"filters": map[string]interface{}{"mine": "function(doc) { return true }"}},
+	}}
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	for _, fc := range servers {
+		if _, found := fc.Docs("db1")["_design/app"]; !found {
+			t.Errorf("Expected design document to be installed, got %v", fc.Docs("db1"))
+		}
+		puts := fc.Requests("PUT", "/")
+		design, repl := -1, -1
+		for i, r := range puts {
+			if r == "PUT /db1/_design/app" {
+				design = i
+			} else if repl < 0 && strings.HasPrefix(r, "PUT /_replicator/") && r != "PUT /_replicator/_security" {
+				repl = i
+			}
+		}
+		if design < 0 || repl < 0 || design > repl {
+			t.Errorf("Expected design document to be installed before replication documents, got %v", puts)
+		}
+		fc.ResetRequests()
+	}
+	if err := s.Run(); err != nil {
+		t.Fatalf("Second run failed: %s", err)
+	}
+	for _, fc := range servers {
+		if puts := fc.Requests("PUT", "/db1/_design/"); len(puts) != 0 {
+			t.Errorf("Expected unchanged design document not to be written, got %v", puts)
+		}
+	}
+	if drifts, err := s.Diff(); err != nil || len(drifts) != 0 {
+		t.Errorf("Expected no drift, got %v (%v)", drifts, err)
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// DriftProblem describes how the live state differs from the desired state.
+type DriftProblem string
+
+const (
+	DriftMissing    DriftProblem = "missing"    // The object does not exist
+	DriftDifferent  DriftProblem = "different"  // The object exists, but differs from the desired state
+	DriftUnexpected DriftProblem = "unexpected" // The object exists, but is not part of the desired state
+)
+
+// Drift is a single difference between the live state of a server and the desired state.
+// It never contains credentials.
+type Drift struct {
+	Server   string       `json:"server"`
+	Database string       `json:"database,omitempty"`
+	Kind     string       `json:"kind"`
+	Name     string       `json:"name"`
+	Problem  DriftProblem `json:"drift"`
+	Expected string       `json:"expected,omitempty"`
+	Actual   string       `json:"actual,omitempty"`
+}
+
+// String returns the drift as a single line of space separated `key=value` pairs.
+func (d Drift) String() string {
+	parts := []string{"server=" + d.Server}
+	if d.Database != "" {
+		parts = append(parts, "database="+d.Database)
+	}
+	parts = append(parts, "kind="+d.Kind, "name="+d.Name, "drift="+string(d.Problem))
+	if d.Expected != "" {
+		parts = append(parts, fmt.Sprintf("expected=%q", d.Expected))
+	}
+	if d.Actual != "" {
+		parts = append(parts, fmt.Sprintf("actual=%q", d.Actual))
+	}
+	return strings.Join(parts, " ")
+}
+
+// managedDocumentID matches the IDs of replication documents created by this tool (see createId).
+var managedDocumentID = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// Diff compares the live state of all servers with the desired state and returns all differences,
+// sorted by server, database, kind & name. Diff never changes anything.
+func (s *service) Diff() ([]Drift, error) {
+	if err := s.validateTopology(); err != nil {
+		return nil, maskAny(err)
+	}
+	conns := make(map[string]*serverConn)
+	for _, srv := range s.Servers {
+		u := srv.URL
+		log := s.log(LogFields{Server: u.Host, Operation: "diff"})
+		conn, err := s.connect(log, srv)
+		if err != nil {
+			return nil, maskAny(RedactError(err))
+		}
+		conns[u.String()] = conn
+	}
+	if err := s.discoverDatabases(conns); err != nil {
+		return nil, maskAny(RedactError(err))
+	}
+
+	var drifts []Drift
+	for _, srv := range s.Servers {
+		u := srv.URL
+		conn := conns[u.String()]
+		serverDrifts, err := s.diffServer(conn)
+		if err != nil {
+			return nil, maskAny(RedactError(errgo.Notef(err, "cannot compare '%s': %s", u.Host, err.Error())))
+		}
+		drifts = append(drifts, serverDrifts...)
+	}
+	sort.Sort(driftsByKey(drifts))
+	return drifts, nil
+}
+
+// diffServer compares the users, database security and replication documents of a single server.
+func (s *service) diffServer(conn *serverConn) ([]Drift, error) {
+	host := conn.URL.Host
+	var drifts []Drift
+	add := func(d Drift) {
+		d.Server = host
+		d.Expected, d.Actual = Redact(d.Expected), Redact(d.Actual)
+		drifts = append(drifts, d)
+	}
+
+	// Users
+	type userRoles struct {
+		name  string
+		roles []string
+	}
+	var users []userRoles
+	flavor := s.flavor(host)
+	if flavor.ManagesUsers() {
+		users = []userRoles{
+			{s.replicatorUser(host).UserName, []string{roleReplicator}},
+			{s.EditorUser.UserName, []string{roleEditor}},
+		}
+	}
+	for _, u := range users {
+		user, err := conn.Admin.GetUser(u.name)
+		if isCouchNotFound(err) {
+			add(Drift{Kind: KindUser, Name: u.name, Problem: DriftMissing, Expected: rolesString(u.roles)})
+			continue
+		} else if err != nil {
+			return nil, maskAny(err)
+		}
+		if _, changed := addMissing(user.Roles, u.roles, false); changed {
+			add(Drift{Kind: KindUser, Name: u.name, Problem: DriftDifferent, Expected: rolesString(u.roles), Actual: rolesString(user.Roles)})
+		}
+	}
+
+	// Database security
+	dbNames := s.databasesOn(host)
+	if flavor.HostsReplications() {
+		dbNames = append([]string{replicatorDbName}, dbNames...)
+	}
+	for _, dbName := range dbNames {
+		if !flavor.ManagesSecurity() {
+			// Only check that the database exists
+			if _, err := conn.Admin.DatabaseInfo(dbName); isCouchNotFound(err) {
+				add(Drift{Database: dbName, Kind: KindDatabase, Name: dbName, Problem: DriftMissing})
+			} else if err != nil {
+				return nil, maskAny(err)
+			}
+			continue
+		}
+		sec, err := conn.Admin.GetSecurity(dbName)
+		if isCouchNotFound(err) {
+			add(Drift{Database: dbName, Kind: KindDatabase, Name: dbName, Problem: DriftMissing})
+			continue
+		} else if err != nil {
+			return nil, maskAny(err)
+		}
+		expected := s.databaseSecurity(host, dbName)
+		changed := false
+		_, changed = addMissing(sec.Members.Names, expected.Members.Names, changed)
+		_, changed = addMissing(sec.Members.Roles, expected.Members.Roles, changed)
+		_, changed = addMissing(sec.Admins.Names, expected.Admins.Names, changed)
+		_, changed = addMissing(sec.Admins.Roles, expected.Admins.Roles, changed)
+		for key, permissions := range expected.Cloudant {
+			_, changed = addMissing(sec.Cloudant[key], permissions, changed)
+		}
+		if changed {
+			add(Drift{
+				Database: dbName,
+				Kind:     KindSecurity,
+				Name:     dbName,
+				Problem:  DriftDifferent,
+				Expected: securityString(expected),
+				Actual:   securityString(sec),
+			})
+		}
+	}
+
+	// Design documents
+	for _, d := range s.designDocuments() {
+		if !s.isReplicatedOn(host, d.Database) {
+			continue
+		}
+		dbName := s.databaseName(host, d.Database)
+		expected, err := documentFields(d.Fields)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		var doc map[string]interface{}
+		if _, err := conn.Admin.ReadDocument(dbName, d.ID, &doc); isCouchNotFound(err) {
+			add(Drift{Database: dbName, Kind: KindDesign, Name: d.ID, Problem: DriftMissing})
+			continue
+		} else if err != nil {
+			return nil, maskAny(err)
+		}
+		if exp, act := fieldDifferences(expected, userFields(doc)); exp != "" || act != "" {
+			add(Drift{Database: dbName, Kind: KindDesign, Name: d.ID, Problem: DriftDifferent, Expected: exp, Actual: act})
+		}
+	}
+
+	// Replication documents
+	expectedIDs := make(map[string]bool)
+	for _, e := range s.edges() {
+		if e.Host().Host != host {
+			continue
+		}
+		replDoc, err := s.replicationDocument(e)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		id := createId(replDoc)
+		expectedIDs[id] = true
+		expected, err := documentFields(replDoc)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		var doc map[string]interface{}
+		if _, err := conn.Admin.ReadDocument(replicatorDbName, id, &doc); isCouchNotFound(err) {
+			add(Drift{Database: e.HostDatabase(), Kind: KindDocument, Name: id, Problem: DriftMissing, Expected: e.String()})
+			continue
+		} else if err != nil {
+			return nil, maskAny(err)
+		}
+		if exp, act := fieldDifferences(expected, userFields(doc)); exp != "" || act != "" {
+			add(Drift{Database: e.HostDatabase(), Kind: KindDocument, Name: id, Problem: DriftDifferent, Expected: exp, Actual: act})
+		}
+	}
+	if !flavor.HostsReplications() {
+		return drifts, nil
+	}
+	ids, err := conn.Admin.ListDocumentIDs(replicatorDbName)
+	if isNotSupported(err) {
+		s.log(LogFields{Server: host, Database: replicatorDbName, Operation: "diff"}).Warningf("Cannot list replication documents, skipping check for unexpected replications (requires the http client)")
+	} else if err != nil {
+		return nil, maskAny(err)
+	}
+	for _, id := range ids {
+		if managedDocumentID.MatchString(id) && !expectedIDs[id] {
+			add(Drift{Database: replicatorDbName, Kind: KindDocument, Name: id, Problem: DriftUnexpected})
+		}
+	}
+
+	return drifts, nil
+}
+
+// fieldDifferences returns the fields that differ between the given documents,
+// formatted as `key=value` pairs, for the expected and actual document.
+func fieldDifferences(expected, actual map[string]interface{}) (string, string) {
+	keys := make(map[string]bool)
+	for k := range expected {
+		keys[k] = true
+	}
+	for k := range actual {
+		keys[k] = true
+	}
+	var sorted []string
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	var exp, act []string
+	for _, k := range sorted {
+		e, eFound := expected[k]
+		a, aFound := actual[k]
+		if eFound == aFound && reflect.DeepEqual(e, a) {
+			continue
+		}
+		if eFound {
+			exp = append(exp, k+"="+jsonString(e))
+		}
+		if aFound {
+			act = append(act, k+"="+jsonString(a))
+		}
+	}
+	return strings.Join(exp, " "), strings.Join(act, " ")
+}
+
+func jsonString(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+func rolesString(roles []string) string {
+	return "[" + strings.Join(sortedCopy(roles), ",") + "]"
+}
+
+// securityString formats the roles (and names, if any) of a security object.
+func securityString(sec Security) string {
+	group := func(g SecurityGroup) string {
+		if len(g.Names) == 0 {
+			return rolesString(g.Roles)
+		}
+		return rolesString(g.Roles) + " names " + rolesString(g.Names)
+	}
+	if len(sec.Cloudant) > 0 {
+		var keys []string
+		for key, permissions := range sec.Cloudant {
+			keys = append(keys, key+" "+rolesString(permissions))
+		}
+		return "cloudant " + strings.Join(sortedCopy(keys), ", ")
+	}
+	return fmt.Sprintf("members %s, admins %s", group(sec.Members), group(sec.Admins))
+}
+
+type driftsByKey []Drift
+
+func (l driftsByKey) Len() int      { return len(l) }
+func (l driftsByKey) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l driftsByKey) Less(i, j int) bool {
+	a, b := l[i], l[j]
+	if a.Server != b.Server {
+		return a.Server < b.Server
+	}
+	if a.Database != b.Database {
+		return a.Database < b.Database
+	}
+	if a.Kind != b.Kind {
+		return a.Kind < b.Kind
+	}
+	return a.Name < b.Name
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffReportsDrift(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+
+	s := newTestService(servers, "db1")
+	drifts, err := s.Diff()
+	if err != nil {
+		t.Fatalf("Diff failed: %s", err)
+	}
+	// Per server: 2 users, 2 security objects & 1 replication document
+	if len(drifts) != 10 {
+		t.Errorf("Expected 10 drifts before setup, got %d: %v", len(drifts), drifts)
+	}
+	for _, fc := range servers {
+		if writes := fc.Requests("PUT", "/"); len(writes) > 0 {
+			t.Errorf("Expected Diff to change nothing, got %v", writes)
+		}
+	}
+
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	if drifts, err := s.Diff(); err != nil {
+		t.Fatalf("Diff failed: %s", err)
+	} else if len(drifts) != 0 {
+		t.Errorf("Expected no drift after setup, got %v", drifts)
+	}
+
+	// Change a replication document & add an unexpected one
+	fc := servers[0]
+	for id, doc := range fc.Docs(replicatorDbName) {
+		doc["continuous"] = false
+		fc.PutDoc(replicatorDbName, id, doc)
+	}
+	fc.PutDoc(replicatorDbName, strings.Repeat("a", 40), map[string]interface{}{"source": "x", "target": "y"})
+	drifts, err = s.Diff()
+	if err != nil {
+		t.Fatalf("Diff failed: %s", err)
+	}
+	if len(drifts) != 2 {
+		t.Fatalf("Expected 2 drifts, got %v", drifts)
+	}
+	if d := drifts[1]; d.Database != "db1" || d.Problem != DriftDifferent || d.Expected != "continuous=true" || d.Actual != "continuous=false" {
+		t.Errorf("Expected changed continuous field, got %s", d)
+	}
+	if d := drifts[0]; d.Database != replicatorDbName || d.Problem != DriftUnexpected {
+		t.Errorf("Expected unexpected document, got %s", d)
+	}
+	for _, d := range drifts {
+		if strings.Contains(d.String(), testReplPass) {
+			t.Errorf("Drift contains credentials: %s", d)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// DatabasePattern matches database names, using a glob (`tenant_*`)
+// or a regular expression (`/^tenant_[0-9]+$/`).
+type DatabasePattern struct {
+	source string
+	glob   string
+	re     *regexp.Regexp
+}
+
+// ParseDatabasePattern parses a glob pattern, or a regular expression when enclosed in slashes.
+func ParseDatabasePattern(value string) (DatabasePattern, error) {
+	if len(value) > 2 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/") {
+		re, err := regexp.Compile(value[1 : len(value)-1])
+		if err != nil {
+			return DatabasePattern{}, maskAny(errgo.Notef(err, "invalid database regular expression '%s'", value))
+		}
+		return DatabasePattern{source: value, re: re}, nil
+	}
+	if _, err := path.Match(value, ""); err != nil {
+		return DatabasePattern{}, maskAny(errgo.Notef(err, "invalid database pattern '%s'", value))
+	}
+	return DatabasePattern{source: value, glob: value}, nil
+}
+
+// Match returns true if the given database name matches the pattern.
+func (p DatabasePattern) Match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	matched, _ := path.Match(p.glob, name)
+	return matched
+}
+
+// String returns the pattern as it was parsed.
+func (p DatabasePattern) String() string {
+	return p.source
+}
+
+// discoveryEnabled returns true if databases must be discovered on the servers.
+func (s *service) discoveryEnabled() bool {
+	return s.AllDatabases || len(s.DatabasePatterns) > 0 || s.PerUserDatabases
+}
+
+// isDiscoverable returns true if a database with given name, found on one of the servers, must be replicated.
+func (s *service) isDiscoverable(name string) bool {
+	if strings.HasPrefix(name, "_") {
+		// Never replicate system databases
+		return false
+	}
+	for _, p := range s.ExcludeDatabases {
+		if p.Match(name) {
+			return false
+		}
+	}
+	if user, ok := s.perUserOwner(name); ok {
+		// Per-user databases are only replicated while their user exists
+		return s.users[user]
+	}
+	if s.AllDatabases {
+		return true
+	}
+	for _, p := range s.DatabasePatterns {
+		if p.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// replicatedDatabases returns the names of all databases that are replicated between all servers,
+// which are the configured databases, followed by all discovered databases.
+func (s *service) replicatedDatabases() []string {
+	result := append([]string{}, s.DatabaseNames...)
+	for _, name := range s.discovered {
+		found := false
+		for _, x := range s.DatabaseNames {
+			if x == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// logicalDatabaseName returns the name of the database as it is used in DatabaseNames,
+// for a database with given name on the server with given host.
+func (s *service) logicalDatabaseName(host, name string) string {
+	for _, o := range s.DatabaseOverrides {
+		if o.Server == host && o.Name == name {
+			return o.Database
+		}
+	}
+	return name
+}
+
+// discoverDatabases lists the databases of all servers and records the union of
+// all matching databases, so they are replicated. Servers without a connection in conns are skipped.
+func (s *service) discoverDatabases(conns map[string]*serverConn) error {
+	if !s.discoveryEnabled() {
+		return nil
+	}
+	if s.PerUserDatabases {
+		if err := s.discoverUsers(conns); err != nil {
+			return maskAny(err)
+		}
+	}
+	found := make(map[string]bool)
+	s.existing = make(map[string]map[string]bool)
+	for _, srv := range s.Servers {
+		u := srv.URL
+		log := s.log(LogFields{Server: u.Host, Operation: "discover-databases"})
+		conn, connected := conns[u.String()]
+		if !connected {
+			continue
+		}
+		var names []string
+		if err := s.Retry.Database.do(log, func() error {
+			var err error
+			names, err = conn.Admin.ListDatabases()
+			return maskAny(err)
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "cannot list databases of '%s': %s", RedactURL(u), err.Error()))
+		}
+		existing := make(map[string]bool)
+		for _, name := range names {
+			existing[name] = true
+			if logical := s.logicalDatabaseName(u.Host, name); s.isDiscoverable(logical) {
+				if !found[logical] {
+					log.Debugf("Discovered database '%s'", logical)
+				}
+				found[logical] = true
+			}
+		}
+		s.existing[u.Host] = existing
+	}
+	s.discovered = nil
+	for name := range found {
+		s.discovered = append(s.discovered, name)
+	}
+	sort.Strings(s.discovered)
+	return nil
+}
+
+// createMissingDatabases creates all discovered databases that do not yet exist on the given server.
+func (s *service) createMissingDatabases(log fieldLogger, conn *serverConn) error {
+	host := conn.URL.Host
+	existing := s.existing[host]
+	for _, name := range s.discovered {
+		dbName := s.databaseName(host, name)
+		if existing[dbName] || !s.isReplicatedOn(host, name) {
+			continue
+		}
+		dbLog := log.With(func(f *LogFields) {
+			f.Database = dbName
+			f.Operation = "create-database"
+		})
+		dbLog.Infof("Creating database '%s'", dbName)
+		if err := s.record(dbLog, KindDatabase, dbName, s.Retry.Database, func() (ActionResult, error) {
+			if err := conn.Admin.CreateDatabase(dbName); isCouchPreconditionFailed(err) {
+				return ActionUnchanged, nil
+			} else if err != nil {
+				return "", maskAny(err)
+			}
+			return ActionCreated, nil
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "cannot create database '%s': %s", dbName, err.Error()))
+		}
+		existing[dbName] = true
+	}
+	return nil
+}
@@ -0,0 +1,744 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	testAdminName  = "admin"
+	testAdminPass  = "admin-secret"
+	testReplName   = "repl"
+	testReplPass   = "repl-secret"
+	testEditorName = "editor"
+	testEditorPass = "editor-secret"
+)
+
+func init() {
+	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+}
+
+// fakeCouch is an in-process HTTP fake of the CouchDB endpoints used by this package.
+// It records all state (databases, documents, security objects, users) and all requests,
+// and can be instructed to fail requests.
+type fakeCouch struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mutex    sync.Mutex
+	admin    UserInfo
+	dbs      map[string]*fakeDB
+	users    map[string]string // name -> password
+	requests []string          // "METHOD /path" of every request
+	failures []*fakeFailure
+
+	// When set, the fake mimics the CouchDB replicator by adding state fields
+	// to every document saved in the _replicator database.
+	replicatorState bool
+	// State of one-shot replications when replicatorState is set (default completed).
+	oneShotState string
+	// CouchDB version reported by the server root (default 1.6.1).
+	// Like CouchDB 1.x, 1.x versions forbid updates of triggered replication documents.
+	version string
+	// When set, every _changes response has a different last_seq, also when nothing changed,
+	// like the opaque sequences of clustered CouchDB servers.
+	opaqueSeqs bool
+	seqCount   int
+}
+
+type fakeDB struct {
+	docs      map[string]map[string]interface{}
+	security  map[string]interface{}
+	updateSeq int
+	changes   map[string]fakeChange // Last change by document ID
+}
+
+// fakeChange is the last change of a document, as reported by _changes.
+type fakeChange struct {
+	seq     int
+	rev     string
+	deleted bool
+}
+
+// fakeFailure makes requests fail with a given status.
+type fakeFailure struct {
+	method     string
+	pathPrefix string
+	status     int
+	remaining  int // Number of requests to fail, negative means forever
+}
+
+// newFakeCouch starts a new fake server with given admin credentials and
+// the given (user) databases. Call Close when done.
+func newFakeCouch(t *testing.T, dbNames ...string) *fakeCouch {
+	fc := &fakeCouch{
+		t:            t,
+		admin:        UserInfo{UserName: testAdminName, Password: testAdminPass},
+		dbs:          make(map[string]*fakeDB),
+		users:        make(map[string]string),
+		oneShotState: "completed",
+		version:      "1.6.1",
+	}
+	fc.dbs[usersDbName] = newFakeDB()
+	fc.dbs[replicatorDbName] = newFakeDB()
+	for _, name := range dbNames {
+		fc.dbs[name] = newFakeDB()
+	}
+	fc.server = httptest.NewServer(http.HandlerFunc(fc.serveHTTP))
+	return fc
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		docs:     make(map[string]map[string]interface{}),
+		security: make(map[string]interface{}),
+		changes:  make(map[string]fakeChange),
+	}
+}
+
+// Close stops the server.
+func (fc *fakeCouch) Close() {
+	fc.server.Close()
+}
+
+// URL returns the URL of the server.
+func (fc *fakeCouch) URL() url.URL {
+	u, err := url.Parse(fc.server.URL)
+	if err != nil {
+		fc.t.Fatalf("Cannot parse server URL: %#v", err)
+	}
+	return *u
+}
+
+// Host returns the host (host:port) of the server.
+func (fc *fakeCouch) Host() string {
+	return fc.URL().Host
+}
+
+// Fail makes the next `times` requests with given method, whose path starts with given prefix,
+// fail with given status. A negative times makes all matching requests fail.
+func (fc *fakeCouch) Fail(method, pathPrefix string, status, times int) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.failures = append(fc.failures, &fakeFailure{method: method, pathPrefix: pathPrefix, status: status, remaining: times})
+}
+
+// ClearFailures removes all failures.
+func (fc *fakeCouch) ClearFailures() {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.failures = nil
+}
+
+// Requests returns all requests with given method, whose path starts with given prefix.
+func (fc *fakeCouch) Requests(method, pathPrefix string) []string {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	var result []string
+	for _, r := range fc.requests {
+		if strings.HasPrefix(r, method+" "+pathPrefix) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// ResetRequests clears the recorded requests.
+func (fc *fakeCouch) ResetRequests() {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.requests = nil
+}
+
+// AddUser creates a user with given password and roles.
+func (fc *fakeCouch) AddUser(name, password string, roles ...string) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.users[name] = password
+	if roles == nil {
+		roles = []string{}
+	}
+	rolesList := make([]interface{}, 0, len(roles))
+	for _, r := range roles {
+		rolesList = append(rolesList, r)
+	}
+	fc.putDoc(fc.dbs[usersDbName], userDocPrefix+name, map[string]interface{}{
+		"name":  name,
+		"type":  "user",
+		"roles": rolesList,
+	})
+}
+
+// RemoveUser deletes a user, as if it was deleted by another client.
+func (fc *fakeCouch) RemoveUser(name string) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	delete(fc.users, name)
+	delete(fc.dbs[usersDbName].docs, userDocPrefix+name)
+}
+
+// AddDatabase creates a database.
+func (fc *fakeCouch) AddDatabase(name string) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	if _, found := fc.dbs[name]; !found {
+		fc.dbs[name] = newFakeDB()
+	}
+}
+
+// Databases returns the names of all databases.
+func (fc *fakeCouch) Databases() []string {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return fc.dbNames()
+}
+
+// UserRoles returns the roles of the given user, or nil if the user does not exist.
+func (fc *fakeCouch) UserRoles(name string) []string {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	doc, found := fc.dbs[usersDbName].docs[userDocPrefix+name]
+	if !found {
+		return nil
+	}
+	roles := []string{}
+	list, _ := doc["roles"].([]interface{})
+	for _, r := range list {
+		roles = append(roles, fmt.Sprint(r))
+	}
+	return roles
+}
+
+// Security returns the member and admin roles of the given database.
+func (fc *fakeCouch) Security(dbName string) (members, admins []string) {
+	return fc.securityList(dbName, "members", "roles"), fc.securityList(dbName, "admins", "roles")
+}
+
+// SecurityNames returns the member and admin names of the given database.
+func (fc *fakeCouch) SecurityNames(dbName string) (members, admins []string) {
+	return fc.securityList(dbName, "members", "names"), fc.securityList(dbName, "admins", "names")
+}
+
+func (fc *fakeCouch) securityList(dbName, section, key string) []string {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	db, found := fc.dbs[dbName]
+	if !found {
+		fc.t.Fatalf("Database '%s' does not exist", dbName)
+	}
+	result := []string{}
+	group, _ := db.security[section].(map[string]interface{})
+	list, _ := group[key].([]interface{})
+	for _, x := range list {
+		result = append(result, fmt.Sprint(x))
+	}
+	return result
+}
+
+// Docs returns a copy of all documents in the given database.
+func (fc *fakeCouch) Docs(dbName string) map[string]map[string]interface{} {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	result := make(map[string]map[string]interface{})
+	db, found := fc.dbs[dbName]
+	if !found {
+		return result
+	}
+	for id, doc := range db.docs {
+		result[id] = copyDoc(doc)
+	}
+	return result
+}
+
+// PutDoc stores a document in the given database, as if it was written by another client.
+func (fc *fakeCouch) PutDoc(dbName, id string, doc map[string]interface{}) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.putDoc(fc.dbs[dbName], id, copyDoc(doc))
+}
+
+// DeleteDoc deletes a document from the given database, as if it was deleted by another client.
+func (fc *fakeCouch) DeleteDoc(dbName, id string) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	db := fc.dbs[dbName]
+	rev := tombstoneRevision(fmt.Sprint(db.docs[id]["_rev"]))
+	delete(db.docs, id)
+	db.updateSeq++
+	db.changes[id] = fakeChange{seq: db.updateSeq, rev: rev, deleted: true}
+}
+
+func (fc *fakeCouch) dbNames() []string {
+	var names []string
+	for name := range fc.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// putDoc stores the given document under a new revision and returns that revision.
+func (fc *fakeCouch) putDoc(db *fakeDB, id string, doc map[string]interface{}) string {
+	gen := 1
+	if old, found := db.docs[id]; found {
+		fmt.Sscanf(fmt.Sprint(old["_rev"]), "%d-", &gen)
+		gen++
+	}
+	delete(doc, "_rev")
+	delete(doc, "_id")
+	data, _ := json.Marshal(doc)
+	rev := fmt.Sprintf("%d-%x", gen, md5.Sum(data))
+	doc["_id"] = id
+	doc["_rev"] = rev
+	db.docs[id] = doc
+	db.updateSeq++
+	db.changes[id] = fakeChange{seq: db.updateSeq, rev: rev}
+	return rev
+}
+
+// replicateDoc stores the given document with its own revision, as _bulk_docs with new_edits=false does.
+// The document is ignored if the database already holds a newer revision.
+func (db *fakeDB) replicateDoc(doc map[string]interface{}) {
+	id, rev := fmt.Sprint(doc["_id"]), fmt.Sprint(doc["_rev"])
+	if c, found := db.changes[id]; found && revisionGeneration(c.rev) >= revisionGeneration(rev) {
+		return
+	}
+	db.updateSeq++
+	if deleted, _ := doc["_deleted"].(bool); deleted {
+		delete(db.docs, id)
+		db.changes[id] = fakeChange{seq: db.updateSeq, rev: rev, deleted: true}
+		return
+	}
+	db.docs[id] = copyDoc(doc)
+	db.changes[id] = fakeChange{seq: db.updateSeq, rev: rev}
+}
+
+// tombstoneRevision returns the revision of the tombstone of a document deleted at the given revision.
+func tombstoneRevision(rev string) string {
+	return fmt.Sprintf("%d-%x", revisionGeneration(rev)+1, md5.Sum([]byte(rev)))
+}
+
+func revisionGeneration(rev string) int {
+	gen := 0
+	fmt.Sscanf(rev, "%d-", &gen)
+	return gen
+}
+
+// changesSince returns the _changes response for the given query (since, limit & include_docs).
+func (db *fakeDB) changesSince(q url.Values) map[string]interface{} {
+	var since int
+	fmt.Sscanf(q.Get("since"), "%d", &since)
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	bySeq := make(map[int]string)
+	for id, c := range db.changes {
+		bySeq[c.seq] = id
+	}
+	var ids []string
+	for seq := since + 1; seq <= db.updateSeq; seq++ {
+		if id, found := bySeq[seq]; found {
+			ids = append(ids, id)
+		}
+	}
+	lastSeq := db.updateSeq
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+		lastSeq = db.changes[ids[limit-1]].seq
+	}
+	results := []map[string]interface{}{}
+	for _, id := range ids {
+		c := db.changes[id]
+		result := map[string]interface{}{"seq": c.seq, "id": id, "changes": []map[string]interface{}{{"rev": c.rev}}}
+		if c.deleted {
+			result["deleted"] = true
+		}
+		if q.Get("include_docs") == "true" {
+			if c.deleted {
+				result["doc"] = map[string]interface{}{"_id": id, "_rev": c.rev, "_deleted": true}
+			} else {
+				result["doc"] = copyDoc(db.docs[id])
+			}
+		}
+		results = append(results, result)
+	}
+	return map[string]interface{}{"results": results, "last_seq": lastSeq}
+}
+
+func copyDoc(doc map[string]interface{}) map[string]interface{} {
+	data, _ := json.Marshal(doc)
+	var result map[string]interface{}
+	json.Unmarshal(data, &result)
+	return result
+}
+
+func (fc *fakeCouch) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	fc.requests = append(fc.requests, r.Method+" "+r.URL.Path)
+	for _, f := range fc.failures {
+		if f.remaining != 0 && f.method == r.Method && strings.HasPrefix(r.URL.Path, f.pathPrefix) {
+			if f.remaining > 0 {
+				f.remaining--
+			}
+			writeError(w, r, f.status, "injected", "injected failure")
+			return
+		}
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if segments[0] == "" {
+		// Server root
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{"couchdb": "Welcome", "version": fc.version})
+		return
+	}
+	user, isAdmin, ok := fc.authenticate(r)
+	if !ok {
+		writeError(w, r, http.StatusUnauthorized, "unauthorized", "Name or password is incorrect.")
+		return
+	}
+	switch segments[0] {
+	case "_all_dbs":
+		writeJSON(w, r, http.StatusOK, fc.dbNames())
+		return
+	case "_session":
+		roles := []string{}
+		if isAdmin {
+			roles = append(roles, "_admin")
+		}
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{
+			"ok":      true,
+			"userCtx": map[string]interface{}{"name": user, "roles": roles},
+		})
+		return
+	case "_active_tasks":
+		writeJSON(w, r, http.StatusOK, fc.activeTasks())
+		return
+	case "_scheduler":
+		if strings.HasPrefix(fc.version, "1.") {
+			writeError(w, r, http.StatusBadRequest, "illegal_database_name", "Only lowercase characters (a-z), digits (0-9), and any of the characters _, $, (, ), +, -, and / are allowed.")
+		} else {
+			writeJSON(w, r, http.StatusOK, map[string]interface{}{"docs": fc.schedulerDocs()})
+		}
+		return
+	}
+
+	dbName := segments[0]
+	db, found := fc.dbs[dbName]
+	if len(segments) == 1 {
+		switch r.Method {
+		case "PUT":
+			if !isAdmin {
+				writeError(w, r, http.StatusUnauthorized, "unauthorized", "You are not a server admin.")
+			} else if found {
+				writeError(w, r, http.StatusPreconditionFailed, "file_exists", "The database could not be created, the file already exists.")
+			} else {
+				fc.dbs[dbName] = newFakeDB()
+				writeJSON(w, r, http.StatusCreated, map[string]interface{}{"ok": true})
+			}
+		case "DELETE":
+			if !isAdmin {
+				writeError(w, r, http.StatusUnauthorized, "unauthorized", "You are not a server admin.")
+			} else if !found {
+				writeError(w, r, http.StatusNotFound, "not_found", "missing")
+			} else {
+				delete(fc.dbs, dbName)
+				writeJSON(w, r, http.StatusOK, map[string]interface{}{"ok": true})
+			}
+		case "GET", "HEAD":
+			if !found {
+				writeError(w, r, http.StatusNotFound, "not_found", "no_db_file")
+			} else {
+				writeJSON(w, r, http.StatusOK, map[string]interface{}{"db_name": dbName, "doc_count": len(db.docs), "update_seq": db.updateSeq})
+			}
+		default:
+			writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+		}
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, "not_found", "no_db_file")
+		return
+	}
+	if (dbName == usersDbName || segments[1] == "_security") && !isAdmin && !strings.HasSuffix(r.URL.Path, userDocPrefix+user) {
+		writeError(w, r, http.StatusUnauthorized, "unauthorized", "You are not a db or server admin.")
+		return
+	}
+
+	id := strings.Join(segments[1:], "/")
+	if id == "_all_docs" {
+		var ids []string
+		for docID := range db.docs {
+			ids = append(ids, docID)
+		}
+		sort.Strings(ids)
+		var startKey string
+		if value := r.URL.Query().Get("startkey"); value != "" {
+			json.Unmarshal([]byte(value), &startKey)
+		}
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		rows := []map[string]interface{}{}
+		for _, docID := range ids {
+			if docID < startKey || (limit > 0 && len(rows) == limit) {
+				continue
+			}
+			row := map[string]interface{}{"id": docID, "key": docID, "value": map[string]interface{}{"rev": db.docs[docID]["_rev"]}}
+			if r.URL.Query().Get("include_docs") == "true" {
+				row["doc"] = copyDoc(db.docs[docID])
+			}
+			rows = append(rows, row)
+		}
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{"total_rows": len(rows), "offset": 0, "rows": rows})
+		return
+	}
+	if id == "_bulk_docs" && r.Method == "POST" {
+		var req struct {
+			Docs     []map[string]interface{} `json:"docs"`
+			NewEdits *bool                    `json:"new_edits"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		if req.NewEdits == nil || *req.NewEdits {
+			writeError(w, r, http.StatusBadRequest, "bad_request", "only new_edits=false is supported")
+			return
+		}
+		for _, doc := range req.Docs {
+			db.replicateDoc(doc)
+		}
+		writeJSON(w, r, http.StatusCreated, []interface{}{})
+		return
+	}
+	if id == "_changes" {
+		changes := db.changesSince(r.URL.Query())
+		if fc.opaqueSeqs {
+			fc.seqCount++
+			changes["last_seq"] = fmt.Sprintf("%d-%d", changes["last_seq"], fc.seqCount)
+		}
+		writeJSON(w, r, http.StatusOK, changes)
+		return
+	}
+	if id == "_security" {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, r, http.StatusOK, db.security)
+		case "PUT":
+			var sec map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&sec); err != nil {
+				writeError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+				return
+			}
+			db.security = sec
+			writeJSON(w, r, http.StatusOK, map[string]interface{}{"ok": true})
+		default:
+			writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+		}
+		return
+	}
+
+	doc, found := db.docs[id]
+	switch r.Method {
+	case "GET", "HEAD":
+		if !found {
+			writeError(w, r, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, doc["_rev"]))
+		writeJSON(w, r, http.StatusOK, doc)
+	case "PUT":
+		var newDoc map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&newDoc); err != nil {
+			writeError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		rev := r.Header.Get("If-Match")
+		if rev == "" {
+			rev, _ = newDoc["_rev"].(string)
+		}
+		if found && rev != doc["_rev"] {
+			writeError(w, r, http.StatusConflict, "conflict", "Document update conflict.")
+			return
+		}
+		if !found && rev != "" {
+			writeError(w, r, http.StatusConflict, "conflict", "Document update conflict.")
+			return
+		}
+		if dbName == replicatorDbName && found && doc["_replication_state"] == "triggered" && strings.HasPrefix(fc.version, "1.") {
+			writeError(w, r, http.StatusForbidden, "forbidden", "Only the replicator can edit replication documents that are in the triggered state.")
+			return
+		}
+		if dbName == usersDbName {
+			if password, ok := newDoc["password"].(string); ok {
+				fc.users[fmt.Sprint(newDoc["name"])] = password
+				delete(newDoc, "password")
+			}
+		}
+		newRev := fc.putDoc(db, id, newDoc)
+		if dbName == replicatorDbName && fc.replicatorState {
+			// Mimic the replicator, which updates the document when it starts the replication,
+			// one-shot replications complete immediately.
+			newDoc = copyDoc(newDoc)
+			newDoc["_replication_state"] = "triggered"
+			if continuous, _ := newDoc["continuous"].(bool); !continuous {
+				newDoc["_replication_state"] = fc.oneShotState
+			}
+			newDoc["_replication_id"] = fmt.Sprintf("%x", md5.Sum([]byte(id)))
+			fc.putDoc(db, id, newDoc)
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, newRev))
+		writeJSON(w, r, http.StatusCreated, map[string]interface{}{"ok": true, "id": id, "rev": newRev})
+	case "DELETE":
+		if !found {
+			writeError(w, r, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		if r.Header.Get("If-Match") != doc["_rev"] && r.URL.Query().Get("rev") != doc["_rev"] {
+			writeError(w, r, http.StatusConflict, "conflict", "Document update conflict.")
+			return
+		}
+		delete(db.docs, id)
+		db.updateSeq++
+		db.changes[id] = fakeChange{seq: db.updateSeq, rev: tombstoneRevision(fmt.Sprint(doc["_rev"])), deleted: true}
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, doc["_rev"]))
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{"ok": true, "id": id})
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+	}
+}
+
+// authenticate checks the basic auth credentials of the given request.
+func (fc *fakeCouch) authenticate(r *http.Request) (user string, isAdmin, ok bool) {
+	name, password, hasAuth := r.BasicAuth()
+	if !hasAuth {
+		// Anonymous access is allowed for reading
+		return "", false, r.Method == "GET" || r.Method == "HEAD"
+	}
+	if name == fc.admin.UserName && password == fc.admin.Password {
+		return name, true, true
+	}
+	if p, found := fc.users[name]; found && p == password {
+		return name, false, true
+	}
+	return "", false, false
+}
+
+// activeTasks returns a replication task for every triggered document in the _replicator database.
+func (fc *fakeCouch) activeTasks() []map[string]interface{} {
+	tasks := []map[string]interface{}{}
+	for id, doc := range fc.dbs[replicatorDbName].docs {
+		tasks = append(tasks, map[string]interface{}{
+			"type":       "replication",
+			"doc_id":     id,
+			"source":     Redact(fmt.Sprint(doc["source"])),
+			"target":     Redact(fmt.Sprint(doc["target"])),
+			"continuous": doc["continuous"],
+		})
+	}
+	return tasks
+}
+
+// schedulerDocs returns the scheduler state of every document in the _replicator database.
+func (fc *fakeCouch) schedulerDocs() []map[string]interface{} {
+	docs := []map[string]interface{}{}
+	for id, doc := range fc.dbs[replicatorDbName].docs {
+		state, _ := doc["_replication_state"].(string)
+		switch state {
+		case "":
+			state = "initializing"
+		case "triggered":
+			state = "running"
+		}
+		docs = append(docs, map[string]interface{}{"doc_id": id, "state": state, "info": doc["_replication_state_reason"]})
+	}
+	return docs
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, errorCode, reason string) {
+	writeJSON(w, r, status, map[string]string{"error": errorCode, "reason": reason})
+}
+
+// testRetryPolicy returns a retry policy that retries fast, for use in tests.
+func testRetryPolicy(maxTries int) RetryPolicy {
+	return RetryPolicy{
+		MaxTries:     maxTries,
+		InitialDelay: time.Millisecond,
+		Multiplier:   1,
+		Timeout:      time.Second * 10,
+	}
+}
+
+// newTestService creates a service for the given servers, replicating the given databases,
+// with the test credentials and fast retry policies.
+func newTestService(servers []*fakeCouch, dbNames ...string) *service {
+	config := ServiceConfig{
+		AdminUser:      UserInfo{UserName: testAdminName, Password: testAdminPass},
+		ReplicatorUser: UserInfo{UserName: testReplName, Password: testReplPass},
+		EditorUser:     UserInfo{UserName: testEditorName, Password: testEditorPass},
+		DatabaseNames:  dbNames,
+		RequestTimeout: time.Second * 5,
+		Retry: RetryConfig{
+			Ping:     testRetryPolicy(3),
+			User:     testRetryPolicy(3),
+			Security: testRetryPolicy(3),
+			Database: testRetryPolicy(3),
+			Document: testRetryPolicy(3),
+		},
+	}
+	for _, fc := range servers {
+		config.Servers = append(config.Servers, Server{URL: fc.URL()})
+	}
+	return NewService(config, ServiceDependencies{
+		Logger:        logging.MustGetLogger("test"),
+		ClientFactory: NewHTTPClient,
+	})
+}
+
+// startFakeCouches starts the given number of fake servers, each with the given databases.
+func startFakeCouches(t *testing.T, count int, dbNames ...string) []*fakeCouch {
+	var result []*fakeCouch
+	for i := 0; i < count; i++ {
+		result = append(result, newFakeCouch(t, dbNames...))
+	}
+	return result
+}
+
+func closeFakeCouches(servers []*fakeCouch) {
+	for _, fc := range servers {
+		fc.Close()
+	}
+}
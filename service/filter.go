@@ -0,0 +1,538 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	// filterDesignDocID is the ID of the design document that contains the generated filter functions.
+	filterDesignDocID = designDocPrefix + "couchdb-repl-filters"
+)
+
+// FilterMode specifies how replication filters are passed to CouchDB.
+type FilterMode string
+
+const (
+	// FilterModeSelector compiles filters into a Mango selector (CouchDB 2.0 and later).
+	FilterModeSelector FilterMode = "selector"
+	// FilterModeJS compiles filters into a JavaScript filter function, installed in a design document.
+	FilterModeJS FilterMode = "js"
+)
+
+// ParseFilterMode parses a filter mode name.
+func ParseFilterMode(value string) (FilterMode, error) {
+	switch m := FilterMode(strings.ToLower(value)); m {
+	case FilterModeSelector, FilterModeJS:
+		return m, nil
+	default:
+		return "", maskAny(errgo.Newf("invalid filter mode '%s', expected '%s' or '%s'", value, FilterModeSelector, FilterModeJS))
+	}
+}
+
+// ReplicationFilter limits the documents that are replicated for all databases matching a pattern.
+type ReplicationFilter struct {
+	Databases  DatabasePattern
+	Expression FilterExpression
+}
+
+// ParseReplicationFilter parses a filter formatted as `pattern:expression`,
+// e.g. `orders:type in [order, invoice] && region == $target.region`.
+func ParseReplicationFilter(value string) (ReplicationFilter, error) {
+	i := strings.Index(value, ":")
+	if strings.HasPrefix(value, "/") {
+		// The pattern is a regular expression, which may contain ':'
+		if j := strings.Index(value[1:], "/:"); j >= 0 {
+			i = j + 2
+		}
+	}
+	if i <= 0 {
+		return ReplicationFilter{}, maskAny(errgo.Newf("invalid filter '%s', expected 'pattern:expression'", value))
+	}
+	pattern, err := ParseDatabasePattern(value[:i])
+	if err != nil {
+		return ReplicationFilter{}, maskAny(err)
+	}
+	expr, err := ParseFilterExpression(value[i+1:])
+	if err != nil {
+		return ReplicationFilter{}, maskAny(err)
+	}
+	return ReplicationFilter{Databases: pattern, Expression: expr}, nil
+}
+
+// FilterExpression is a parsed filter expression. It is either a combination of expressions
+// (`&&`, `||`) or a condition on a single document field (`==`, `!=`, `in`, `not in`).
+type FilterExpression struct {
+	Op       string // and, or, ==, !=, in, not in
+	Operands []FilterExpression
+	Field    string
+	Values   []FilterValue
+}
+
+// FilterValue is a literal value or a reference to a label of the source or target server of an edge.
+type FilterValue struct {
+	Literal interface{}
+	Server  string // source or target when the value is a label reference
+	Label   string
+}
+
+// String returns the value as it is written in an expression.
+func (v FilterValue) String() string {
+	if v.Server != "" {
+		return "$" + v.Server + "." + v.Label
+	}
+	encoded, _ := json.Marshal(v.Literal)
+	return string(encoded)
+}
+
+// param returns the name of the query parameter used to pass a label reference to a JS filter function.
+func (v FilterValue) param() string {
+	return v.Server + "." + v.Label
+}
+
+// ParseFilterExpression parses an expression of conditions combined with `&&` (or `and`), `||` (or `or`)
+// and parentheses. A condition is formatted as `field == value`, `field != value`, `field in [value, ...]`
+// or `field not in [value, ...]`. Values are quoted strings, numbers, true, false, null, bare words (strings)
+// or `$source.label` / `$target.label`, which refer to a label of the source or target server of an edge.
+func ParseFilterExpression(value string) (FilterExpression, error) {
+	tokens, err := tokenizeFilter(value)
+	if err != nil {
+		return FilterExpression{}, maskAny(err)
+	}
+	p := &filterParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return FilterExpression{}, maskAny(errgo.Newf("invalid filter expression '%s': %s", value, err.Error()))
+	}
+	if p.pos < len(tokens) {
+		return FilterExpression{}, maskAny(errgo.Newf("invalid filter expression '%s': unexpected '%s'", value, tokens[p.pos].text))
+	}
+	return expr, nil
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+// tokenizeFilter splits a filter expression into words, quoted strings and operators.
+func tokenizeFilter(value string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(value); {
+		c := value[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(value[i+1:], c)
+			if end < 0 {
+				return nil, maskAny(errgo.Newf("unterminated string in filter expression '%s'", value))
+			}
+			tokens = append(tokens, filterToken{text: value[i+1 : i+1+end], quoted: true})
+			i += end + 2
+		case strings.IndexByte("[](),", c) >= 0:
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+		case i+1 < len(value) && (value[i:i+2] == "==" || value[i:i+2] == "!=" || value[i:i+2] == "&&" || value[i:i+2] == "||"):
+			tokens = append(tokens, filterToken{text: value[i : i+2]})
+			i += 2
+		default:
+			start := i
+			for i < len(value) && strings.IndexByte(" \t\"'[](),=!&|", value[i]) < 0 {
+				i++
+			}
+			if i == start {
+				return nil, maskAny(errgo.Newf("unexpected '%c' in filter expression '%s'", c, value))
+			}
+			tokens = append(tokens, filterToken{text: value[start:i]})
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// accept consumes the next token if it is one of the given (unquoted) words.
+func (p *filterParser) accept(words ...string) bool {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return false
+	}
+	for _, w := range words {
+		if p.tokens[p.pos].text == w {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *filterParser) next() (filterToken, error) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, maskAny(errgo.New("unexpected end"))
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) parseOr() (FilterExpression, error) {
+	return p.parseBinary("or", []string{"||", "or"}, p.parseAnd)
+}
+
+func (p *filterParser) parseAnd() (FilterExpression, error) {
+	return p.parseBinary("and", []string{"&&", "and"}, p.parseUnary)
+}
+
+func (p *filterParser) parseBinary(op string, words []string, operand func() (FilterExpression, error)) (FilterExpression, error) {
+	first, err := operand()
+	if err != nil {
+		return FilterExpression{}, maskAny(err)
+	}
+	result := FilterExpression{Op: op, Operands: []FilterExpression{first}}
+	for p.accept(words...) {
+		x, err := operand()
+		if err != nil {
+			return FilterExpression{}, maskAny(err)
+		}
+		result.Operands = append(result.Operands, x)
+	}
+	if len(result.Operands) == 1 {
+		return first, nil
+	}
+	return result, nil
+}
+
+func (p *filterParser) parseUnary() (FilterExpression, error) {
+	if p.accept("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return FilterExpression{}, maskAny(err)
+		}
+		if !p.accept(")") {
+			return FilterExpression{}, maskAny(errgo.New("expected ')'"))
+		}
+		return expr, nil
+	}
+	field, err := p.next()
+	if err != nil {
+		return FilterExpression{}, maskAny(err)
+	}
+	if field.quoted || strings.HasPrefix(field.text, "$") || strings.IndexByte("[](),=!&|", field.text[0]) >= 0 {
+		return FilterExpression{}, maskAny(errgo.Newf("expected field name, got '%s'", field.text))
+	}
+	expr := FilterExpression{Field: field.text}
+	switch {
+	case p.accept("=="):
+		expr.Op = "=="
+	case p.accept("!="):
+		expr.Op = "!="
+	case p.accept("in"):
+		expr.Op = "in"
+	case p.accept("not"):
+		if !p.accept("in") {
+			return FilterExpression{}, maskAny(errgo.New("expected 'in' after 'not'"))
+		}
+		expr.Op = "not in"
+	default:
+		return FilterExpression{}, maskAny(errgo.Newf("expected '==', '!=', 'in' or 'not in' after '%s'", field.text))
+	}
+	if expr.Op == "==" || expr.Op == "!=" {
+		v, err := p.parseValue()
+		if err != nil {
+			return FilterExpression{}, maskAny(err)
+		}
+		expr.Values = []FilterValue{v}
+		return expr, nil
+	}
+	if !p.accept("[") {
+		return FilterExpression{}, maskAny(errgo.Newf("expected '[' after '%s'", expr.Op))
+	}
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return FilterExpression{}, maskAny(err)
+		}
+		expr.Values = append(expr.Values, v)
+		if p.accept("]") {
+			return expr, nil
+		}
+		if !p.accept(",") {
+			return FilterExpression{}, maskAny(errgo.New("expected ',' or ']'"))
+		}
+	}
+}
+
+func (p *filterParser) parseValue() (FilterValue, error) {
+	t, err := p.next()
+	if err != nil {
+		return FilterValue{}, maskAny(err)
+	}
+	if t.quoted {
+		return FilterValue{Literal: t.text}, nil
+	}
+	for _, server := range []string{"source", "target"} {
+		if prefix := "$" + server + "."; strings.HasPrefix(t.text, prefix) && len(t.text) > len(prefix) {
+			return FilterValue{Server: server, Label: t.text[len(prefix):]}, nil
+		}
+	}
+	switch t.text {
+	case "true":
+		return FilterValue{Literal: true}, nil
+	case "false":
+		return FilterValue{Literal: false}, nil
+	case "null":
+		return FilterValue{Literal: nil}, nil
+	}
+	if strings.HasPrefix(t.text, "$") || strings.IndexByte("[](),", t.text[0]) >= 0 {
+		return FilterValue{}, maskAny(errgo.Newf("unexpected '%s', expected a value", t.text))
+	}
+	if f, err := strconv.ParseFloat(t.text, 64); err == nil {
+		return FilterValue{Literal: f}, nil
+	}
+	return FilterValue{Literal: t.text}, nil
+}
+
+// String returns the expression in its canonical form.
+func (e FilterExpression) String() string {
+	switch e.Op {
+	case "and", "or":
+		sep := map[string]string{"and": " && ", "or": " || "}[e.Op]
+		var parts []string
+		for _, x := range e.Operands {
+			if x.Op == "and" || x.Op == "or" {
+				parts = append(parts, "("+x.String()+")")
+			} else {
+				parts = append(parts, x.String())
+			}
+		}
+		return strings.Join(parts, sep)
+	case "==", "!=":
+		return e.Field + " " + e.Op + " " + e.Values[0].String()
+	default:
+		var values []string
+		for _, v := range e.Values {
+			values = append(values, v.String())
+		}
+		return e.Field + " " + e.Op + " [" + strings.Join(values, ", ") + "]"
+	}
+}
+
+// references returns all label references of the expression.
+func (e FilterExpression) references() []FilterValue {
+	var result []FilterValue
+	for _, x := range e.Operands {
+		result = append(result, x.references()...)
+	}
+	for _, v := range e.Values {
+		if v.Server != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Selector compiles the expression into a Mango selector, resolving label references using the
+// given resolver. Deleted documents are always selected, so deletions are replicated, as are the canary
+// documents of lag measurements.
+func (e FilterExpression) Selector(resolve func(FilterValue) interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"$or": []interface{}{
+			map[string]interface{}{"_deleted": true},
+			map[string]interface{}{"_id": map[string]interface{}{"$regex": "^" + regexp.QuoteMeta(canaryDocPrefix)}},
+			e.selector(resolve),
+		},
+	}
+}
+
+func (e FilterExpression) selector(resolve func(FilterValue) interface{}) map[string]interface{} {
+	switch e.Op {
+	case "and", "or":
+		var operands []interface{}
+		for _, x := range e.Operands {
+			operands = append(operands, x.selector(resolve))
+		}
+		return map[string]interface{}{"$" + e.Op: operands}
+	case "==", "!=":
+		op := map[string]string{"==": "$eq", "!=": "$ne"}[e.Op]
+		return map[string]interface{}{e.Field: map[string]interface{}{op: resolve(e.Values[0])}}
+	default:
+		op := map[string]string{"in": "$in", "not in": "$nin"}[e.Op]
+		var values []interface{}
+		for _, v := range e.Values {
+			values = append(values, resolve(v))
+		}
+		return map[string]interface{}{e.Field: map[string]interface{}{op: values}}
+	}
+}
+
+// jsTree returns the expression as a JSON tree that is evaluated by the generated filter function.
+// Label references become the names of query parameters.
+func (e FilterExpression) jsTree() map[string]interface{} {
+	result := map[string]interface{}{"op": e.Op}
+	if e.Op == "and" || e.Op == "or" {
+		var operands []interface{}
+		for _, x := range e.Operands {
+			operands = append(operands, x.jsTree())
+		}
+		result["operands"] = operands
+		return result
+	}
+	var values []interface{}
+	for _, v := range e.Values {
+		if v.Server != "" {
+			values = append(values, map[string]interface{}{"param": v.param()})
+		} else {
+			values = append(values, map[string]interface{}{"value": v.Literal})
+		}
+	}
+	result["field"] = e.Field
+	result["values"] = values
+	return result
+}
+
+// filterFunctionTemplate is a filter function that evaluates the expression tree in the second `%s`
+// with the same semantics as the Mango selector: conditions on missing fields never match.
+// Deleted documents always pass the filter, so deletions are replicated, as do the canary documents
+// of lag measurements (with the ID prefix in the first `%s`).
+const filterFunctionTemplate = `function(doc, req) {
+  if (doc._deleted || doc._id.indexOf(%s) === 0) {
+    return true;
+  }
+  var expr = %s;
+  function lookup(path) {
+    var i, v = doc, parts = path.split('.');
+    for (i = 0; i < parts.length; i++) {
+      if (v === null || typeof v !== 'object' || !v.hasOwnProperty(parts[i])) { return undefined; }
+      v = v[parts[i]];
+    }
+    return v;
+  }
+  function test(e) {
+    var i, v, found = false;
+    if (e.op === 'and' || e.op === 'or') {
+      for (i = 0; i < e.operands.length; i++) {
+        if (test(e.operands[i]) === (e.op === 'or')) { return e.op === 'or'; }
+      }
+      return e.op === 'and';
+    }
+    v = lookup(e.field);
+    if (v === undefined) { return false; }
+    for (i = 0; i < e.values.length; i++) {
+      var x = e.values[i].hasOwnProperty('param') ? req.query[e.values[i].param] : e.values[i].value;
+      if (JSON.stringify(v) === JSON.stringify(x)) { found = true; }
+    }
+    return (e.op === '==' || e.op === 'in') ? found : !found;
+  }
+  return test(expr);
+}`
+
+// filterName returns the name of the filter function of the expression in the filters design document.
+func (e FilterExpression) filterName() string {
+	return fmt.Sprintf("f%x", sha1.Sum([]byte(e.String())))[:13]
+}
+
+// Function returns the JavaScript filter function that evaluates the expression.
+func (e FilterExpression) Function() string {
+	encoded, _ := json.Marshal(e.jsTree())
+	prefix, _ := json.Marshal(canaryDocPrefix)
+	return fmt.Sprintf(filterFunctionTemplate, string(prefix), string(encoded))
+}
+
+// filterOf returns the filter of the database with given (logical) name, or nil if the database is not filtered.
+// When multiple filters match a database, the first one is used.
+func (s *service) filterOf(dbName string) *ReplicationFilter {
+	if dbName == "" {
+		return nil
+	}
+	for i, f := range s.Filters {
+		if f.Databases.Match(dbName) {
+			return &s.Filters[i]
+		}
+	}
+	return nil
+}
+
+// applyFilter adds the filter of the database of the given edge (if any) to the given replication document.
+func (s *service) applyFilter(e edge, doc *ReplicatorDocument) error {
+	f := s.filterOf(e.Database)
+	if f == nil {
+		return nil
+	}
+	labels := map[string]map[string]string{"source": nil, "target": nil}
+	if srv, found := s.server(e.Source.Host); found {
+		labels["source"] = srv.Labels
+	}
+	if srv, found := s.server(e.Target.Host); found {
+		labels["target"] = srv.Labels
+	}
+	hosts := map[string]string{"source": e.Source.Host, "target": e.Target.Host}
+	for _, ref := range f.Expression.references() {
+		if _, found := labels[ref.Server][ref.Label]; !found {
+			return maskAny(errgo.Newf("filter of '%s' refers to label '%s' of %s server '%s', which does not have that label", e.Database, ref.Label, ref.Server, hosts[ref.Server]))
+		}
+	}
+	resolve := func(v FilterValue) interface{} {
+		if v.Server != "" {
+			return labels[v.Server][v.Label]
+		}
+		return v.Literal
+	}
+	if s.FilterMode == FilterModeJS {
+		doc.Filter = strings.TrimPrefix(filterDesignDocID, designDocPrefix) + "/" + f.Expression.filterName()
+		for _, ref := range f.Expression.references() {
+			if doc.QueryParams == nil {
+				doc.QueryParams = make(map[string]string)
+			}
+			doc.QueryParams[ref.param()] = labels[ref.Server][ref.Label]
+		}
+	} else {
+		doc.Selector = f.Expression.Selector(resolve)
+	}
+	return nil
+}
+
+// filterDesignDocuments returns the design documents with the filter functions of all filtered databases.
+// They are only needed when FilterMode is js.
+func (s *service) filterDesignDocuments() []DesignDocument {
+	if s.FilterMode != FilterModeJS {
+		return nil
+	}
+	var result []DesignDocument
+	for _, dbName := range s.replicatedDatabases() {
+		f := s.filterOf(dbName)
+		if f == nil {
+			continue
+		}
+		result = append(result, DesignDocument{
+			Database: dbName,
+			ID:       filterDesignDocID,
+			Fields: map[string]interface{}{
+				"language": "javascript",
+				"filters":  map[string]interface{}{f.Expression.filterName(): f.Expression.Function()},
+			},
+		})
+	}
+	return result
+}
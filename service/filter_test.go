@@ -0,0 +1,166 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFilterExpression(t *testing.T) {
+	tests := map[string]string{
+		`type == order`: `type == "order"`,
+		`type in [order, "in voice"] && region == $target.region`: `type in ["order", "in voice"] && region == $target.region`,
+		`a == 1 || b != true and c not in ['x']`:                  `a == 1 || (b != true && c not in ["x"])`,
+		`(a == 1 or b == null) && meta.owner == $source.name`:     `(a == 1 || b == null) && meta.owner == $source.name`,
+	}
+	for value, expected := range tests {
+		expr, err := ParseFilterExpression(value)
+		if err != nil {
+			t.Errorf("ParseFilterExpression('%s') failed: %s", value, err)
+		} else if expr.String() != expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", expected, value, expr.String())
+		}
+	}
+	for _, value := range []string{``, `type`, `type = x`, `type == `, `type in x`, `type in [a b]`, `(a == 1`, `a == 1 b == 2`, `$x == 1`, `a == $other.x`, `a == "x`} {
+		if _, err := ParseFilterExpression(value); err == nil {
+			t.Errorf("Expected error for '%s'", value)
+		}
+	}
+}
+
+func TestParseReplicationFilter(t *testing.T) {
+	f, err := ParseReplicationFilter(`/^orders:[a-z]+$/:type == order`)
+	if err != nil {
+		t.Fatalf("ParseReplicationFilter failed: %s", err)
+	}
+	if !f.Databases.Match("orders:eu") || f.Expression.String() != `type == "order"` {
+		t.Errorf("Unexpected filter %v", f)
+	}
+	if _, err := ParseReplicationFilter(`type == order`); err == nil {
+		t.Error("Expected error for filter without pattern")
+	}
+}
+
+func TestFilterSelector(t *testing.T) {
+	expr, err := ParseFilterExpression(`type in [order, invoice] && region == $target.region`)
+	if err != nil {
+		t.Fatalf("ParseFilterExpression failed: %s", err)
+	}
+	selector := expr.Selector(func(v FilterValue) interface{} {
+		if v.Server != "" {
+			return "eu"
+		}
+		return v.Literal
+	})
+	encoded, _ := json.Marshal(selector)
+	expected := `{"$or":[{"_deleted":true},{"_id":{"$regex":"^repl_canary:"}},{"$and":[{"type":{"$in":["order","invoice"]}},{"region":{"$eq":"eu"}}]}]}`
+	if string(encoded) != expected {
+		t.Errorf("Expected %s, got %s", expected, encoded)
+	}
+}
+
+func newFilterTestService(t *testing.T, servers []*fakeCouch, filter string) *service {
+	s := newTestService(servers, "orders", "users")
+	for i := range s.Servers {
+		s.Servers[i].Labels = map[string]string{"region": []string{"eu", "us"}[i]}
+	}
+	f, err := ParseReplicationFilter(filter)
+	if err != nil {
+		t.Fatalf("ParseReplicationFilter failed: %s", err)
+	}
+	s.Filters = []ReplicationFilter{f}
+	return s
+}
+
+// pullDocuments returns the (pull) replication documents, by target database, stored on the given server.
+func pullDocuments(fc *fakeCouch) map[string]map[string]interface{} {
+	result := make(map[string]map[string]interface{})
+	for id, doc := range fc.Docs(replicatorDbName) {
+		if managedDocumentID.MatchString(id) {
+			target, _ := doc["target"].(string)
+			result[target] = doc
+		}
+	}
+	return result
+}
+
+func TestRunFilterSelector(t *testing.T) {
+	servers := startFakeCouches(t, 2, "orders", "users")
+	defer closeFakeCouches(servers)
+	s := newFilterTestService(t, servers, `orders:type in [order, invoice] && region == $target.region`)
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	for i, fc := range servers {
+		docs := pullDocuments(fc)
+		encoded, _ := json.Marshal(docs["orders"]["selector"])
+		region := []string{"eu", "us"}[i]
+		if !strings.Contains(string(encoded), `{"region":{"$eq":"`+region+`"}}`) {
+			t.Errorf("Expected selector for region %s on %s, got %s", region, fc.Host(), encoded)
+		}
+		if _, found := docs["users"]["selector"]; found {
+			t.Errorf("Expected no selector for users, got %v", docs["users"])
+		}
+		if _, found := fc.Docs("orders")[filterDesignDocID]; found {
+			t.Errorf("Expected no filter design document in selector mode")
+		}
+	}
+	if drifts, err := s.Diff(); err != nil || len(drifts) != 0 {
+		t.Errorf("Expected no drift, got %v (%v)", drifts, err)
+	}
+}
+
+func TestRunFilterJS(t *testing.T) {
+	servers := startFakeCouches(t, 2, "orders", "users")
+	defer closeFakeCouches(servers)
+	s := newFilterTestService(t, servers, `orders:type == order && region == $target.region`)
+	s.FilterMode = FilterModeJS
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	name := s.Filters[0].Expression.filterName()
+	for i, fc := range servers {
+		design, found := fc.Docs("orders")[filterDesignDocID]
+		if !found {
+			t.Fatalf("Expected filter design document on %s", fc.Host())
+		}
+		if filters, _ := design["filters"].(map[string]interface{}); filters[name] != s.Filters[0].Expression.Function() {
+			t.Errorf("Unexpected filters %v", design["filters"])
+		}
+		doc := pullDocuments(fc)["orders"]
+		if doc["filter"] != "couchdb-repl-filters/"+name {
+			t.Errorf("Unexpected filter '%v'", doc["filter"])
+		}
+		expected := map[string]interface{}{"target.region": []string{"eu", "us"}[i]}
+		if !reflect.DeepEqual(doc["query_params"], expected) {
+			t.Errorf("Expected query params %v, got %v", expected, doc["query_params"])
+		}
+		if _, found := fc.Docs("users")[filterDesignDocID]; found {
+			t.Errorf("Expected no filter design document in users")
+		}
+	}
+}
+
+func TestRunFilterMissingLabel(t *testing.T) {
+	servers := startFakeCouches(t, 2, "orders", "users")
+	defer closeFakeCouches(servers)
+	s := newFilterTestService(t, servers, `orders:zone == $source.zone`)
+	if err := s.Run(); err == nil || !strings.Contains(err.Error(), "label 'zone'") {
+		t.Errorf("Expected missing label error, got %v", err)
+	}
+}
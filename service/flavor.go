@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// Flavor is the kind of CouchDB compatible endpoint a server is.
+// It determines which administrative steps can be performed on the server.
+type Flavor string
+
+const (
+	// FlavorCouchDB is a plain CouchDB server (default).
+	FlavorCouchDB Flavor = "couchdb"
+	// FlavorCloudant is an IBM Cloudant account. Users are API keys that are managed outside of this tool,
+	// and database permissions are granted to API keys in the `cloudant` section of the security object.
+	FlavorCloudant Flavor = "cloudant"
+	// FlavorPouchDB is a PouchDB-server instance. It only stores databases, users, security and
+	// replication jobs are not managed on it.
+	FlavorPouchDB Flavor = "pouchdb"
+)
+
+const (
+	cloudantReader     = "_reader"
+	cloudantWriter     = "_writer"
+	cloudantReplicator = "_replicator"
+)
+
+// ParseFlavor parses a flavor name.
+func ParseFlavor(value string) (Flavor, error) {
+	switch f := Flavor(strings.ToLower(value)); f {
+	case FlavorCouchDB, FlavorCloudant, FlavorPouchDB:
+		return f, nil
+	default:
+		return "", maskAny(errgo.Newf("invalid flavor '%s', expected '%s', '%s' or '%s'", value, FlavorCouchDB, FlavorCloudant, FlavorPouchDB))
+	}
+}
+
+// ManagesUsers returns true if the users in the _users database of servers of this flavor are managed.
+func (f Flavor) ManagesUsers() bool {
+	return f == "" || f == FlavorCouchDB
+}
+
+// ManagesSecurity returns true if the security objects of databases on servers of this flavor are managed.
+func (f Flavor) ManagesSecurity() bool {
+	return f != FlavorPouchDB
+}
+
+// HostsReplications returns true if servers of this flavor can run replication jobs from their _replicator database.
+func (f Flavor) HostsReplications() bool {
+	return f != FlavorPouchDB
+}
+
+// flavor returns the flavor of the server with given host.
+func (s *service) flavor(host string) Flavor {
+	if srv, found := s.server(host); found && srv.Flavor != "" {
+		return srv.Flavor
+	}
+	return FlavorCouchDB
+}
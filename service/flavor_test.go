@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlacementFlavors(t *testing.T) {
+	servers := startFakeCouches(t, 3)
+	defer closeFakeCouches(servers)
+	s := newTestService(servers)
+	s.Servers[2].Flavor = FlavorPouchDB
+	couch, pouch := servers[0].URL(), servers[2].URL()
+	if p := s.placement(couch, pouch); p != PlacementPush {
+		t.Errorf("Expected push to pouchdb, got %s", p)
+	}
+	if p := s.placement(pouch, couch); p != PlacementPull {
+		t.Errorf("Expected pull from pouchdb, got %s", p)
+	}
+	s.DefaultPlacement = PlacementPush
+	if p := s.placement(pouch, couch); p != PlacementPull {
+		t.Errorf("Expected pull from pouchdb with default push, got %s", p)
+	}
+	s.Servers[0].Flavor = FlavorPouchDB
+	if p := s.placement(pouch, couch); p != PlacementPush {
+		t.Errorf("Expected configured placement between pouchdb servers, got %s", p)
+	}
+}
+
+func TestRunFlavors(t *testing.T) {
+	servers := startFakeCouches(t, 3, "db1")
+	defer closeFakeCouches(servers)
+	cloudant, pouch := servers[1], servers[2]
+	// API keys of Cloudant are managed outside of couchdb-repl
+	cloudant.AddUser(testReplName, testReplPass)
+	s := newTestService(servers, "db1")
+	s.Servers[1].Flavor = FlavorCloudant
+	s.Servers[2].Flavor = FlavorPouchDB
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	for _, fc := range []*fakeCouch{cloudant, pouch} {
+		if puts := fc.Requests("PUT", "/"+usersDbName+"/"); len(puts) != 0 {
+			t.Errorf("Expected no user changes on %s, got %v", fc.Host(), puts)
+		}
+	}
+	client, err := NewHTTPClient(Server{URL: cloudant.URL()}, UserInfo{UserName: testAdminName, Password: testAdminPass}, time.Second)
+	if err != nil {
+		t.Fatalf("NewHTTPClient failed: %s", err)
+	}
+	sec, err := client.GetSecurity("db1")
+	if err != nil {
+		t.Fatalf("GetSecurity failed: %s", err)
+	}
+	if expected := []string{cloudantReader, cloudantWriter, cloudantReplicator}; !reflect.DeepEqual(sec.Cloudant[testReplName], expected) {
+		t.Errorf("Expected cloudant permissions %v, got %v", expected, sec.Cloudant)
+	}
+	if len(sec.Members.Roles) != 0 || len(sec.Admins.Roles) != 0 {
+		t.Errorf("Expected no CouchDB roles on Cloudant, got %+v", sec)
+	}
+
+	// PouchDB only stores the data, all edges with it run on its peers
+	if puts := pouch.Requests("PUT", "/"); len(puts) != 0 {
+		t.Errorf("Expected no writes on pouchdb, got %v", puts)
+	}
+	for _, fc := range servers[:2] {
+		docs := replicationDocs(fc)
+		if target := docs[remoteURL(pouch, "db1")]; target != "db1" {
+			t.Errorf("Expected pull from pouchdb on %s, got %v", fc.Host(), docs)
+		}
+		if source := findKey(docs, remoteURL(pouch, "db1")); source != "db1" {
+			t.Errorf("Expected push to pouchdb on %s, got %v", fc.Host(), docs)
+		}
+	}
+	if drifts, err := s.Diff(); err != nil || len(drifts) != 0 {
+		t.Errorf("Expected no drift, got %v (%v)", drifts, err)
+	}
+}
+
+// findKey returns the key of the given value in the given map, or an empty string if not found.
+func findKey(m map[string]string, value string) string {
+	for k, v := range m {
+		if v == value {
+			return k
+		}
+	}
+	return ""
+}
+
+func TestRunPouchDBOnly(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	s := newTestService(servers, "db1")
+	for i := range s.Servers {
+		s.Servers[i].Flavor = FlavorPouchDB
+	}
+	if err := s.Run(); err == nil || !strings.Contains(err.Error(), "can run replications") {
+		t.Errorf("Expected error for edge between pouchdb servers, got %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// JoinOptions specify how a new server is added to an existing topology.
+type JoinOptions struct {
+	Peer Server // A server that is already part of the topology
+	// Servers are the settings of other existing servers (optional).
+	// Discovered servers are matched by host, servers without settings use the default credentials.
+	Servers []Server
+}
+
+// mesh is the topology of an existing set of servers, as discovered from the replication documents of a peer.
+type mesh struct {
+	Servers        []Server
+	DatabaseNames  []string
+	Overrides      []DatabaseOverride
+	EdgePlacements []EdgePlacement
+}
+
+// Join adds the (single) server of the configuration to the existing topology of the given peer.
+// The topology is discovered from the replication documents created by this tool on the peer.
+// The new server is prepared and seeded from the peer, after which the replications to and from
+// the new server are created. Replications between existing servers are not touched.
+// The topology including the new server is returned.
+func (s *service) Join(opts JoinOptions) ([]TopologyEdge, error) {
+	s.startReport()
+	topology, err := s.join(opts)
+	s.finishReport(err)
+	return topology, maskAny(err)
+}
+
+func (s *service) join(opts JoinOptions) ([]TopologyEdge, error) {
+	if len(s.Servers) != 1 {
+		return nil, maskAny(errgo.Newf("expected exactly 1 server to join, got %d", len(s.Servers)))
+	}
+	newServer := s.Servers[0].URL
+	peer := opts.Peer.URL
+	if newServer.Host == peer.Host {
+		return nil, maskAny(errgo.Newf("server '%s' cannot join itself", newServer.Host))
+	}
+	// Make the settings of the existing servers available while discovering the topology
+	s.Servers = append(append(s.Servers, opts.Peer), opts.Servers...)
+
+	// Discover the existing topology
+	log := s.log(LogFields{Server: peer.Host, Operation: "join"})
+	peerConn, err := s.connect(log, opts.Peer)
+	if err != nil {
+		return nil, maskAny(RedactError(err))
+	}
+	if err := requireHTTPClient(peerConn, "joining"); err != nil {
+		return nil, maskAny(err)
+	}
+	var m mesh
+	if err := s.Retry.Document.do(log, func() error {
+		var err error
+		m, err = s.discoverMesh(peerConn, opts)
+		return maskAny(err)
+	}); err != nil {
+		return nil, maskAny(RedactError(errgo.Notef(err, "cannot discover topology of '%s': %s", peer.Host, err.Error())))
+	}
+	if len(m.DatabaseNames) == 0 {
+		return nil, maskAny(errgo.Newf("no replications found on '%s'", peer.Host))
+	}
+	log.Infof("Found %d servers & %d databases", len(m.Servers), len(m.DatabaseNames))
+
+	// Extend the configuration with the existing topology
+	s.Servers = append(m.Servers, s.Servers[0])
+	s.DatabaseOverrides = append(s.DatabaseOverrides, m.Overrides...)
+	s.EdgePlacements = append(s.EdgePlacements, m.EdgePlacements...)
+	s.Seeds = []Seed{{Server: newServer.Host, Peer: peer.Host}}
+	if err := s.validateTopology(); err != nil {
+		return nil, maskAny(err)
+	}
+
+	conns := map[string]*serverConn{peer.String(): peerConn}
+	for _, srv := range s.Servers {
+		u := srv.URL
+		if _, found := conns[u.String()]; found {
+			continue
+		}
+		conn, err := s.connect(s.log(LogFields{Server: u.Host, Operation: "join"}), srv)
+		if err != nil {
+			return nil, maskAny(RedactError(err))
+		}
+		conns[u.String()] = conn
+	}
+	if err := s.discoverDatabases(conns); err != nil {
+		return nil, maskAny(RedactError(err))
+	}
+	// The databases of the existing topology are created on the new server when missing
+	s.discovered = mergeNames(s.discovered, m.DatabaseNames)
+	sort.Strings(s.discovered)
+	if s.existing == nil {
+		s.existing = make(map[string]map[string]bool)
+	}
+	if s.existing[newServer.Host] == nil {
+		s.existing[newServer.Host] = make(map[string]bool)
+	}
+
+	newConn := conns[newServer.String()]
+	s.log(LogFields{Server: newServer.Host}).Infof("Configuring replication for '%s'", newServer.Host)
+	if err := s.prepareServer(newConn); err != nil {
+		return nil, maskAny(RedactError(err))
+	}
+	if err := s.installDesignDocuments(newConn); err != nil {
+		return nil, maskAny(RedactError(err))
+	}
+	if err := s.seedServer(newConn, peerConn); err != nil {
+		return nil, maskAny(RedactError(err))
+	}
+	for _, e := range s.edges() {
+		if e.Source.Host != newServer.Host && e.Target.Host != newServer.Host {
+			continue
+		}
+		host := e.Host()
+		if err := s.setupEdge(e, conns[host.String()]); err != nil {
+			return nil, maskAny(RedactError(err))
+		}
+	}
+	return s.topology(), nil
+}
+
+// discoverMesh derives the existing topology from the continuous replication documents
+// created by this tool on the given server.
+func (s *service) discoverMesh(conn *serverConn, opts JoinOptions) (mesh, error) {
+	ids, err := conn.Admin.ListDocumentIDs(replicatorDbName)
+	if err != nil {
+		return mesh{}, maskAny(err)
+	}
+	m := mesh{Servers: []Server{opts.Peer}}
+	servers := map[string]bool{conn.URL.Host: true}
+	databases := make(map[string]bool)
+	overrides := make(map[DatabaseOverride]bool)
+	placements := make(map[EdgePlacement]bool)
+	for _, id := range ids {
+		if !managedDocumentID.MatchString(id) {
+			continue
+		}
+		var doc map[string]interface{}
+		if _, err := conn.Admin.ReadDocument(replicatorDbName, id, &doc); isCouchNotFound(err) {
+			continue
+		} else if err != nil {
+			return mesh{}, maskAny(err)
+		}
+		if continuous, _ := doc["continuous"].(bool); !continuous {
+			continue
+		}
+		placement := PlacementPull
+		remote, local := endpointURL(doc["source"]), doc["target"]
+		if remote == nil {
+			placement = PlacementPush
+			remote, local = endpointURL(doc["target"]), doc["source"]
+		}
+		localDb, _ := local.(string)
+		if remote == nil || localDb == "" || endpointHost(localDb) != "" {
+			continue
+		}
+		remoteDb := strings.TrimPrefix(remote.Path, "/")
+		remote.User, remote.Path, remote.RawPath, remote.RawQuery = nil, "", "", ""
+		if !servers[remote.Host] {
+			servers[remote.Host] = true
+			srv := Server{URL: *remote}
+			for _, x := range opts.Servers {
+				if x.URL.Host == remote.Host {
+					srv = x
+					srv.URL = *remote
+				}
+			}
+			m.Servers = append(m.Servers, srv)
+		}
+		databases[localDb] = true
+		if remoteDb != localDb {
+			overrides[DatabaseOverride{Server: remote.Host, Database: localDb, Name: remoteDb}] = true
+		}
+		if placement == PlacementPull {
+			placements[EdgePlacement{Source: remote.Host, Target: conn.URL.Host, Placement: placement}] = true
+		} else {
+			placements[EdgePlacement{Source: conn.URL.Host, Target: remote.Host, Placement: placement}] = true
+		}
+	}
+	for name := range databases {
+		m.DatabaseNames = append(m.DatabaseNames, name)
+	}
+	sort.Strings(m.DatabaseNames)
+	for o := range overrides {
+		m.Overrides = append(m.Overrides, o)
+	}
+	for p := range placements {
+		m.EdgePlacements = append(m.EdgePlacements, p)
+	}
+	return m, nil
+}
+
+// endpointURL returns the URL of the source or target of a replication document,
+// or nil for local databases.
+func endpointURL(endpoint interface{}) *url.URL {
+	var value string
+	switch e := endpoint.(type) {
+	case string:
+		value = e
+	case map[string]interface{}:
+		value, _ = e["url"].(string)
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	return u
+}
+
+// mergeNames returns the union of the given lists of names, in the order of first appearance.
+func mergeNames(list, values []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, name := range append(append([]string{}, list...), values...) {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	return result
+}
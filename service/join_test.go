@@ -0,0 +1,84 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJoin(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1", "db2")
+	defer closeFakeCouches(servers)
+	if err := newTestService(servers, "db1", "db2").Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	peer := servers[0]
+	peer.PutDoc("db1", "doc1", map[string]interface{}{"value": 1})
+	for _, fc := range servers {
+		fc.ResetRequests()
+	}
+
+	newServer := newFakeCouch(t)
+	defer newServer.Close()
+	newServer.replicatorState = true
+	s := newTestService([]*fakeCouch{newServer})
+	s.SeedPollInterval = time.Millisecond
+	topology, err := s.Join(JoinOptions{Peer: Server{URL: peer.URL()}})
+	if err != nil {
+		t.Fatalf("Join failed: %s", err)
+	}
+	// 3 servers, 2 databases
+	if len(topology) != 12 {
+		t.Errorf("Expected 12 edges, got %v", topology)
+	}
+	if dbs := newServer.Databases(); len(dbs) < 2 {
+		t.Errorf("Expected databases to be created on new server, got %v", dbs)
+	}
+	if seeds := newServer.Requests("PUT", "/"+replicatorDbName+"/"+seedDocumentPrefix); len(seeds) != 1 {
+		t.Errorf("Expected db1 to be seeded, got %v", seeds)
+	}
+	if docs := newServer.Docs(replicatorDbName); len(docs) != 4 {
+		t.Errorf("Expected 4 replication documents on new server, got %d", len(docs))
+	}
+	// Existing servers only get the replications from the new server
+	for _, fc := range servers {
+		if docs := fc.Docs(replicatorDbName); len(docs) != 4 {
+			t.Errorf("Expected 4 replication documents on existing server, got %d", len(docs))
+		}
+		if puts := fc.Requests("PUT", "/"); len(puts) != 2 {
+			t.Errorf("Expected only 2 new replication documents, got %v", puts)
+		}
+	}
+}
+
+func TestJoinRequiresHTTPClient(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	if err := newTestService(servers, "db1").Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	newServer := newFakeCouch(t)
+	defer newServer.Close()
+	s := newTestService([]*fakeCouch{newServer})
+	s.ClientFactory = NewLegacyClient
+	if _, err := s.Join(JoinOptions{Peer: Server{URL: servers[0].URL()}}); !isNotSupported(err) {
+		t.Fatalf("Expected Join to fail with an unsupported error, got %v", err)
+	}
+	if writes := newServer.Requests("PUT", "/"); len(writes) > 0 {
+		t.Errorf("Expected no writes on the new server, got %v", writes)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	// DefaultLagTimeout is the default maximum time to wait for a canary document to arrive.
+	DefaultLagTimeout = time.Minute
+	// DefaultLagPollInterval is the default time between checks for arrived canary documents.
+	DefaultLagPollInterval = 500 * time.Millisecond
+
+	// canaryDocPrefix is the prefix of the ID of canary documents, followed by the host of the server
+	// they are written on. Document IDs cannot start with an underscore, so `_repl_canary` is not usable.
+	canaryDocPrefix = "repl_canary:"
+	canaryDocType   = "repl_canary"
+)
+
+// LagOptions specify how replication lag is measured.
+type LagOptions struct {
+	Timeout      time.Duration // Maximum time to wait for a canary to arrive (default DefaultLagTimeout)
+	PollInterval time.Duration // Time between checks for arrived canaries (default DefaultLagPollInterval)
+}
+
+// LagMeasurement is the time it took for a canary document written on one server to appear on another server.
+type LagMeasurement struct {
+	Database string `json:"database"`
+	Source   string `json:"source"` // Host of the server the canary was written on
+	Target   string `json:"target"` // Host of the server the canary was waited for
+	Arrived  bool   `json:"arrived"`
+	LagMS    int64  `json:"lag_ms"` // Time until the canary arrived, or the time waited if it did not arrive
+}
+
+// String returns the measurement as a single line of space separated `key=value` pairs.
+func (m LagMeasurement) String() string {
+	lag := fmt.Sprintf("%dms", m.LagMS)
+	if !m.Arrived {
+		lag = "timeout"
+	}
+	return fmt.Sprintf("database=%s source=%s target=%s lag=%s", m.Database, m.Source, m.Target, lag)
+}
+
+// canaryDocumentID returns the ID of the canary document written on the server with given host.
+func canaryDocumentID(host string) string {
+	return canaryDocPrefix + host
+}
+
+// pendingCanary is a canary document that has not yet arrived on a target server.
+type pendingCanary struct {
+	LagMeasurement
+	conn    *serverConn // Connection to the target server
+	written time.Time
+	token   string
+}
+
+// Lag measures the replication lag between all servers. For every replicated database, it writes a
+// timestamped canary document (one per server) on every server and waits for these documents to appear
+// on the other servers of the database. The measurements are returned sorted by database, source & target.
+// Canaries that do not arrive within the timeout are returned as not arrived.
+func (s *service) Lag(opts LagOptions) ([]LagMeasurement, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultLagTimeout
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultLagPollInterval
+	}
+	if err := s.validateTopology(); err != nil {
+		return nil, maskAny(err)
+	}
+	conns := make(map[string]*serverConn)
+	for _, srv := range s.Servers {
+		u := srv.URL
+		log := s.log(LogFields{Server: u.Host, Operation: "lag"})
+		conn, err := s.connect(log, srv)
+		if err != nil {
+			return nil, maskAny(RedactError(err))
+		}
+		conns[u.String()] = conn
+	}
+	if err := s.discoverDatabases(conns); err != nil {
+		return nil, maskAny(RedactError(err))
+	}
+
+	var pending []*pendingCanary
+	for _, name := range s.replicatedDatabases() {
+		for _, source := range s.serversOf(name) {
+			if !s.isReplicatedOn(source.Host, name) {
+				continue
+			}
+			log := s.log(LogFields{Server: source.Host, Database: name, Operation: "lag"})
+			written, token, err := s.writeCanary(log, conns[source.String()], name)
+			if isCouchNotFound(err) {
+				log.Warningf("Database '%s' does not exist, skipping", name)
+				continue
+			} else if err != nil {
+				return nil, maskAny(RedactError(errgo.Notef(err, "cannot write canary document in '%s' on '%s': %s", name, source.Host, err.Error())))
+			}
+			for _, target := range s.serversOf(name) {
+				if target.Host == source.Host {
+					continue
+				}
+				pending = append(pending, &pendingCanary{
+					LagMeasurement: LagMeasurement{Database: name, Source: source.Host, Target: target.Host},
+					conn:           conns[target.String()],
+					written:        written,
+					token:          token,
+				})
+			}
+		}
+	}
+
+	var result []LagMeasurement
+	deadline := time.Now().Add(opts.Timeout)
+	for len(pending) > 0 {
+		var remaining []*pendingCanary
+		for _, p := range pending {
+			var doc struct {
+				Written string `json:"written"`
+			}
+			_, err := p.conn.Admin.ReadDocument(s.databaseName(p.Target, p.Database), canaryDocumentID(p.Source), &doc)
+			if err != nil && !isCouchNotFound(err) {
+				s.log(LogFields{Server: p.Target, Database: p.Database, Operation: "lag"}).Debugf("Cannot read canary document: %s", err.Error())
+			}
+			if err == nil && doc.Written == p.token {
+				p.Arrived = true
+				p.LagMS = milliseconds(time.Since(p.written))
+				result = append(result, p.LagMeasurement)
+			} else {
+				remaining = append(remaining, p)
+			}
+		}
+		pending = remaining
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			for _, p := range pending {
+				p.LagMS = milliseconds(time.Since(p.written))
+				result = append(result, p.LagMeasurement)
+			}
+			break
+		}
+		time.Sleep(opts.PollInterval)
+	}
+	sort.Sort(measurementsByKey(result))
+	return result, nil
+}
+
+// writeCanary writes the canary document of the given server in the given (logical) database.
+// It returns the local time at which it was written and the token that identifies this version of the canary.
+func (s *service) writeCanary(log fieldLogger, conn *serverConn, dbName string) (time.Time, string, error) {
+	host := conn.URL.Host
+	id := canaryDocumentID(host)
+	dbName = s.databaseName(host, dbName)
+	var written time.Time
+	var token string
+	err := s.Retry.Document.do(log, func() error {
+		var existing map[string]interface{}
+		rev, err := conn.Admin.ReadDocument(dbName, id, &existing)
+		if err != nil && !isCouchNotFound(err) {
+			return maskAny(err)
+		}
+		written = time.Now()
+		token = written.UTC().Format(time.RFC3339Nano)
+		doc := map[string]interface{}{
+			"type":    canaryDocType,
+			"server":  host,
+			"written": token,
+		}
+		if _, err := conn.Admin.SaveDocument(dbName, id, rev, doc); err != nil {
+			return maskAny(err)
+		}
+		return nil
+	})
+	return written, token, maskAny(err)
+}
+
+// logLag logs the given measurements, a warning for every canary that did not arrive.
+func (s *service) logLag(measurements []LagMeasurement) {
+	for _, m := range measurements {
+		log := s.log(LogFields{Server: m.Target, Database: m.Database, Edge: m.Source + "->" + m.Target, Operation: "lag"})
+		if m.Arrived {
+			log.Infof("Replication lag of '%s' from '%s' to '%s' is %dms", m.Database, m.Source, m.Target, m.LagMS)
+		} else {
+			log.Warningf("Canary of '%s' from '%s' did not arrive on '%s' within %dms", m.Database, m.Source, m.Target, m.LagMS)
+		}
+	}
+}
+
+type measurementsByKey []LagMeasurement
+
+func (l measurementsByKey) Len() int      { return len(l) }
+func (l measurementsByKey) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l measurementsByKey) Less(i, j int) bool {
+	a, b := l[i], l[j]
+	if a.Database != b.Database {
+		return a.Database < b.Database
+	}
+	if a.Source != b.Source {
+		return a.Source < b.Source
+	}
+	return a.Target < b.Target
+}
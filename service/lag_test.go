@@ -0,0 +1,76 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLag(t *testing.T) {
+	servers := startFakeCouches(t, 3, "db1")
+	defer closeFakeCouches(servers)
+	s := newTestService(servers, "db1")
+
+	// Mimic a replication from the first to the second server only
+	source, target := servers[0], servers[1]
+	id := canaryDocumentID(source.Host())
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			if doc, found := source.Docs("db1")[id]; found {
+				target.PutDoc("db1", id, doc)
+				return
+			}
+		}
+	}()
+
+	measurements, err := s.Lag(LagOptions{Timeout: 300 * time.Millisecond, PollInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Lag failed: %s", err)
+	}
+	if len(measurements) != 6 {
+		t.Fatalf("Expected 6 measurements, got %v", measurements)
+	}
+	for _, m := range measurements {
+		expected := m.Source == source.Host() && m.Target == target.Host()
+		if m.Arrived != expected {
+			t.Errorf("Unexpected measurement %s", m.String())
+		}
+		if !m.Arrived && m.LagMS < 300 {
+			t.Errorf("Expected timeout after at least 300ms, got %s", m.String())
+		}
+	}
+	for _, fc := range servers {
+		doc, found := fc.Docs("db1")[canaryDocumentID(fc.Host())]
+		if !found || doc["type"] != canaryDocType || doc["server"] != fc.Host() {
+			t.Errorf("Expected canary document on %s, got %v", fc.Host(), doc)
+		}
+	}
+
+	// Canaries are updated by later measurements
+	if _, err := s.Lag(LagOptions{Timeout: time.Millisecond}); err != nil {
+		t.Fatalf("Second lag measurement failed: %s", err)
+	}
+	if rev := source.Docs("db1")[id]["_rev"].(string); rev[:2] != "2-" {
+		t.Errorf("Expected updated canary document, got revision %s", rev)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/op/go-logging"
+)
+
+// LogFields holds the structured context that is attached to every log message of the service.
+// It is passed as the second (and last) argument of every log record, after the message itself,
+// so log formatters can extract it.
+type LogFields struct {
+	Server    string `json:"server,omitempty"`
+	Database  string `json:"database,omitempty"`
+	Edge      string `json:"edge,omitempty"`
+	Operation string `json:"operation,omitempty"`
+	Attempt   int    `json:"attempt,omitempty"`
+}
+
+// String returns the fields formatted as space separated `key=value` pairs.
+func (f LogFields) String() string {
+	var buf bytes.Buffer
+	add := func(key, value string) {
+		if value != "" {
+			if buf.Len() > 0 {
+				buf.WriteString(" ")
+			}
+			fmt.Fprintf(&buf, "%s=%s", key, value)
+		}
+	}
+	add("server", f.Server)
+	add("database", f.Database)
+	add("edge", f.Edge)
+	add("operation", f.Operation)
+	if f.Attempt > 0 {
+		add("attempt", fmt.Sprintf("%d", f.Attempt))
+	}
+	return buf.String()
+}
+
+// fieldLogger logs messages with a fixed set of structured fields.
+type fieldLogger struct {
+	logger *logging.Logger
+	fields LogFields
+}
+
+// log returns a logger that adds the given fields to every message.
+func (s *service) log(fields LogFields) fieldLogger {
+	return fieldLogger{logger: s.Logger, fields: fields}
+}
+
+// With returns a logger with the given modification applied to its fields.
+func (l fieldLogger) With(modify func(f *LogFields)) fieldLogger {
+	modify(&l.fields)
+	return l
+}
+
+func (l fieldLogger) Debugf(format string, args ...interface{}) {
+	l.logger.Debug(l.args(format, args...)...)
+}
+
+func (l fieldLogger) Infof(format string, args ...interface{}) {
+	l.logger.Info(l.args(format, args...)...)
+}
+
+func (l fieldLogger) Warningf(format string, args ...interface{}) {
+	l.logger.Warning(l.args(format, args...)...)
+}
+
+func (l fieldLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Error(l.args(format, args...)...)
+}
+
+// args formats the given message, redacts all credentials in it
+// and returns the log arguments for it.
+func (l fieldLogger) args(format string, args ...interface{}) []interface{} {
+	msg := Redact(fmt.Sprintf(format, args...))
+	if l.fields == (LogFields{}) {
+		return []interface{}{msg}
+	}
+	return []interface{}{msg, l.fields}
+}
+
+// operation returns a field modifier that sets the operation field.
+func operation(name string) func(f *LogFields) {
+	return func(f *LogFields) {
+		f.Operation = name
+	}
+}
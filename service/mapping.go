@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// DatabaseMapping is an explicit replication of a database on one server
+// into a (possibly differently named) database on another server.
+// Servers are identified by their host (host:port).
+type DatabaseMapping struct {
+	SourceDatabase string
+	SourceServer   string
+	TargetDatabase string
+	TargetServer   string
+}
+
+// ParseDatabaseMapping parses a mapping formatted as `db@source-host->db@target-host`.
+func ParseDatabaseMapping(value string) (DatabaseMapping, error) {
+	sides := strings.SplitN(value, "->", 2)
+	if len(sides) == 2 {
+		source := strings.SplitN(sides[0], "@", 2)
+		target := strings.SplitN(sides[1], "@", 2)
+		if len(source) == 2 && len(target) == 2 && source[0] != "" && source[1] != "" && target[0] != "" && target[1] != "" {
+			return DatabaseMapping{
+				SourceDatabase: source[0],
+				SourceServer:   source[1],
+				TargetDatabase: target[0],
+				TargetServer:   target[1],
+			}, nil
+		}
+	}
+	return DatabaseMapping{}, maskAny(errgo.Newf("invalid database mapping '%s', expected 'db@source-host->db@target-host'", value))
+}
+
+// ParseServerUser parses a server specific user formatted as `host=username:password`.
+func ParseServerUser(value string) (string, UserInfo, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) == 2 {
+		user := strings.SplitN(parts[1], ":", 2)
+		if parts[0] != "" && len(user) == 2 && user[0] != "" && user[1] != "" {
+			return parts[0], UserInfo{UserName: user[0], Password: user[1]}, nil
+		}
+	}
+	// Do not include the value in the error, it contains a password
+	return "", UserInfo{}, maskAny(errgo.New("invalid server user, expected 'host=username:password'"))
+}
+
+// DatabaseOverride specifies that a database is named differently on a specific server.
+type DatabaseOverride struct {
+	Server   string
+	Database string // Name as given in DatabaseNames
+	Name     string // Name of the database on the server
+}
+
+// ParseDatabaseOverride parses a database override formatted as `host=db:name`.
+func ParseDatabaseOverride(value string) (DatabaseOverride, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) == 2 {
+		names := strings.SplitN(parts[1], ":", 2)
+		if parts[0] != "" && len(names) == 2 && names[0] != "" && names[1] != "" {
+			return DatabaseOverride{Server: parts[0], Database: names[0], Name: names[1]}, nil
+		}
+	}
+	return DatabaseOverride{}, maskAny(errgo.Newf("invalid database override '%s', expected 'host=db:name'", value))
+}
+
+// databaseName returns the name of the given database on the server with given host.
+func (s *service) databaseName(host, dbName string) string {
+	for _, o := range s.DatabaseOverrides {
+		if o.Server == host && o.Database == dbName {
+			return o.Name
+		}
+	}
+	return dbName
+}
+
+// databasesOn returns the names of all replicated databases on the server with given host.
+func (s *service) databasesOn(host string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	for _, dbName := range s.replicatedDatabases() {
+		if s.isReplicatedOn(host, dbName) {
+			add(s.databaseName(host, dbName))
+		}
+	}
+	for _, m := range s.DatabaseMappings {
+		if m.SourceServer == host {
+			add(m.SourceDatabase)
+		}
+		if m.TargetServer == host {
+			add(m.TargetDatabase)
+		}
+	}
+	return result
+}
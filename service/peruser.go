@@ -0,0 +1,131 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	// DefaultPerUserPrefix is the prefix of the per-user databases created by couch_peruser.
+	DefaultPerUserPrefix = "userdb-"
+)
+
+// perUserDatabaseName returns the name of the per-user database of the user with given name,
+// as created by couch_peruser: the prefix followed by the hex encoded user name.
+func (s *service) perUserDatabaseName(user string) string {
+	return s.PerUserPrefix + hex.EncodeToString([]byte(user))
+}
+
+// perUserOwner returns the name of the user that owns the per-user database with given name.
+// It returns false if per-user databases are not enabled, or the name is not that of a per-user database.
+func (s *service) perUserOwner(dbName string) (string, bool) {
+	if !s.PerUserDatabases || !strings.HasPrefix(dbName, s.PerUserPrefix) {
+		return "", false
+	}
+	encoded := strings.TrimPrefix(dbName, s.PerUserPrefix)
+	if encoded == "" || strings.ToLower(encoded) != encoded {
+		return "", false
+	}
+	user, err := hex.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(user), true
+}
+
+// discoverUsers lists the users of all servers and records the union of their names,
+// so the per-user databases of these users are replicated. Servers without a connection in conns are skipped.
+func (s *service) discoverUsers(conns map[string]*serverConn) error {
+	users := make(map[string]bool)
+	for _, srv := range s.Servers {
+		u := srv.URL
+		conn, connected := conns[u.String()]
+		if !connected || !s.flavor(u.Host).ManagesUsers() {
+			continue
+		}
+		log := s.log(LogFields{Server: u.Host, Database: usersDbName, Operation: "discover-users"})
+		var ids []string
+		if err := s.Retry.Database.do(log, func() error {
+			var err error
+			ids, err = conn.Admin.ListDocumentIDs(usersDbName)
+			return maskAny(err)
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "cannot list users of '%s': %s", RedactURL(u), err.Error()))
+		}
+		for _, id := range ids {
+			if strings.HasPrefix(id, userDocPrefix) {
+				users[strings.TrimPrefix(id, userDocPrefix)] = true
+			}
+		}
+	}
+	s.users = users
+	return nil
+}
+
+// removeDeletedUserReplications removes the replication documents on the given server
+// of the per-user databases whose user no longer exists on any server.
+func (s *service) removeDeletedUserReplications(conn *serverConn) error {
+	host := conn.URL.Host
+	if !s.flavor(host).HostsReplications() {
+		return nil
+	}
+	log := s.log(LogFields{Server: host, Database: replicatorDbName, Operation: "remove-user-replications"})
+	var ids []string
+	if err := s.Retry.Document.do(log, func() error {
+		var err error
+		ids, err = conn.Admin.ListDocumentIDs(replicatorDbName)
+		return maskAny(err)
+	}); err != nil {
+		return maskAny(err)
+	}
+	for _, id := range ids {
+		if !managedDocumentID.MatchString(id) {
+			continue
+		}
+		id := id
+		var doc map[string]interface{}
+		rev, err := conn.Admin.ReadDocument(replicatorDbName, id, &doc)
+		if isCouchNotFound(err) {
+			continue
+		} else if err != nil {
+			return maskAny(err)
+		}
+		local, _ := doc["target"].(string)
+		if endpointHost(doc["source"]) == "" {
+			local, _ = doc["source"].(string)
+		}
+		user, ok := s.perUserOwner(s.logicalDatabaseName(host, local))
+		if !ok || s.users[user] {
+			continue
+		}
+		docLog := log.With(func(f *LogFields) { f.Database = local })
+		if err := s.record(docLog, KindDocument, id, s.Retry.Document, func() (ActionResult, error) {
+			docLog.Infof("User '%s' no longer exists, removing replication document '%s'", user, id)
+			if err := conn.Admin.DeleteDocument(replicatorDbName, id, rev); isCouchNotFound(err) {
+				return ActionUnchanged, nil
+			} else if err != nil {
+				return "", maskAny(err)
+			}
+			return ActionDeleted, nil
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "cannot remove replication document '%s': %s", id, err.Error()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPerUserOwner(t *testing.T) {
+	s := newTestService(nil)
+	if _, ok := s.perUserOwner("userdb-616c696365"); ok {
+		t.Error("Expected no owner when per-user databases are disabled")
+	}
+	s.PerUserDatabases = true
+	if name := s.perUserDatabaseName("alice"); name != "userdb-616c696365" {
+		t.Errorf("Unexpected database name '%s'", name)
+	}
+	if user, ok := s.perUserOwner("userdb-616c696365"); !ok || user != "alice" {
+		t.Errorf("Expected owner 'alice', got '%s' (%v)", user, ok)
+	}
+	for _, name := range []string{"userdb-", "userdb-xyz", "userdb-616C696365", "db1"} {
+		if _, ok := s.perUserOwner(name); ok {
+			t.Errorf("Expected '%s' not to be a per-user database", name)
+		}
+	}
+}
+
+func TestRunPerUserDatabases(t *testing.T) {
+	alice, bob := "userdb-616c696365", "userdb-626f62"
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	servers[0].AddUser("alice", "secret")
+	servers[0].AddDatabase(alice)
+	servers[1].AddDatabase(bob) // User bob does not exist (anymore)
+	s := newTestService(servers, "db1")
+	s.PerUserDatabases = true
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	for _, fc := range servers {
+		docs := pullDocuments(fc)
+		if _, found := docs[alice]; !found {
+			t.Errorf("Expected replication of '%s' on %s, got %v", alice, fc.Host(), docs)
+		}
+		if _, found := docs[bob]; found {
+			t.Errorf("Expected no replication of '%s' on %s", bob, fc.Host())
+		}
+		members, admins := fc.SecurityNames(alice)
+		if !reflect.DeepEqual(members, []string{"alice"}) || !reflect.DeepEqual(admins, []string{"alice"}) {
+			t.Errorf("Expected alice to be member & admin on %s, got %v, %v", fc.Host(), members, admins)
+		}
+		memberRoles, adminRoles := fc.Security(alice)
+		if len(memberRoles) != 0 || !reflect.DeepEqual(adminRoles, []string{roleReplicator}) {
+			t.Errorf("Unexpected roles on %s: %v, %v", fc.Host(), memberRoles, adminRoles)
+		}
+	}
+	if drifts, err := s.Diff(); err != nil || len(drifts) != 0 {
+		t.Errorf("Expected no drift, got %v (%v)", drifts, err)
+	}
+
+	// Delete the user, its replications must be removed
+	servers[0].RemoveUser("alice")
+	if err := s.Run(); err != nil {
+		t.Fatalf("Second run failed: %s", err)
+	}
+	for _, fc := range servers {
+		docs := pullDocuments(fc)
+		if _, found := docs[alice]; found {
+			t.Errorf("Expected replication of '%s' to be removed on %s", alice, fc.Host())
+		}
+		if _, found := docs["db1"]; !found {
+			t.Errorf("Expected replication of 'db1' to remain on %s", fc.Host())
+		}
+	}
+	deleted := 0
+	for _, a := range s.report.Actions {
+		if a.Kind == KindDocument && a.Result == ActionDeleted {
+			deleted++
+		}
+	}
+	if deleted != 2 {
+		t.Errorf("Expected 2 deleted replication documents in report, got %d", deleted)
+	}
+	if drifts, err := s.Diff(); err != nil || len(drifts) != 0 {
+		t.Errorf("Expected no drift after deleting user, got %v (%v)", drifts, err)
+	}
+}
@@ -16,17 +16,14 @@ package service
 
 import (
 	"crypto/sha1"
+	"encoding/json"
 	"fmt"
-	"net"
 	"net/http"
 	"net/url"
 	"reflect"
-	"strconv"
-	"time"
+	"strings"
 
-	"github.com/giantswarm/retry-go"
 	"github.com/juju/errgo"
-	"github.com/rhinoman/couchdb-go"
 )
 
 const (
@@ -41,6 +38,10 @@ type ReplicatorDocument struct {
 	CreateTarget bool    `json:"create_target,omitempty"`
 	Continuous   bool    `json:"continuous,omitempty"`
 	UserCtx      UserCtx `json:"user_ctx"`
+	// Selector, or Filter & QueryParams limit the replicated documents (see ReplicationFilter)
+	Selector    map[string]interface{} `json:"selector,omitempty"`
+	Filter      string                 `json:"filter,omitempty"`
+	QueryParams map[string]string      `json:"query_params,omitempty"`
 }
 
 type UserCtx struct {
@@ -48,211 +49,453 @@ type UserCtx struct {
 	Roles []string `json:"roles"`
 }
 
-func (s *service) setupReplication(serverURL url.URL) error {
-	// Open couchDB connection to given URL
-	host, port, err := net.SplitHostPort(serverURL.Host)
-	if err != nil {
-		return maskAny(err)
+// serverConn holds the clients used to access a single server.
+type serverConn struct {
+	URL        url.URL
+	Admin      CouchClient // Authenticated as the admin user of the server
+	Replicator CouchClient // Authenticated as the replicator user of the server
+}
+
+// requireHTTPClient returns an error when the given connection uses the legacy client,
+// which does not support the calls (database info, listing documents, ...) needed for the given feature.
+func requireHTTPClient(conn *serverConn, feature string) error {
+	if _, legacy := conn.Admin.(*legacyClient); legacy {
+		return maskAny(errgo.WithCausef(nil, NotSupportedError, "%s requires the http client", feature))
 	}
-	portNr, err := strconv.Atoi(port)
+	return nil
+}
+
+// connect creates clients for the given server and waits until it is available.
+func (s *service) connect(log fieldLogger, server Server) (*serverConn, error) {
+	serverURL := server.URL
+	admin, err := s.ClientFactory(server, s.adminUser(serverURL.Host), s.RequestTimeout)
 	if err != nil {
-		return maskAny(err)
+		return nil, maskAny(errgo.Notef(err, "cannot create database client: %s", err.Error()))
 	}
-	conn, err := couchdb.NewConnection(host, portNr, couchdbTimeout)
+	replicator, err := s.ClientFactory(server, s.replicatorUser(serverURL.Host), s.RequestTimeout)
 	if err != nil {
-		return maskAny(errgo.Notef(err, "cannot create database connection: %s", err.Error()))
+		return nil, maskAny(errgo.Notef(err, "cannot create database client: %s", err.Error()))
 	}
 	ping := func() error {
-		return maskAny(conn.Ping())
+		return maskAny(admin.Ping())
 	}
-	err = retry.Do(ping,
-		retry.MaxTries(60),
-		retry.Sleep(time.Second*2),
-		retry.Timeout(time.Minute*5),
-	)
-	if err != nil {
-		return maskAny(errgo.Notef(err, "cannot ping database: %s", err.Error()))
+	if err := s.Retry.Ping.do(log.With(operation("ping")), ping); err != nil {
+		return nil, maskAny(errgo.Notef(err, "cannot ping database: %s", err.Error()))
+	}
+	return &serverConn{
+		URL:        serverURL,
+		Admin:      admin,
+		Replicator: replicator,
+	}, nil
+}
+
+// prepareServer ensures that the users, roles and database security needed for replication
+// are configured on the given server.
+func (s *service) prepareServer(conn *serverConn) error {
+	serverURL := conn.URL
+	log := s.log(LogFields{Server: serverURL.Host})
+
+	flavor := s.flavor(serverURL.Host)
+	if flavor.ManagesUsers() {
+		// Create replicator user (if needed)
+		replicatorUser := s.replicatorUser(serverURL.Host)
+		replicationRoles := []string{roleReplicator}
+		userLog := log.With(operation("ensure-user"))
+		if err := s.record(userLog, KindUser, replicatorUser.UserName, s.Retry.User, func() (ActionResult, error) {
+			return s.ensureUser(userLog, replicatorUser, replicationRoles, conn.Admin)
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "failed to create replicator user '%s', on '%s': %s", replicatorUser.UserName, RedactURL(serverURL), err.Error()))
+		}
+
+		// Create editor user (if needed)
+		editorRoles := []string{roleEditor}
+		if err := s.record(userLog, KindUser, s.EditorUser.UserName, s.Retry.User, func() (ActionResult, error) {
+			return s.ensureUser(userLog, s.EditorUser, editorRoles, conn.Admin)
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "failed to create editor user '%s', on '%s': %s", s.EditorUser.UserName, RedactURL(serverURL), err.Error()))
+		}
 	}
 
-	// Connect to replicator database
-	adminAuth := couchdb.BasicAuth{Username: s.AdminUser.UserName, Password: s.AdminUser.Password}
+	// Configure roles for _replicator database
+	if flavor.ManagesSecurity() && flavor.HostsReplications() {
+		securityLog := log.With(func(f *LogFields) {
+			f.Database = replicatorDbName
+			f.Operation = "configure-security"
+		})
+		if err := s.record(securityLog, KindSecurity, replicatorDbName, s.Retry.Security, func() (ActionResult, error) {
+			return s.configureDatabaseSecurity(securityLog, s.databaseSecurity(serverURL.Host, replicatorDbName), conn.Admin, replicatorDbName)
+		}); err != nil {
+			return maskAny(err)
+		}
+	}
 
-	// Create replicator user (if needed)
-	replicationRoles := []string{roleReplicator}
-	if err := do(func() error {
-		return s.ensureUser(s.ReplicatorUser, replicationRoles, conn, &adminAuth)
-	}); err != nil {
-		return maskAny(errgo.Notef(err, "failed to create replicator user '%s', on '%s': %s", s.ReplicatorUser.UserName, serverURL, err.Error()))
+	// Create discovered databases that are missing on this server
+	if err := s.createMissingDatabases(log, conn); err != nil {
+		return maskAny(err)
 	}
 
-	// Create editor user (if needed)
-	editorRoles := []string{roleEditor}
-	if err := do(func() error {
-		return s.ensureUser(s.EditorUser, editorRoles, conn, &adminAuth)
-	}); err != nil {
-		return maskAny(errgo.Notef(err, "failed to create editor user '%s', on '%s': %s", s.EditorUser.UserName, serverURL, err.Error()))
+	// Configure database security
+	if !flavor.ManagesSecurity() {
+		return nil
+	}
+	for _, dbName := range s.databasesOn(serverURL.Host) {
+		securityLog := log.With(func(f *LogFields) {
+			f.Database = dbName
+			f.Operation = "configure-security"
+		})
+		if err := s.record(securityLog, KindSecurity, dbName, s.Retry.Security, func() (ActionResult, error) {
+			return s.configureDatabaseSecurity(securityLog, s.databaseSecurity(serverURL.Host, dbName), conn.Admin, dbName)
+		}); err != nil {
+			return maskAny(err)
+		}
 	}
 
-	// Connect to db
-	replicatorAuth := couchdb.BasicAuth{Username: s.ReplicatorUser.UserName, Password: s.ReplicatorUser.Password}
+	return nil
+}
 
-	// Configure roles for _replicator database
-	adminRoles := []string{roleReplicator}
-	if err := do(func() error {
-		return s.configureDatabaseRoles(nil, adminRoles, conn.SelectDB(replicatorDbName, &adminAuth))
-	}); err != nil {
+// setupEdge creates or updates the replication document of the given edge,
+// in the _replicator database of the server that hosts the edge.
+func (s *service) setupEdge(e edge, conn *serverConn) error {
+	host := e.Host()
+	log := s.log(LogFields{
+		Server:    host.Host,
+		Database:  e.HostDatabase(),
+		Edge:      e.String(),
+		Operation: "update-replication-document",
+	})
+
+	if !s.flavor(host.Host).HostsReplications() {
+		return maskAny(errgo.Newf("cannot setup edge '%s': neither '%s' nor '%s' can run replications", e, e.Source.Host, e.Target.Host))
+	}
+	replDoc, err := s.replicationDocument(e)
+	if err != nil {
 		return maskAny(err)
 	}
+	id := createId(replDoc)
 
-	// Create replicator document for all servers, for all databases
-	for _, sourceURL := range s.ServerURLs {
-		if sourceURL.String() == serverURL.String() {
-			// Do not replicate with myself
-			continue
+	update := func() (ActionResult, error) {
+		log.Infof("Updating replication database (%s)", e.Placement)
+		result, err := s.updateOrCreate(log, conn.Replicator, replicatorDbName, id, replDoc)
+		if err != nil {
+			log.Errorf("updateOrCreate failed: %s", err.Error())
+			return "", maskAny(err)
 		}
-		for _, dbName := range s.DatabaseNames {
-			// Configure database roles
-			memberRoles := []string{roleEditor}
-			adminRoles := []string{roleReplicator, roleEditor}
-			if err := do(func() error {
-				return s.configureDatabaseRoles(memberRoles, adminRoles, conn.SelectDB(dbName, &adminAuth))
-			}); err != nil {
-				return maskAny(err)
-			}
+		return result, nil
+	}
+	if err := s.record(log, KindDocument, id, s.Retry.Document, update); err != nil {
+		return maskAny(errgo.Notef(err, "failed to setup replicator document for '%s', edge '%s': %s", e.HostDatabase(), e, err.Error()))
+	}
+	return nil
+}
 
-			authURL := sourceURL
-			authURL.User = url.UserPassword(s.ReplicatorUser.UserName, s.ReplicatorUser.Password)
-			authURL.Path = dbName
-			replDoc := ReplicatorDocument{
-				Source:     authURL.String(),
-				Target:     dbName,
-				Continuous: true,
-				UserCtx: UserCtx{
-					Name:  s.ReplicatorUser.UserName,
-					Roles: []string{roleReplicator},
-				},
-			}
-			id := createId(replDoc)
-
-			replicatorDb := conn.SelectDB(replicatorDbName, &replicatorAuth)
-			update := func() error {
-				s.Logger.Info("Updating replication database")
-				if err := s.updateOrCreate(replicatorDb, id, replDoc); err != nil {
-					s.Logger.Errorf("updateOrCreate failed: %#v", err)
-					return maskAny(err)
-				}
-				return nil
-			}
-			err = retry.Do(update,
-				retry.MaxTries(5),
-				retry.Sleep(time.Second*2),
-				retry.Timeout(time.Minute),
-			)
-			if err != nil {
-				return maskAny(errgo.Notef(err, "failed to setup replicator document for '%s', source '%s': %s", dbName, sourceURL, err.Error()))
-			}
+// edgeKey identifies an edge by its source & target server and database, regardless of its placement.
+func edgeKey(sourceHost, sourceDb, targetHost, targetDb string) string {
+	return sourceHost + "/" + sourceDb + "->" + targetHost + "/" + targetDb
+}
+
+// documentEdgeKey returns the edge key of a replication document stored on the server with given host.
+// It returns false if the document does not replicate between a local and a remote database.
+func documentEdgeKey(host string, doc map[string]interface{}) (string, bool) {
+	endpoint := func(value interface{}) (string, string, bool) {
+		if u := endpointURL(value); u != nil {
+			return u.Host, strings.TrimPrefix(u.Path, "/"), true
 		}
+		name, ok := value.(string)
+		return host, name, ok && name != ""
 	}
+	sourceHost, sourceDb, ok1 := endpoint(doc["source"])
+	targetHost, targetDb, ok2 := endpoint(doc["target"])
+	if !ok1 || !ok2 || (sourceHost == host) == (targetHost == host) {
+		return "", false
+	}
+	return edgeKey(sourceHost, sourceDb, targetHost, targetDb), true
+}
 
+// removeMovedReplications removes the replication documents created by this tool from the given server,
+// for edges that are now hosted by the other server of the edge (e.g. after a change of placement),
+// so the replication does not run twice.
+func (s *service) removeMovedReplications(conn *serverConn) error {
+	host := conn.URL.Host
+	if !s.flavor(host).HostsReplications() {
+		return nil
+	}
+	moved := make(map[string]bool)
+	for _, e := range s.edges() {
+		if e.Host().Host != host && (e.Source.Host == host || e.Target.Host == host) {
+			moved[edgeKey(e.Source.Host, e.SourceDatabase, e.Target.Host, e.TargetDatabase)] = true
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	log := s.log(LogFields{Server: host, Database: replicatorDbName, Operation: "remove-moved-replications"})
+	var ids []string
+	if err := s.Retry.Document.do(log, func() error {
+		var err error
+		ids, err = conn.Admin.ListDocumentIDs(replicatorDbName)
+		return maskAny(err)
+	}); isNotSupported(err) {
+		log.Warningf("Cannot list replication documents, skipping removal of moved replications (requires the http client)")
+		return nil
+	} else if err != nil {
+		return maskAny(err)
+	}
+	for _, id := range ids {
+		if !managedDocumentID.MatchString(id) {
+			continue
+		}
+		var doc map[string]interface{}
+		var rev string
+		if err := s.Retry.Document.do(log, func() error {
+			var err error
+			rev, err = conn.Admin.ReadDocument(replicatorDbName, id, &doc)
+			return maskAny(err)
+		}); isCouchNotFound(err) {
+			continue
+		} else if err != nil {
+			return maskAny(err)
+		}
+		if key, ok := documentEdgeKey(host, doc); !ok || !moved[key] {
+			continue
+		}
+		id := id
+		if err := s.record(log, KindDocument, id, s.Retry.Document, func() (ActionResult, error) {
+			log.Infof("Replication document '%s' is now hosted by the other server, removing it", id)
+			if err := conn.Admin.DeleteDocument(replicatorDbName, id, rev); isCouchNotFound(err) {
+				return ActionUnchanged, nil
+			} else if err != nil {
+				return "", maskAny(err)
+			}
+			return ActionDeleted, nil
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "cannot remove replication document '%s': %s", id, err.Error()))
+		}
+	}
 	return nil
 }
 
-// ensureUser ensures that the given user exists in the given database server.
-func (s *service) ensureUser(user UserInfo, roles []string, conn *couchdb.Connection, adminAuth couchdb.Auth) error {
-	var userDoc couchdb.UserRecord
-	if _, err := conn.GetUser(user.UserName, &userDoc, adminAuth); err == nil {
+// replicationDocument creates the replication document for the given edge.
+// The database on the server hosting the edge is referenced by name only, the remote
+// database is referenced by URL, including the replicator credentials of the remote server.
+// The filter of the database (if any) is compiled for the edge.
+func (s *service) replicationDocument(e edge) (ReplicatorDocument, error) {
+	host := e.Host()
+	remote, remoteDb := e.Source, e.SourceDatabase
+	if e.Placement == PlacementPush {
+		remote, remoteDb = e.Target, e.TargetDatabase
+	}
+	remoteUser := s.replicatorUser(remote.Host)
+	authURL := remote
+	authURL.User = url.UserPassword(remoteUser.UserName, remoteUser.Password)
+	authURL.Path = remoteDb
+
+	doc := ReplicatorDocument{
+		Source:     authURL.String(),
+		Target:     e.HostDatabase(),
+		Continuous: true,
+		UserCtx: UserCtx{
+			Name:  s.replicatorUser(host.Host).UserName,
+			Roles: []string{roleReplicator},
+		},
+	}
+	if e.Placement == PlacementPush {
+		doc.Source, doc.Target = e.HostDatabase(), authURL.String()
+	}
+	if err := s.applyFilter(e, &doc); err != nil {
+		return ReplicatorDocument{}, maskAny(err)
+	}
+	return doc, nil
+}
+
+// ensureUser ensures that the given user exists in the given database server and has at least the given roles.
+func (s *service) ensureUser(log fieldLogger, user UserInfo, roles []string, client CouchClient) (ActionResult, error) {
+	if userDoc, err := client.GetUser(user.UserName); err == nil {
 		// user exists, check the roles
-		s.Logger.Debugf("user '%s' already exists", user.UserName)
-		for _, r := range roles {
-			if _, err := conn.GrantRole(user.UserName, r, adminAuth); err != nil {
-				s.Logger.Errorf("Failed to grant role '%s' to user '%s': %#v", r, user.UserName, err)
-				return maskAny(err)
-			}
+		log.Debugf("user '%s' already exists", user.UserName)
+		if _, changed := addMissing(userDoc.Roles, roles, false); !changed {
+			return ActionUnchanged, nil
 		}
-		return nil
+		if err := client.GrantRoles(user.UserName, roles); err != nil {
+			log.Errorf("Failed to grant roles %v to user '%s': %s", roles, user.UserName, err.Error())
+			return "", maskAny(err)
+		}
+		return ActionUpdated, nil
 	} else if isCouchNotFound(err) {
 		// Replicator user not found
-		s.Logger.Infof("Adding user '%s'", user.UserName)
-		if _, err := conn.AddUser(user.UserName, user.Password, roles, adminAuth); err != nil {
-			s.Logger.Errorf("Failed to add user '%s': %#v", user.UserName, err)
-			return maskAny(err)
+		log.Infof("Adding user '%s'", user.UserName)
+		if err := client.AddUser(user.UserName, user.Password, roles); err != nil {
+			log.Errorf("Failed to add user '%s': %s", user.UserName, err.Error())
+			return "", maskAny(err)
 		}
-		return nil
+		return ActionCreated, nil
 	} else {
 		// Some other error
-		return maskAny(err)
+		return "", maskAny(err)
 	}
 }
 
-// configureDatabaseRoles ensures that the given database has at least the given member and admin roles.
-func (s *service) configureDatabaseRoles(memberRoles, adminRoles []string, db *couchdb.Database) error {
-	for _, r := range memberRoles {
-		if err := db.AddRole(r, false); err != nil {
-			s.Logger.Errorf("Failed to add member role '%s' to db: %#v", r, err)
-			return maskAny(err)
+// databaseSecurity returns the names & roles that the security object of the given database on the server
+// with given host must (at least) contain. Per-user databases are only accessible by their user and the replicator.
+// On Cloudant, only the API key of the replicator is granted access.
+func (s *service) databaseSecurity(host, dbName string) Security {
+	if s.flavor(host) == FlavorCloudant {
+		return Security{Cloudant: map[string][]string{
+			s.replicatorUser(host).UserName: []string{cloudantReader, cloudantWriter, cloudantReplicator},
+		}}
+	}
+	if dbName == replicatorDbName {
+		return Security{Admins: SecurityGroup{Roles: []string{roleReplicator}}}
+	}
+	if user, ok := s.perUserOwner(s.logicalDatabaseName(host, dbName)); ok {
+		return Security{
+			Members: SecurityGroup{Names: []string{user}},
+			Admins:  SecurityGroup{Names: []string{user}, Roles: []string{roleReplicator}},
 		}
 	}
-	for _, r := range adminRoles {
-		if err := db.AddRole(r, true); err != nil {
-			s.Logger.Errorf("Failed to add admin role '%s' to db: %#v", r, err)
-			return maskAny(err)
+	return Security{
+		Members: SecurityGroup{Roles: []string{roleEditor}},
+		Admins:  SecurityGroup{Roles: []string{roleReplicator, roleEditor}},
+	}
+}
+
+// configureDatabaseSecurity ensures that the given database has at least the given member and admin names & roles.
+func (s *service) configureDatabaseSecurity(log fieldLogger, expected Security, client CouchClient, dbName string) (ActionResult, error) {
+	sec, err := client.GetSecurity(dbName)
+	if err != nil {
+		log.Errorf("Failed to read security of db: %s", err.Error())
+		return "", maskAny(err)
+	}
+	changed := false
+	sec.Members.Names, changed = addMissing(sec.Members.Names, expected.Members.Names, changed)
+	sec.Members.Roles, changed = addMissing(sec.Members.Roles, expected.Members.Roles, changed)
+	sec.Admins.Names, changed = addMissing(sec.Admins.Names, expected.Admins.Names, changed)
+	sec.Admins.Roles, changed = addMissing(sec.Admins.Roles, expected.Admins.Roles, changed)
+	for key, permissions := range expected.Cloudant {
+		if sec.Cloudant == nil {
+			sec.Cloudant = make(map[string][]string)
 		}
+		sec.Cloudant[key], changed = addMissing(sec.Cloudant[key], permissions, changed)
 	}
-	return nil
+	if !changed {
+		return ActionUnchanged, nil
+	}
+	if err := client.SaveSecurity(dbName, sec); err != nil {
+		log.Errorf("Failed to add roles to db: %s", err.Error())
+		return "", maskAny(err)
+	}
+	return ActionUpdated, nil
 }
 
-func (s *service) updateOrCreate(db *couchdb.Database, id string, document ReplicatorDocument) error {
-	var oldDoc ReplicatorDocument
-	rev, err := db.Read(id, &oldDoc, nil)
+// addMissing appends all values that are not yet in list.
+// changed is set to true when a value was appended.
+func addMissing(list, values []string, changed bool) ([]string, bool) {
+	for _, v := range values {
+		found := false
+		for _, x := range list {
+			if x == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+			changed = true
+		}
+	}
+	return list, changed
+}
+
+// updateOrCreate ensures that the document with given id in the given database matches the given document.
+// An existing document is updated in place (using its current revision), so the replication is not interrupted,
+// unless the server does not allow that (triggered documents on CouchDB 1.x), in which case it is recreated.
+// A conflicting update (e.g. by the replicator) fails with 409, so the retry policy of the caller reads it again.
+func (s *service) updateOrCreate(log fieldLogger, client CouchClient, dbName, id string, document interface{}) (ActionResult, error) {
+	expected, err := documentFields(document)
+	if err != nil {
+		return "", maskAny(err)
+	}
+	var oldDoc map[string]interface{}
+	rev, err := client.ReadDocument(dbName, id, &oldDoc)
 	if isCouchNotFound(err) {
 		// Not found, create new document
 		rev = ""
 	} else if err != nil {
-		return maskAny(err)
-	} else {
-		// Compare document
-		if reflect.DeepEqual(oldDoc, document) {
-			// Nothing has changed
-			s.Logger.Infof("nothing has changed in replicator-document '%s'", id)
-			return nil
-		}
+		return "", maskAny(err)
+	} else if reflect.DeepEqual(userFields(oldDoc), expected) {
+		// Nothing has changed
+		log.Infof("nothing has changed in document '%s' of '%s'", id, dbName)
+		return ActionUnchanged, nil
 	}
 
-	// Remove the old document (if needed)
-	if rev != "" {
-		if _, err := db.Delete(id, rev); err != nil {
-			return maskAny(err)
-		}
+	// CouchDB 1.x only allows the replicator itself to edit triggered replication documents.
+	if rev != "" && oldDoc["_replication_state"] == "triggered" && isCouchDB1(client) {
+		log.Debugf("document '%s' of '%s' is triggered, recreating it", id, dbName)
+		return recreateDocument(client, dbName, id, rev, document)
+	}
+	// Conflicts are retried by the caller, which reads the document again.
+	_, err = client.SaveDocument(dbName, id, rev, document)
+	if rev != "" && couchStatus(err) == http.StatusForbidden {
+		log.Debugf("updating document '%s' of '%s' is forbidden, recreating it", id, dbName)
+		return recreateDocument(client, dbName, id, rev, document)
+	} else if err != nil {
+		return "", maskAny(err)
+	}
+	if rev == "" {
+		return ActionCreated, nil
 	}
+	return ActionUpdated, nil
+}
 
-	// Save as new document
-	if _, err := db.Save(document, id, ""); err != nil {
-		return maskAny(err)
+// recreateDocument replaces revision rev of a document by deleting it and creating it again.
+func recreateDocument(client CouchClient, dbName, id, rev string, document interface{}) (ActionResult, error) {
+	if err := client.DeleteDocument(dbName, id, rev); err != nil {
+		return "", maskAny(err)
 	}
+	if _, err := client.SaveDocument(dbName, id, "", document); err != nil {
+		return "", maskAny(err)
+	}
+	return ActionUpdated, nil
+}
 
-	return nil
+// isCouchDB1 returns true if the server of given client runs CouchDB 1.x.
+// Clients that cannot fetch the server info (legacy) only support CouchDB 1.x.
+func isCouchDB1(client CouchClient) bool {
+	info, err := client.ServerInfo()
+	if isNotSupported(err) {
+		return true
+	} else if err != nil {
+		return false
+	}
+	return strings.HasPrefix(info.Version, "1.")
 }
 
-func isCouchNotFound(err error) bool {
-	if cerr, ok := err.(*couchdb.Error); ok {
-		return cerr.StatusCode == http.StatusNotFound
+// documentFields returns the fields of the given document, as they are stored in the database.
+func documentFields(document interface{}) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return nil, maskAny(err)
 	}
-	return false
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, maskAny(err)
+	}
+	return fields, nil
+}
+
+// userFields returns a copy of the given document without the fields that are managed by CouchDB,
+// such as _id, _rev, _replication_state and owner.
+func userFields(doc map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for k, v := range doc {
+		if strings.HasPrefix(k, "_") || k == "owner" {
+			continue
+		}
+		result[k] = v
+	}
+	return result
 }
 
 func createId(replDoc ReplicatorDocument) string {
 	data := fmt.Sprintf("%s,%s", replDoc.Source, replDoc.Target)
 	return fmt.Sprintf("%x", sha1.Sum([]byte(data)))
 }
-
-// do executes the given functions, retrying a few times when it fails.
-func do(action func() error) error {
-	if err := retry.Do(action,
-		retry.MaxTries(5),
-		retry.Sleep(time.Second*2),
-		retry.Timeout(time.Minute),
-	); err != nil {
-		return maskAny(err)
-	}
-	return nil
-}
@@ -0,0 +1,679 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replicationDocs returns the source/target pairs of all documents in the _replicator database of the given server.
+func replicationDocs(fc *fakeCouch) map[string]string {
+	result := make(map[string]string)
+	for _, doc := range fc.Docs(replicatorDbName) {
+		result[fmt.Sprint(doc["source"])] = fmt.Sprint(doc["target"])
+	}
+	return result
+}
+
+// remoteURL returns the URL used in replication documents to reference the given database on the given server.
+func remoteURL(fc *fakeCouch, dbName string) string {
+	u := fc.URL()
+	u.User = url.UserPassword(testReplName, testReplPass)
+	u.Path = dbName
+	return u.String()
+}
+
+func TestRunTwoServers(t *testing.T) {
+	testRunTwoServers(t, NewHTTPClient)
+}
+
+func TestRunTwoServersLegacyClient(t *testing.T) {
+	testRunTwoServers(t, NewLegacyClient)
+}
+
+func testRunTwoServers(t *testing.T, factory ClientFactory) {
+	servers := startFakeCouches(t, 2, "db1", "db2")
+	defer closeFakeCouches(servers)
+
+	s := newTestService(servers, "db1", "db2")
+	s.ClientFactory = factory
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	for i, fc := range servers {
+		peer := servers[1-i]
+		if roles := fc.UserRoles(testReplName); !reflect.DeepEqual(roles, []string{roleReplicator}) {
+			t.Errorf("Expected replicator roles %v, got %v", []string{roleReplicator}, roles)
+		}
+		if roles := fc.UserRoles(testEditorName); !reflect.DeepEqual(roles, []string{roleEditor}) {
+			t.Errorf("Expected editor roles %v, got %v", []string{roleEditor}, roles)
+		}
+		if _, admins := fc.Security(replicatorDbName); !reflect.DeepEqual(admins, []string{roleReplicator}) {
+			t.Errorf("Expected _replicator admin roles %v, got %v", []string{roleReplicator}, admins)
+		}
+		for _, dbName := range []string{"db1", "db2"} {
+			members, admins := fc.Security(dbName)
+			if !reflect.DeepEqual(members, []string{roleEditor}) {
+				t.Errorf("Expected %s member roles %v, got %v", dbName, []string{roleEditor}, members)
+			}
+			if !reflect.DeepEqual(admins, []string{roleReplicator, roleEditor}) {
+				t.Errorf("Expected %s admin roles %v, got %v", dbName, []string{roleReplicator, roleEditor}, admins)
+			}
+		}
+		expected := map[string]string{
+			remoteURL(peer, "db1"): "db1",
+			remoteURL(peer, "db2"): "db2",
+		}
+		if docs := replicationDocs(fc); !reflect.DeepEqual(docs, expected) {
+			t.Errorf("Expected replication documents %v, got %v", expected, docs)
+		}
+	}
+}
+
+func TestRunIsIdempotent(t *testing.T) {
+	servers := startFakeCouches(t, 3, "db1")
+	defer closeFakeCouches(servers)
+
+	s := newTestService(servers, "db1")
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	before := make([]map[string]map[string]interface{}, len(servers))
+	for i, fc := range servers {
+		before[i] = fc.Docs(replicatorDbName)
+		if len(before[i]) != 2 {
+			t.Errorf("Expected 2 replication documents, got %d", len(before[i]))
+		}
+		fc.ResetRequests()
+	}
+
+	if err := s.Run(); err != nil {
+		t.Fatalf("Second run failed: %s", err)
+	}
+	for i, fc := range servers {
+		if writes := fc.Requests("PUT", "/"+replicatorDbName+"/"); len(writes) > 0 {
+			t.Errorf("Expected no writes to _replicator in second run, got %v", writes)
+		}
+		if deletes := fc.Requests("DELETE", "/"); len(deletes) > 0 {
+			t.Errorf("Expected no deletes in second run, got %v", deletes)
+		}
+		if after := fc.Docs(replicatorDbName); !reflect.DeepEqual(before[i], after) {
+			t.Errorf("Replication documents changed in second run")
+		}
+	}
+}
+
+func TestRunRetriesTransientErrors(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	servers[0].Fail("GET", "/db1/_security", http.StatusInternalServerError, 2)
+	servers[1].Fail("PUT", "/"+replicatorDbName+"/", http.StatusServiceUnavailable, 1)
+
+	s := newTestService(servers, "db1")
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	// 2 failed attempts, followed by a successful attempt
+	if reqs := servers[0].Requests("GET", "/db1/_security"); len(reqs) != 3 {
+		t.Errorf("Expected 3 security requests, got %d", len(reqs))
+	}
+	for _, fc := range servers {
+		if docs := fc.Docs(replicatorDbName); len(docs) != 1 {
+			t.Errorf("Expected 1 replication document, got %d", len(docs))
+		}
+	}
+}
+
+func TestRunDoesNotRetryFatalErrors(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	servers[0].Fail("GET", "/db1/_security", http.StatusForbidden, -1)
+
+	s := newTestService(servers, "db1")
+	if err := s.Run(); err == nil {
+		t.Fatal("Expected Run to fail")
+	}
+	if reqs := servers[0].Requests("GET", "/db1/_security"); len(reqs) != 1 {
+		t.Errorf("Expected 1 security request, got %d", len(reqs))
+	}
+}
+
+func TestRunWrongAdminPassword(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+
+	s := newTestService(servers, "db1")
+	s.AdminUser.Password = "wrong-secret"
+	s.ReplicatorUser.Password = "other-secret"
+	err := s.Run()
+	if err == nil {
+		t.Fatal("Expected Run to fail")
+	}
+	for _, secret := range []string{"wrong-secret", "other-secret"} {
+		if strings.Contains(err.Error(), secret) {
+			t.Errorf("Error contains password: %s", err)
+		}
+	}
+	if docs := servers[1].Docs(replicatorDbName); len(docs) != 0 {
+		t.Errorf("Expected no replication documents, got %d", len(docs))
+	}
+}
+
+func TestRunPartialFailureConverges(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+
+	s := newTestService(servers, "db1")
+	replDoc, err := s.replicationDocument(edge{
+		Source:         servers[0].URL(),
+		Target:         servers[1].URL(),
+		SourceDatabase: "db1",
+		TargetDatabase: "db1",
+		Placement:      PlacementPull,
+	})
+	if err != nil {
+		t.Fatalf("replicationDocument failed: %s", err)
+	}
+	id := createId(replDoc)
+	servers[1].Fail("PUT", "/"+replicatorDbName+"/"+id, http.StatusInternalServerError, -1)
+	if err := s.Run(); err == nil {
+		t.Fatal("Expected Run to fail")
+	}
+	if docs := servers[0].Docs(replicatorDbName); len(docs) != 1 {
+		t.Errorf("Expected 1 replication document on first server, got %d", len(docs))
+	}
+	if docs := servers[1].Docs(replicatorDbName); len(docs) != 0 {
+		t.Errorf("Expected no replication documents on second server, got %d", len(docs))
+	}
+
+	servers[1].ClearFailures()
+	if err := s.Run(); err != nil {
+		t.Fatalf("Second run failed: %s", err)
+	}
+	for _, fc := range servers {
+		if docs := fc.Docs(replicatorDbName); len(docs) != 1 {
+			t.Errorf("Expected 1 replication document, got %d", len(docs))
+		}
+	}
+}
+
+func TestRunPushPlacementAndPairs(t *testing.T) {
+	servers := startFakeCouches(t, 3, "db1")
+	defer closeFakeCouches(servers)
+	core, edge1, edge2 := servers[0], servers[1], servers[2]
+
+	s := newTestService(servers, "db1")
+	s.EdgePlacements = []EdgePlacement{{Source: edge1.Host(), Target: core.Host(), Placement: PlacementPush}}
+	s.Pairs = []ServerPair{{Host: core.Host(), Peer: edge2.Host()}}
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	expectCore := map[string]string{
+		remoteURL(edge2, "db1"): "db1",                   // Pull from edge2 (pair)
+		"db1":                   remoteURL(edge2, "db1"), // Push to edge2 (pair)
+	}
+	if docs := replicationDocs(core); !reflect.DeepEqual(docs, expectCore) {
+		t.Errorf("Expected core documents %v, got %v", expectCore, docs)
+	}
+	if docs := edge1.Docs(replicatorDbName); len(docs) != 3 {
+		// Pull from core & edge2, push to core
+		t.Errorf("Expected 3 documents on edge1, got %d", len(docs))
+	}
+	if docs := edge2.Docs(replicatorDbName); len(docs) != 1 {
+		// Pull from edge1 only, core edges are on core
+		t.Errorf("Expected 1 document on edge2, got %d", len(docs))
+	}
+}
+
+func TestRunRemovesMovedReplications(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	s := newTestService(servers, "db1")
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	unrelated := map[string]interface{}{"source": "other", "target": "db2"}
+	servers[0].PutDoc(replicatorDbName, "0123456789012345678901234567890123456789", unrelated)
+
+	// Switch to push, every pull document must be removed from its old host
+	s.DefaultPlacement = PlacementPush
+	if err := s.Run(); err != nil {
+		t.Fatalf("Second run failed: %s", err)
+	}
+	for i, fc := range servers {
+		peer := servers[1-i]
+		docs := replicationDocs(fc)
+		if target := docs["db1"]; target != remoteURL(peer, "db1") {
+			t.Errorf("Expected push document on %s, got %v", fc.Host(), docs)
+		}
+		if _, found := docs[remoteURL(peer, "db1")]; found {
+			t.Errorf("Expected pull document to be removed from %s, got %v", fc.Host(), docs)
+		}
+	}
+	if _, found := servers[0].Docs(replicatorDbName)["0123456789012345678901234567890123456789"]; !found {
+		t.Error("Expected unrelated replication document to remain")
+	}
+}
+
+func TestRunDatabaseMappingsAndOverrides(t *testing.T) {
+	servers := startFakeCouches(t, 2)
+	defer closeFakeCouches(servers)
+	dc1, dc2 := servers[0], servers[1]
+	dc1.AddDatabase("orders")
+	dc2.AddDatabase("orders_replica")
+	dc1.AddDatabase("users")
+	dc2.AddDatabase("users_eu")
+
+	s := newTestService(servers, "users")
+	s.DatabaseMappings = []DatabaseMapping{{SourceDatabase: "orders", SourceServer: dc1.Host(), TargetDatabase: "orders_replica", TargetServer: dc2.Host()}}
+	s.DatabaseOverrides = []DatabaseOverride{{Server: dc2.Host(), Database: "users", Name: "users_eu"}}
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	expectDc1 := map[string]string{
+		remoteURL(dc2, "users_eu"): "users",
+	}
+	if docs := replicationDocs(dc1); !reflect.DeepEqual(docs, expectDc1) {
+		t.Errorf("Expected dc1 documents %v, got %v", expectDc1, docs)
+	}
+	expectDc2 := map[string]string{
+		remoteURL(dc1, "users"):  "users_eu",
+		remoteURL(dc1, "orders"): "orders_replica",
+	}
+	if docs := replicationDocs(dc2); !reflect.DeepEqual(docs, expectDc2) {
+		t.Errorf("Expected dc2 documents %v, got %v", expectDc2, docs)
+	}
+}
+
+func TestRunAllDatabasesCreatesMissing(t *testing.T) {
+	servers := startFakeCouches(t, 2)
+	defer closeFakeCouches(servers)
+	servers[0].AddDatabase("tenant_a")
+	servers[0].AddDatabase("internal")
+	servers[1].AddDatabase("tenant_b")
+
+	s := newTestService(servers)
+	s.AllDatabases = true
+	exclude, _ := ParseDatabasePattern("intern*")
+	s.ExcludeDatabases = []DatabasePattern{exclude}
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	expected := []string{replicatorDbName, usersDbName, "tenant_a", "tenant_b"}
+	if dbs := servers[1].Databases(); !reflect.DeepEqual(dbs, expected) {
+		t.Errorf("Expected databases %v, got %v", expected, dbs)
+	}
+	for _, fc := range servers {
+		if docs := fc.Docs(replicatorDbName); len(docs) != 2 {
+			t.Errorf("Expected 2 replication documents, got %d", len(docs))
+		}
+	}
+}
+
+func TestEnsureUserGrantsMissingRoles(t *testing.T) {
+	fc := newFakeCouch(t)
+	defer fc.Close()
+	fc.AddUser(testReplName, testReplPass, "other")
+
+	s := newTestService([]*fakeCouch{fc})
+	conn, err := s.connect(s.log(LogFields{}), Server{URL: fc.URL()})
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.ensureUser(s.log(LogFields{}), s.ReplicatorUser, []string{roleReplicator}, conn.Admin); err != nil {
+			t.Fatalf("ensureUser failed: %s", err)
+		}
+	}
+	if roles := fc.UserRoles(testReplName); !reflect.DeepEqual(roles, []string{"other", roleReplicator}) {
+		t.Errorf("Expected roles %v, got %v", []string{"other", roleReplicator}, roles)
+	}
+}
+
+func TestUpdateOrCreateUpdatesChangedDocumentInPlace(t *testing.T) {
+	fc := newFakeCouch(t)
+	defer fc.Close()
+	fc.replicatorState = true
+	fc.version = "2.1.1"
+
+	s := newTestService([]*fakeCouch{fc})
+	conn, err := s.connect(s.log(LogFields{}), Server{URL: fc.URL()})
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	doc := ReplicatorDocument{Source: "http://a/db", Target: "db", Continuous: true, UserCtx: UserCtx{Name: testReplName, Roles: []string{roleReplicator}}}
+	if _, err := s.updateOrCreate(s.log(LogFields{}), conn.Admin, replicatorDbName, "doc1", doc); err != nil {
+		t.Fatalf("updateOrCreate failed: %s", err)
+	}
+	doc.Continuous = false
+	if _, err := s.updateOrCreate(s.log(LogFields{}), conn.Admin, replicatorDbName, "doc1", doc); err != nil {
+		t.Fatalf("updateOrCreate failed: %s", err)
+	}
+	docs := fc.Docs(replicatorDbName)
+	if len(docs) != 1 {
+		t.Fatalf("Expected 1 document, got %d", len(docs))
+	}
+	if _, found := docs["doc1"]["continuous"]; found {
+		t.Errorf("Expected document to be updated, got %v", docs["doc1"])
+	}
+	if deletes := fc.Requests("DELETE", "/"+replicatorDbName+"/"); len(deletes) > 0 {
+		t.Errorf("Expected document to be updated in place, got %v", deletes)
+	}
+}
+
+func TestUpdateOrCreateIgnoresReplicatorFields(t *testing.T) {
+	fc := newFakeCouch(t)
+	defer fc.Close()
+	fc.replicatorState = true
+
+	s := newTestService([]*fakeCouch{fc})
+	conn, err := s.connect(s.log(LogFields{}), Server{URL: fc.URL()})
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	doc := ReplicatorDocument{Source: "http://a/db", Target: "db", Continuous: true, UserCtx: UserCtx{Name: testReplName, Roles: []string{roleReplicator}}}
+	if _, err := s.updateOrCreate(s.log(LogFields{}), conn.Admin, replicatorDbName, "doc1", doc); err != nil {
+		t.Fatalf("updateOrCreate failed: %s", err)
+	}
+	fc.ResetRequests()
+	if _, err := s.updateOrCreate(s.log(LogFields{}), conn.Admin, replicatorDbName, "doc1", doc); err != nil {
+		t.Fatalf("updateOrCreate failed: %s", err)
+	}
+	if writes := fc.Requests("PUT", "/"+replicatorDbName+"/"); len(writes) > 0 {
+		t.Errorf("Expected no writes for unchanged document, got %v", writes)
+	}
+}
+
+func TestUpdateOrCreateRecreatesTriggeredDocumentOnCouchDB1(t *testing.T) {
+	fc := newFakeCouch(t)
+	defer fc.Close()
+	fc.replicatorState = true
+
+	s := newTestService([]*fakeCouch{fc})
+	conn, err := s.connect(s.log(LogFields{}), Server{URL: fc.URL()})
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	doc := ReplicatorDocument{Source: "http://a/db", Target: "db", Continuous: true, UserCtx: UserCtx{Name: testReplName, Roles: []string{roleReplicator}}}
+	if _, err := s.updateOrCreate(s.log(LogFields{}), conn.Admin, replicatorDbName, "doc1", doc); err != nil {
+		t.Fatalf("updateOrCreate failed: %s", err)
+	}
+	doc.Target = "db2"
+	fc.ResetRequests()
+	result, err := s.updateOrCreate(s.log(LogFields{}), conn.Admin, replicatorDbName, "doc1", doc)
+	if err != nil {
+		t.Fatalf("updateOrCreate failed: %s", err)
+	}
+	if result != ActionUpdated {
+		t.Errorf("Expected %s, got %s", ActionUpdated, result)
+	}
+	if deletes := fc.Requests("DELETE", "/"+replicatorDbName+"/doc1"); len(deletes) != 1 {
+		t.Errorf("Expected triggered document to be deleted once, got %v", deletes)
+	}
+	if target := fc.Docs(replicatorDbName)["doc1"]["target"]; target != "db2" {
+		t.Errorf("Expected recreated document with target db2, got %v", target)
+	}
+}
+
+func TestUpdateOrCreateRecreatesForbiddenDocument(t *testing.T) {
+	fc := newFakeCouch(t)
+	defer fc.Close()
+	fc.version = "2.1.1"
+
+	s := newTestService([]*fakeCouch{fc})
+	conn, err := s.connect(s.log(LogFields{}), Server{URL: fc.URL()})
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	doc := ReplicatorDocument{Source: "http://a/db", Target: "db", Continuous: true, UserCtx: UserCtx{Name: testReplName, Roles: []string{roleReplicator}}}
+	if _, err := s.updateOrCreate(s.log(LogFields{}), conn.Admin, replicatorDbName, "doc1", doc); err != nil {
+		t.Fatalf("updateOrCreate failed: %s", err)
+	}
+	doc.Target = "db2"
+	fc.Fail("PUT", "/"+replicatorDbName+"/doc1", http.StatusForbidden, 1)
+	if _, err := s.updateOrCreate(s.log(LogFields{}), conn.Admin, replicatorDbName, "doc1", doc); err != nil {
+		t.Fatalf("updateOrCreate failed: %s", err)
+	}
+	if deletes := fc.Requests("DELETE", "/"+replicatorDbName+"/doc1"); len(deletes) != 1 {
+		t.Errorf("Expected forbidden document to be deleted once, got %v", deletes)
+	}
+	if target := fc.Docs(replicatorDbName)["doc1"]["target"]; target != "db2" {
+		t.Errorf("Expected recreated document with target db2, got %v", target)
+	}
+}
+
+func TestUpdateOrCreateConflictsAreRetriedByPolicy(t *testing.T) {
+	fc := newFakeCouch(t)
+	defer fc.Close()
+
+	s := newTestService([]*fakeCouch{fc})
+	conn, err := s.connect(s.log(LogFields{}), Server{URL: fc.URL()})
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	doc := ReplicatorDocument{Source: "http://a/db", Target: "db", Continuous: true, UserCtx: UserCtx{Name: testReplName, Roles: []string{roleReplicator}}}
+	update := func() error {
+		_, err := s.updateOrCreate(s.log(LogFields{}), conn.Admin, replicatorDbName, "doc1", doc)
+		return err
+	}
+
+	// A single attempt does not retry conflicts itself
+	fc.Fail("PUT", "/"+replicatorDbName+"/doc1", http.StatusConflict, 1)
+	if err := testRetryPolicy(1).do(s.log(LogFields{}), update); err == nil {
+		t.Fatal("Expected conflict")
+	}
+	if reads := fc.Requests("GET", "/"+replicatorDbName+"/doc1"); len(reads) != 1 {
+		t.Errorf("Expected document to be read once, got %d", len(reads))
+	}
+
+	fc.ResetRequests()
+	fc.Fail("PUT", "/"+replicatorDbName+"/doc1", http.StatusConflict, 2)
+	if err := testRetryPolicy(3).do(s.log(LogFields{}), update); err != nil {
+		t.Fatalf("update failed: %s", err)
+	}
+	if reads := fc.Requests("GET", "/"+replicatorDbName+"/doc1"); len(reads) != 3 {
+		t.Errorf("Expected document to be read 3 times, got %d", len(reads))
+	}
+	if docs := fc.Docs(replicatorDbName); len(docs) != 1 {
+		t.Errorf("Expected 1 document, got %d", len(docs))
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	servers[0].Fail("GET", "/db1/_security", http.StatusInternalServerError, 1)
+
+	var reports []Report
+	s := newTestService(servers, "db1")
+	s.ReportHandler = func(r Report) { reports = append(reports, r) }
+	for i := 0; i < 2; i++ {
+		if err := s.Run(); err != nil {
+			t.Fatalf("Run failed: %s", err)
+		}
+	}
+	if len(reports) != 2 {
+		t.Fatalf("Expected 2 reports, got %d", len(reports))
+	}
+
+	// Per server: 2 users, 2 security objects & 1 replication document
+	first, second := reports[0], reports[1]
+	if !first.Success || len(first.Actions) != 10 {
+		t.Fatalf("Expected successful report with 10 actions, got %+v", first)
+	}
+	if first.Summary[ActionCreated] != 6 || first.Summary[ActionUpdated] != 4 {
+		t.Errorf("Expected 6 created & 4 updated actions, got %v", first.Summary)
+	}
+	if second.Summary[ActionUnchanged] != 10 {
+		t.Errorf("Expected 10 unchanged actions in second run, got %v", second.Summary)
+	}
+	found := false
+	for _, a := range first.Actions {
+		if a.Kind == KindSecurity && a.Server == servers[0].Host() && a.Database == "db1" {
+			found = true
+			if a.Attempts != 2 || a.Result != ActionUpdated {
+				t.Errorf("Expected updated security after 2 attempts, got %+v", a)
+			}
+		}
+		if a.Kind == KindDocument && strings.Contains(a.Error+a.Name, testReplPass) {
+			t.Errorf("Report contains credentials: %+v", a)
+		}
+	}
+	if !found {
+		t.Errorf("Expected security action for db1 on first server")
+	}
+}
+
+func TestRunReportFailure(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	servers[1].Fail("PUT", "/db1/_security", http.StatusForbidden, -1)
+
+	var report Report
+	s := newTestService(servers, "db1")
+	s.ReportHandler = func(r Report) { report = r }
+	if err := s.Run(); err == nil {
+		t.Fatalf("Expected Run to fail")
+	}
+	if report.Success || report.Error == "" || report.Summary[ActionFailed] != 1 {
+		t.Fatalf("Expected failed report, got %+v", report)
+	}
+	last := report.Actions[len(report.Actions)-1]
+	if last.Kind != KindSecurity || last.Database != "db1" || last.Result != ActionFailed || last.Attempts != 1 || last.Error == "" {
+		t.Errorf("Expected failed security action, got %+v", last)
+	}
+}
+
+func TestRunSeedsNewServer(t *testing.T) {
+	servers := startFakeCouches(t, 3, "db1", "db2")
+	defer closeFakeCouches(servers)
+	newServer := servers[2]
+	newServer.replicatorState = true
+	servers[0].PutDoc("db1", "doc1", map[string]interface{}{"value": 1})
+
+	s := newTestService(servers, "db1", "db2")
+	s.Seeds = []Seed{{Server: newServer.Host(), Peer: servers[0].Host()}}
+	s.SeedPollInterval = time.Millisecond
+	var report Report
+	s.ReportHandler = func(r Report) { report = r }
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	// Only db1 contains documents, so only db1 is seeded, before any continuous replication is created
+	var writes []string
+	for _, r := range newServer.Requests("PUT", "/"+replicatorDbName+"/") {
+		if !strings.HasSuffix(r, "/_security") {
+			writes = append(writes, r)
+		}
+	}
+	if len(writes) != 5 || !strings.HasPrefix(writes[0], "PUT /"+replicatorDbName+"/"+seedDocumentPrefix) {
+		t.Errorf("Expected seed document followed by 4 continuous documents, got %v", writes)
+	}
+	if deletes := newServer.Requests("DELETE", "/"+replicatorDbName+"/"+seedDocumentPrefix); len(deletes) != 1 {
+		t.Errorf("Expected seed document to be removed, got %v", deletes)
+	}
+	if docs := newServer.Docs(replicatorDbName); len(docs) != 4 {
+		t.Errorf("Expected 4 continuous replication documents, got %d", len(docs))
+	}
+	seeds := 0
+	for _, a := range report.Actions {
+		if a.Kind == KindSeed {
+			seeds++
+			if a.Result != ActionCreated || a.Database != "db1" {
+				t.Errorf("Expected db1 to be seeded, got %+v", a)
+			}
+		}
+	}
+	if seeds != 1 {
+		t.Errorf("Expected 1 seed action, got %d", seeds)
+	}
+
+	// A second run must not seed again, once the data has arrived (the fake does not replicate)
+	newServer.PutDoc("db1", "doc1", map[string]interface{}{"value": 1})
+	if err := s.Run(); err != nil {
+		t.Fatalf("Second run failed: %s", err)
+	}
+	if puts := newServer.Requests("PUT", "/"+replicatorDbName+"/"+seedDocumentPrefix); len(puts) != 1 {
+		t.Errorf("Expected no additional seed, got %v", puts)
+	}
+}
+
+func TestRunSeedFailure(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	servers[1].replicatorState = true
+	servers[1].oneShotState = "failed"
+	servers[0].PutDoc("db1", "doc1", map[string]interface{}{"value": 1})
+
+	s := newTestService(servers, "db1")
+	s.Seeds = []Seed{{Server: servers[1].Host(), Peer: servers[0].Host()}}
+	s.SeedPollInterval = time.Millisecond
+	if err := s.Run(); err == nil {
+		t.Fatalf("Expected Run to fail")
+	}
+	if docs := servers[1].Docs(replicatorDbName); len(docs) != 0 {
+		t.Errorf("Expected failed seed document to be removed, got %v", docs)
+	}
+}
+
+func TestRunSeedRequiresHTTPClient(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	servers[0].PutDoc("db1", "doc1", map[string]interface{}{"value": 1})
+
+	s := newTestService(servers, "db1")
+	s.ClientFactory = NewLegacyClient
+	s.Seeds = []Seed{{Server: servers[1].Host(), Peer: servers[0].Host()}}
+	if err := s.Run(); !isNotSupported(err) {
+		t.Fatalf("Expected Run to fail with an unsupported error, got %v", err)
+	}
+	for _, fc := range servers {
+		if writes := fc.Requests("PUT", "/"); len(writes) > 0 {
+			t.Errorf("Expected no writes before failing, got %v", writes)
+		}
+	}
+}
+
+func TestRunSeedTimeout(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	servers[1].replicatorState = true
+	servers[1].oneShotState = "triggered"
+	servers[1].version = "2.1.1"
+	servers[0].PutDoc("db1", "doc1", map[string]interface{}{"value": 1})
+
+	s := newTestService(servers, "db1")
+	s.Seeds = []Seed{{Server: servers[1].Host(), Peer: servers[0].Host()}}
+	s.SeedPollInterval = time.Millisecond
+	s.SeedTimeout = 20 * time.Millisecond
+	if err := s.Run(); err == nil {
+		t.Fatalf("Expected Run to fail")
+	}
+	if reqs := servers[1].Requests("GET", "/_scheduler/docs"); len(reqs) == 0 {
+		t.Errorf("Expected seed state to be read from the scheduler")
+	}
+	if docs := servers[1].Docs(replicatorDbName); len(docs) != 0 {
+		t.Errorf("Expected timed out seed document to be removed, got %v", docs)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"time"
+)
+
+// ActionResult is the outcome of a single action taken by Run.
+type ActionResult string
+
+const (
+	ActionCreated   ActionResult = "created"
+	ActionUpdated   ActionResult = "updated"
+	ActionUnchanged ActionResult = "unchanged"
+	ActionDeleted   ActionResult = "deleted"
+	ActionFailed    ActionResult = "failed"
+)
+
+// Kinds of actions.
+const (
+	KindUser     = "user"     // Creating a user, or granting missing roles to an existing user
+	KindSecurity = "security" // Configuring the roles of a database
+	KindDatabase = "database" // Creating a missing database
+	KindDocument = "document" // Writing a replication document
+	KindSeed     = "seed"     // Seeding a database from a peer
+	KindDesign   = "design"   // Writing a design document
+	KindRestore  = "restore"  // Restoring a backup archive into a database
+)
+
+// ReportAction is a single action taken by Run.
+type ReportAction struct {
+	Server     string       `json:"server"`
+	Database   string       `json:"database,omitempty"`
+	Edge       string       `json:"edge,omitempty"`
+	Kind       string       `json:"kind"`
+	Name       string       `json:"name"`
+	Result     ActionResult `json:"result"`
+	Attempts   int          `json:"attempts"`
+	DurationMS int64        `json:"duration_ms"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// Report describes all actions taken by a single Run.
+// It never contains credentials.
+type Report struct {
+	Started    time.Time            `json:"started"`
+	Finished   time.Time            `json:"finished"`
+	DurationMS int64                `json:"duration_ms"`
+	Success    bool                 `json:"success"`
+	Error      string               `json:"error,omitempty"`
+	Summary    map[ActionResult]int `json:"summary"`
+	Actions    []ReportAction       `json:"actions"`
+}
+
+// startReport resets the report for a new run.
+func (s *service) startReport() {
+	s.report = Report{
+		Started: time.Now(),
+		Summary: make(map[ActionResult]int),
+		Actions: []ReportAction{},
+	}
+}
+
+// finishReport completes the report of the current run and passes it to the report handler (if any).
+func (s *service) finishReport(err error) {
+	s.report.Finished = time.Now()
+	s.report.DurationMS = milliseconds(s.report.Finished.Sub(s.report.Started))
+	s.report.Success = err == nil
+	if err != nil {
+		s.report.Error = Redact(err.Error())
+	}
+	if s.ReportHandler != nil {
+		s.ReportHandler(s.report)
+	}
+}
+
+// record performs the given action using the given retry policy and adds the outcome to the report.
+// The server, database & edge of the action are taken from the fields of the given logger.
+func (s *service) record(log fieldLogger, kind, name string, policy RetryPolicy, action func() (ActionResult, error)) error {
+	start := time.Now()
+	var result ActionResult
+	attempts, err := policy.doAttempts(log, func() error {
+		var err error
+		result, err = action()
+		return err
+	})
+	a := ReportAction{
+		Server:     log.fields.Server,
+		Database:   log.fields.Database,
+		Edge:       log.fields.Edge,
+		Kind:       kind,
+		Name:       name,
+		Result:     result,
+		Attempts:   attempts,
+		DurationMS: milliseconds(time.Since(start)),
+	}
+	if err != nil {
+		a.Result = ActionFailed
+		a.Error = Redact(err.Error())
+	}
+	if s.report.Summary == nil {
+		s.report.Summary = make(map[ActionResult]int)
+	}
+	s.report.Actions = append(s.report.Actions, a)
+	s.report.Summary[a.Result]++
+	return maskAny(err)
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
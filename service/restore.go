@@ -0,0 +1,337 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	// DefaultRestoreBatchSize is the default number of documents stored per _bulk_docs request.
+	DefaultRestoreBatchSize = 500
+	// DefaultRestoreConcurrency is the default number of concurrent _bulk_docs requests.
+	DefaultRestoreConcurrency = 4
+)
+
+// RestoreOptions specify which backups are restored into which server.
+type RestoreOptions struct {
+	Directory      string   // Backup directory holding the manifest & archives
+	Server         string   // Host or name of the server to restore into (default the first server)
+	Databases      []string // Databases of the backup to restore (default all)
+	TargetDatabase string   // Name of the database to restore into (single database only, default its name on the server)
+	BatchSize      int      // Number of documents per _bulk_docs request (default DefaultRestoreBatchSize)
+	Concurrency    int      // Number of concurrent _bulk_docs requests (default DefaultRestoreConcurrency)
+	Checkpoint     string   // File recording the progress of the restore, used to resume a failed restore (optional)
+}
+
+// restoreCheckpoint records the number of documents restored per archive & target database.
+type restoreCheckpoint struct {
+	path     string
+	Archives map[string]restoreProgress `json:"archives"`
+}
+
+type restoreProgress struct {
+	Documents int  `json:"documents"` // Number of leading documents of the archive that have been restored
+	Completed bool `json:"completed"`
+}
+
+// readRestoreCheckpoint reads the checkpoint file at given path.
+// An empty checkpoint is returned if the file does not exist, or no path is given.
+func readRestoreCheckpoint(path string) (*restoreCheckpoint, error) {
+	cp := &restoreCheckpoint{path: path, Archives: make(map[string]restoreProgress)}
+	if path == "" {
+		return cp, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	} else if err != nil {
+		return nil, maskAny(err)
+	}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, maskAny(errgo.Notef(err, "cannot decode restore checkpoint: %s", err.Error()))
+	}
+	if cp.Archives == nil {
+		cp.Archives = make(map[string]restoreProgress)
+	}
+	return cp, nil
+}
+
+// update records the progress of the archive with given key and writes the checkpoint file (if any).
+func (cp *restoreCheckpoint) update(key string, progress restoreProgress) error {
+	cp.Archives[key] = progress
+	if cp.path == "" {
+		return nil
+	}
+	encoded, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return maskAny(err)
+	}
+	tmp := cp.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(encoded, '\n'), 0644); err != nil {
+		return maskAny(err)
+	}
+	return maskAny(os.Rename(tmp, cp.path))
+}
+
+// restoreChain returns the archives needed to restore the given database: its last full backup,
+// followed by all later incremental backups of the same server.
+func (m BackupManifest) restoreChain(dbName string) ([]BackupArchive, error) {
+	full := -1
+	for i, a := range m.Archives {
+		if a.Database == dbName && !a.Incremental {
+			full = i
+		}
+	}
+	if full < 0 {
+		return nil, maskAny(errgo.Newf("no full backup of '%s'", dbName))
+	}
+	chain := []BackupArchive{m.Archives[full]}
+	for _, a := range m.Archives[full+1:] {
+		if a.Database == dbName && a.Incremental && a.Server == chain[0].Server {
+			chain = append(chain, a)
+		}
+	}
+	return chain, nil
+}
+
+// Restore loads the archives of a backup directory into a server, using _bulk_docs with new_edits=false
+// so all documents keep their revisions. Every database is restored from its last full backup followed by
+// its later incremental backups. Missing databases are created, but the restored databases are not
+// replicated: restore into a differently named database and map it to replicate it afterwards.
+func (s *service) Restore(opts RestoreOptions) error {
+	s.startReport()
+	err := s.restore(opts)
+	s.finishReport(err)
+	return maskAny(err)
+}
+
+func (s *service) restore(opts RestoreOptions) error {
+	if err := s.validateTopology(); err != nil {
+		return maskAny(err)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultRestoreBatchSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultRestoreConcurrency
+	}
+	if len(s.Servers) == 0 {
+		return maskAny(errgo.New("no server to restore into"))
+	}
+	server := s.Servers[0]
+	if opts.Server != "" {
+		var found bool
+		if server, found = s.server(opts.Server); !found {
+			return maskAny(errgo.Newf("unknown server '%s', expected one of the server hosts", opts.Server))
+		}
+	}
+	host := server.URL.Host
+
+	manifest, err := ReadBackupManifest(opts.Directory)
+	if err != nil {
+		return maskAny(err)
+	}
+	dbNames := opts.Databases
+	if len(dbNames) == 0 {
+		seen := make(map[string]bool)
+		for _, a := range manifest.Archives {
+			if !seen[a.Database] {
+				seen[a.Database] = true
+				dbNames = append(dbNames, a.Database)
+			}
+		}
+	}
+	if len(dbNames) == 0 {
+		return maskAny(errgo.Newf("no backups found in '%s'", opts.Directory))
+	}
+	if opts.TargetDatabase != "" && len(dbNames) != 1 {
+		return maskAny(errgo.New("a target database requires a single database to restore"))
+	}
+	checkpoint, err := readRestoreCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return maskAny(err)
+	}
+
+	log := s.log(LogFields{Server: host, Operation: "restore"})
+	conn, err := s.connect(log, server)
+	if err != nil {
+		return maskAny(RedactError(err))
+	}
+	for _, name := range dbNames {
+		chain, err := manifest.restoreChain(name)
+		if err != nil {
+			return maskAny(err)
+		}
+		dbName := opts.TargetDatabase
+		if dbName == "" {
+			dbName = s.databaseName(host, name)
+		}
+		dbLog := s.log(LogFields{Server: host, Database: dbName, Operation: "create-database"})
+		if err := s.record(dbLog, KindDatabase, dbName, s.Retry.Database, func() (ActionResult, error) {
+			if err := conn.Admin.CreateDatabase(dbName); isCouchPreconditionFailed(err) {
+				return ActionUnchanged, nil
+			} else if err != nil {
+				return "", maskAny(err)
+			}
+			return ActionCreated, nil
+		}); err != nil {
+			return maskAny(RedactError(errgo.Notef(err, "cannot create database '%s': %s", dbName, err.Error())))
+		}
+		for _, archive := range chain {
+			archive := archive
+			archiveLog := dbLog.With(operation("restore"))
+			key := host + "/" + dbName + "/" + archive.File
+			if checkpoint.Archives[key].Completed {
+				archiveLog.Infof("Archive '%s' has already been restored", archive.File)
+				continue
+			}
+			// Failed batches are retried by restoreArchive, the archive itself is attempted once.
+			if err := s.record(archiveLog, KindRestore, archive.File, RetryPolicy{MaxTries: 1}, func() (ActionResult, error) {
+				if err := s.restoreArchive(archiveLog, conn, opts, archive, dbName, checkpoint, key); err != nil {
+					return "", maskAny(err)
+				}
+				return ActionUpdated, nil
+			}); err != nil {
+				return maskAny(RedactError(errgo.Notef(err, "cannot restore '%s' into '%s': %s", archive.File, dbName, err.Error())))
+			}
+			archiveLog.Infof("Restored %d documents of '%s' into '%s'", archive.Documents, archive.File, dbName)
+		}
+	}
+	return nil
+}
+
+// restoreBatch is a number of consecutive documents of an archive.
+type restoreBatch struct {
+	index int
+	docs  []map[string]interface{}
+	err   error
+}
+
+// restoreArchive stores the documents of an archive in the given database, in batches that are stored concurrently.
+// Documents already restored according to the checkpoint are skipped. The checkpoint is updated whenever all
+// documents up to a batch have been stored, and marked completed when the whole archive has been stored.
+func (s *service) restoreArchive(log fieldLogger, conn *serverConn, opts RestoreOptions, archive BackupArchive, dbName string, checkpoint *restoreCheckpoint, key string) error {
+	f, err := os.Open(filepath.Join(opts.Directory, archive.File))
+	if err != nil {
+		return maskAny(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return maskAny(err)
+	}
+	skip := checkpoint.Archives[key].Documents
+	if skip > 0 {
+		log.Infof("Resuming restore of '%s' after %d documents", archive.File, skip)
+	}
+
+	batches := make(chan restoreBatch)
+	results := make(chan restoreBatch)
+	stop := make(chan struct{})
+	var readErr error
+	go func() {
+		defer close(batches)
+		decoder := json.NewDecoder(gz)
+		batch := restoreBatch{}
+		for n := 0; ; n++ {
+			var doc map[string]interface{}
+			if err := decoder.Decode(&doc); err == io.EOF {
+				break
+			} else if err != nil {
+				readErr = maskAny(errgo.Notef(err, "cannot read archive: %s", err.Error()))
+				return
+			}
+			if n < skip {
+				continue
+			}
+			batch.docs = append(batch.docs, doc)
+			if len(batch.docs) == opts.BatchSize {
+				select {
+				case batches <- batch:
+				case <-stop:
+					return
+				}
+				batch = restoreBatch{index: batch.index + 1}
+			}
+		}
+		if len(batch.docs) > 0 {
+			select {
+			case batches <- batch:
+			case <-stop:
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				b.err = s.Retry.Document.do(log, func() error {
+					return maskAny(conn.Admin.BulkDocs(dbName, b.docs, false))
+				})
+				results <- b
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Batches complete out of order, the checkpoint only covers the leading completed batches.
+	done := skip
+	next := 0
+	completed := make(map[int]int)
+	var firstErr error
+	for b := range results {
+		if b.err != nil {
+			if firstErr == nil {
+				firstErr = b.err
+				close(stop)
+			}
+			continue
+		}
+		completed[b.index] = len(b.docs)
+		advanced := false
+		for count, found := completed[next]; found; count, found = completed[next] {
+			delete(completed, next)
+			done += count
+			next++
+			advanced = true
+		}
+		if advanced && firstErr == nil {
+			if err := checkpoint.update(key, restoreProgress{Documents: done}); err != nil {
+				log.Warningf("Cannot write restore checkpoint: %s", err.Error())
+			}
+		}
+	}
+	if firstErr != nil {
+		return maskAny(firstErr)
+	}
+	if readErr != nil {
+		return maskAny(readErr)
+	}
+	return maskAny(checkpoint.update(key, restoreProgress{Documents: done, Completed: true}))
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// backupForRestore writes a full and an incremental backup of db1 on the first server into a new directory.
+func backupForRestore(t *testing.T, servers []*fakeCouch) string {
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		servers[0].PutDoc("db1", id, map[string]interface{}{"value": id})
+	}
+	dir, err := ioutil.TempDir("", "couchdb-repl-restore")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	s := newTestService(servers, "db1")
+	if _, err := s.Backup(BackupOptions{Directory: dir}); err != nil {
+		t.Fatalf("Backup failed: %s", err)
+	}
+	servers[0].PutDoc("db1", "b", map[string]interface{}{"value": "b2"})
+	servers[0].DeleteDoc("db1", "c")
+	if _, err := s.Backup(BackupOptions{Directory: dir, Incremental: true}); err != nil {
+		t.Fatalf("Incremental backup failed: %s", err)
+	}
+	return dir
+}
+
+func TestRestore(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	dir := backupForRestore(t, servers)
+	defer os.RemoveAll(dir)
+
+	s := newTestService(servers, "db1")
+	checkpoint := filepath.Join(dir, "checkpoint.json")
+	opts := RestoreOptions{
+		Directory:      dir,
+		Server:         servers[1].Host(),
+		TargetDatabase: "db1-restored",
+		BatchSize:      2,
+		Concurrency:    2,
+		Checkpoint:     checkpoint,
+	}
+	if err := s.Restore(opts); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+	if expected, actual := servers[0].Docs("db1"), servers[1].Docs("db1-restored"); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected restored documents %v, got %v", expected, actual)
+	}
+	if len(servers[1].Docs("db1")) != 0 {
+		t.Error("Expected db1 on the target to be unchanged")
+	}
+	cp, err := readRestoreCheckpoint(checkpoint)
+	if err != nil {
+		t.Fatalf("readRestoreCheckpoint failed: %s", err)
+	}
+	for key, p := range cp.Archives {
+		if !p.Completed {
+			t.Errorf("Expected archive '%s' to be completed, got %+v", key, p)
+		}
+	}
+
+	// Completed archives are not restored again
+	servers[1].ResetRequests()
+	if err := s.Restore(opts); err != nil {
+		t.Fatalf("Second restore failed: %s", err)
+	}
+	if posts := servers[1].Requests("POST", "/db1-restored/_bulk_docs"); len(posts) != 0 {
+		t.Errorf("Expected no bulk requests, got %v", posts)
+	}
+}
+
+func TestRestoreResume(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	dir := backupForRestore(t, servers)
+	defer os.RemoveAll(dir)
+
+	s := newTestService(servers, "db1")
+	s.Retry.Document = testRetryPolicy(1)
+	checkpoint := filepath.Join(dir, "checkpoint.json")
+	opts := RestoreOptions{Directory: dir, Server: servers[1].Host(), BatchSize: 2, Concurrency: 1, Checkpoint: checkpoint}
+	servers[1].Fail("POST", "/db1/_bulk_docs", 500, -1)
+	if err := s.Restore(opts); err == nil {
+		t.Fatal("Expected restore to fail")
+	}
+	servers[1].ClearFailures()
+
+	// Pretend the first batch was stored before the failure
+	cp, _ := readRestoreCheckpoint(checkpoint)
+	key := servers[1].Host() + "/db1/db1.0001.ndjson.gz"
+	if cp.Archives[key].Completed {
+		t.Fatalf("Expected archive not to be completed after failure")
+	}
+	if err := cp.update(key, restoreProgress{Documents: 2}); err != nil {
+		t.Fatalf("update failed: %s", err)
+	}
+	servers[1].ResetRequests()
+	if err := s.Restore(opts); err != nil {
+		t.Fatalf("Resumed restore failed: %s", err)
+	}
+	// 3 remaining documents of the full backup, 2 of the incremental backup
+	if posts := servers[1].Requests("POST", "/db1/_bulk_docs"); len(posts) != 3 {
+		t.Errorf("Expected 3 bulk requests, got %v", posts)
+	}
+	docs := servers[1].Docs("db1")
+	if _, found := docs["a"]; found {
+		t.Errorf("Expected skipped document 'a' not to be restored")
+	}
+	if docs["b"]["value"] != "b2" || docs["e"]["value"] != "e" {
+		t.Errorf("Unexpected documents %v", docs)
+	}
+	if _, found := docs["c"]; found {
+		t.Errorf("Expected deleted document 'c' not to be restored")
+	}
+}
+
+func TestRestoreUsesDatabaseOverrides(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	dir := backupForRestore(t, servers)
+	defer os.RemoveAll(dir)
+
+	s := newTestService(servers, "db1")
+	s.DatabaseOverrides = []DatabaseOverride{{Server: servers[1].Host(), Database: "db1", Name: "db1-local"}}
+	if err := s.Restore(RestoreOptions{Directory: dir, Server: servers[1].Host()}); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+	if expected, actual := servers[0].Docs("db1"), servers[1].Docs("db1-local"); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected restored documents %v, got %v", expected, actual)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/giantswarm/retry-go"
+)
+
+// RetryPolicy specifies how an operation is retried when it fails.
+type RetryPolicy struct {
+	MaxTries     int           // Maximum number of attempts
+	InitialDelay time.Duration // Delay before the first retry
+	MaxDelay     time.Duration // Upper bound of the delay between retries (0 means no bound)
+	Multiplier   float64       // Factor by which the delay grows after every retry
+	Jitter       float64       // Fraction (0-1) of the delay that is randomized
+	Timeout      time.Duration // Maximum total time spent on the operation
+}
+
+// RetryConfig holds the retry policies for the various operations.
+type RetryConfig struct {
+	Ping     RetryPolicy // Waiting for a server to become available
+	User     RetryPolicy // Creating users & granting roles
+	Security RetryPolicy // Configuring database security
+	Database RetryPolicy // Listing, creating & inspecting databases
+	Document RetryPolicy // Writing replication documents
+}
+
+// DefaultRetryPolicy returns the policy used for regular operations when nothing else is configured.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxTries:     5,
+		InitialDelay: time.Second * 2,
+		Multiplier:   1,
+		Timeout:      time.Minute,
+	}
+}
+
+// DefaultPingPolicy returns the policy used for waiting for a server when nothing else is configured.
+func DefaultPingPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxTries:     60,
+		InitialDelay: time.Second * 2,
+		Multiplier:   1,
+		Timeout:      time.Minute * 5,
+	}
+}
+
+// delay returns the time to wait before the given retry (1 is the first retry).
+func (p RetryPolicy) delay(retry int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	d := float64(p.InitialDelay) * math.Pow(multiplier, float64(retry-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		d -= d * jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// do executes the given action, retrying it according to the policy as long as it fails with a retryable error.
+// Failed attempts are logged to the given logger.
+func (p RetryPolicy) do(log fieldLogger, action func() error) error {
+	_, err := p.doAttempts(log, action)
+	return maskAny(err)
+}
+
+// doAttempts is like do, but also returns the number of attempts made.
+func (p RetryPolicy) doAttempts(log fieldLogger, action func() error) (int, error) {
+	attempt := 0
+	op := func() error {
+		if attempt > 0 {
+			time.Sleep(p.delay(attempt))
+		}
+		attempt++
+		if err := action(); err != nil {
+			log.With(func(f *LogFields) { f.Attempt = attempt }).Warningf("Attempt failed: %s", err.Error())
+			return err
+		}
+		return nil
+	}
+	if err := retry.Do(op,
+		retry.MaxTries(p.MaxTries),
+		retry.Timeout(p.Timeout),
+		retry.RetryChecker(isRetryable),
+	); err != nil {
+		return attempt, maskAny(err)
+	}
+	return attempt, nil
+}
+
+// isRetryable returns true if the given error is worth retrying.
+// Timeouts, network errors, conflicts and server errors are retryable,
+// all other client errors (bad request, unauthorized, forbidden, ...) are fatal.
+func isRetryable(err error) bool {
+	if isNotSupported(err) {
+		return false
+	}
+	if status := couchStatus(err); status != 0 {
+		switch status {
+		case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+			return true
+		}
+		return status >= 500
+	}
+	// Network errors, timeouts & unknown errors
+	return true
+}
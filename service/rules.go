@@ -0,0 +1,170 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// LabelSelector selects servers or databases by their labels.
+// An empty selector selects everything.
+type LabelSelector struct {
+	Requirements []LabelRequirement
+}
+
+// LabelRequirement is a single requirement of a LabelSelector.
+type LabelRequirement struct {
+	Key     string
+	Value   string
+	Exists  bool // Only require the label to exist (Value is ignored)
+	Negated bool // Require the label to be different (or not to exist)
+}
+
+// ParseLabelSelector parses a label selector formatted as `key=value&key!=value&key&!key`,
+// or `*` for a selector that selects everything.
+func ParseLabelSelector(value string) (LabelSelector, error) {
+	var result LabelSelector
+	if value == "*" || value == "" {
+		return result, nil
+	}
+	for _, term := range strings.Split(value, "&") {
+		var r LabelRequirement
+		if i := strings.Index(term, "!="); i >= 0 {
+			r = LabelRequirement{Key: term[:i], Value: term[i+2:], Negated: true}
+		} else if i := strings.Index(term, "="); i >= 0 {
+			r = LabelRequirement{Key: term[:i], Value: term[i+1:]}
+		} else if strings.HasPrefix(term, "!") {
+			r = LabelRequirement{Key: term[1:], Exists: true, Negated: true}
+		} else {
+			r = LabelRequirement{Key: term, Exists: true}
+		}
+		if r.Key == "" {
+			return LabelSelector{}, maskAny(errgo.Newf("invalid label selector '%s', expected 'key=value&...' or '*'", value))
+		}
+		result.Requirements = append(result.Requirements, r)
+	}
+	return result, nil
+}
+
+// Matches returns true if the given labels meet all requirements of the selector.
+func (sel LabelSelector) Matches(labels map[string]string) bool {
+	for _, r := range sel.Requirements {
+		value, found := labels[r.Key]
+		matched := found && (r.Exists || value == r.Value)
+		if matched == r.Negated {
+			return false
+		}
+	}
+	return true
+}
+
+// ReplicationRule specifies that all databases selected by Databases are replicated
+// between all servers selected by Servers.
+type ReplicationRule struct {
+	Databases LabelSelector
+	Servers   LabelSelector
+}
+
+// ParseReplicationRule parses a rule formatted as `database-selector@server-selector`,
+// e.g. `scope=global@*` or `region=eu@region=eu`.
+func ParseReplicationRule(value string) (ReplicationRule, error) {
+	parts := strings.SplitN(value, "@", 2)
+	if len(parts) != 2 {
+		return ReplicationRule{}, maskAny(errgo.Newf("invalid replication rule '%s', expected 'database-selector@server-selector'", value))
+	}
+	dbs, err := ParseLabelSelector(parts[0])
+	if err != nil {
+		return ReplicationRule{}, maskAny(err)
+	}
+	servers, err := ParseLabelSelector(parts[1])
+	if err != nil {
+		return ReplicationRule{}, maskAny(err)
+	}
+	return ReplicationRule{Databases: dbs, Servers: servers}, nil
+}
+
+// DatabaseLabel adds a label to all databases matching a pattern.
+type DatabaseLabel struct {
+	Pattern DatabasePattern
+	Key     string
+	Value   string
+}
+
+// ParseDatabaseLabel parses a database label formatted as `pattern=key=value`.
+func ParseDatabaseLabel(value string) (DatabaseLabel, error) {
+	// Split from the right, the pattern may contain '=' (in a regular expression)
+	i := strings.LastIndex(value, "=")
+	if i > 0 {
+		if j := strings.LastIndex(value[:i], "="); j > 0 && j+1 < i {
+			pattern, err := ParseDatabasePattern(value[:j])
+			if err != nil {
+				return DatabaseLabel{}, maskAny(err)
+			}
+			return DatabaseLabel{Pattern: pattern, Key: value[j+1 : i], Value: value[i+1:]}, nil
+		}
+	}
+	return DatabaseLabel{}, maskAny(errgo.Newf("invalid database label '%s', expected 'pattern=key=value'", value))
+}
+
+// databaseLabels returns the labels of the database with given (logical) name.
+func (s *service) databaseLabels(dbName string) map[string]string {
+	labels := make(map[string]string)
+	for _, l := range s.DatabaseLabels {
+		if l.Pattern.Match(dbName) {
+			labels[l.Key] = l.Value
+		}
+	}
+	return labels
+}
+
+// serversOf returns the URLs of all servers the database with given (logical) name is replicated between.
+// Without rules, every database is replicated between all servers.
+func (s *service) serversOf(dbName string) []url.URL {
+	var result []url.URL
+	if len(s.Rules) == 0 {
+		for _, srv := range s.Servers {
+			result = append(result, srv.URL)
+		}
+		return result
+	}
+	labels := s.databaseLabels(dbName)
+	for _, srv := range s.Servers {
+		for _, r := range s.Rules {
+			if r.Databases.Matches(labels) && r.Servers.Matches(srv.Labels) {
+				result = append(result, srv.URL)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// isReplicatedOn returns true if the database with given (logical) name is replicated
+// between the server with given host and at least one other server.
+func (s *service) isReplicatedOn(host, dbName string) bool {
+	servers := s.serversOf(dbName)
+	if len(servers) < 2 {
+		return false
+	}
+	for _, u := range servers {
+		if u.Host == host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestLabelSelector(t *testing.T) {
+	labels := map[string]string{"region": "eu", "tier": "core"}
+	tests := []struct {
+		selector string
+		matches  bool
+	}{
+		{"*", true},
+		{"region=eu", true},
+		{"region=us", false},
+		{"region=eu&tier=core", true},
+		{"region=eu&tier=edge", false},
+		{"region!=us", true},
+		{"tier", true},
+		{"!tier", false},
+		{"zone", false},
+		{"!zone", true},
+	}
+	for _, test := range tests {
+		sel, err := ParseLabelSelector(test.selector)
+		if err != nil {
+			t.Fatalf("ParseLabelSelector(%s) failed: %s", test.selector, err)
+		}
+		if m := sel.Matches(labels); m != test.matches {
+			t.Errorf("Expected '%s' to match %v, got %v", test.selector, test.matches, m)
+		}
+	}
+	if _, err := ParseLabelSelector("=eu"); err == nil {
+		t.Errorf("Expected selector without key to fail")
+	}
+}
+
+func TestParseDatabaseLabel(t *testing.T) {
+	l, err := ParseDatabaseLabel("/^a=b$/=scope=global")
+	if err != nil {
+		t.Fatalf("ParseDatabaseLabel failed: %s", err)
+	}
+	if !l.Pattern.Match("a=b") || l.Key != "scope" || l.Value != "global" {
+		t.Errorf("Unexpected label %+v", l)
+	}
+	if _, err := ParseDatabaseLabel("orders=scope"); err == nil {
+		t.Errorf("Expected label without value to fail")
+	}
+}
+
+func TestRuleEdges(t *testing.T) {
+	server := func(host, region string) Server {
+		return Server{URL: url.URL{Scheme: "http", Host: host}, Labels: map[string]string{"region": region}}
+	}
+	label := func(value string) DatabaseLabel {
+		l, err := ParseDatabaseLabel(value)
+		if err != nil {
+			t.Fatalf("ParseDatabaseLabel failed: %s", err)
+		}
+		return l
+	}
+	rule := func(value string) ReplicationRule {
+		r, err := ParseReplicationRule(value)
+		if err != nil {
+			t.Fatalf("ParseReplicationRule failed: %s", err)
+		}
+		return r
+	}
+	s := NewService(ServiceConfig{
+		Servers:        []Server{server("eu1", "eu"), server("eu2", "eu"), server("us1", "us"), server("us2", "us")},
+		DatabaseNames:  []string{"users", "eu-orders", "scratch"},
+		DatabaseLabels: []DatabaseLabel{label("users=scope=global"), label("eu-*=region=eu")},
+		Rules:          []ReplicationRule{rule("scope=global@*"), rule("region=eu@region=eu")},
+	}, ServiceDependencies{})
+
+	counts := make(map[string]int)
+	for _, e := range s.edges() {
+		counts[e.SourceDatabase]++
+		if e.SourceDatabase == "eu-orders" && (e.Source.Host[:2] != "eu" || e.Target.Host[:2] != "eu") {
+			t.Errorf("Expected eu-orders to be replicated between eu servers only, got %s", e)
+		}
+	}
+	if counts["users"] != 12 || counts["eu-orders"] != 2 || counts["scratch"] != 0 {
+		t.Errorf("Unexpected edges per database: %v", counts)
+	}
+	if dbs := s.databasesOn("us1"); len(dbs) != 1 || dbs[0] != "users" {
+		t.Errorf("Expected only users on us1, got %v", dbs)
+	}
+}
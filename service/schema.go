@@ -0,0 +1,404 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	// validationDesignDocID is the ID of the design document that contains the generated validate_doc_update function.
+	validationDesignDocID = designDocPrefix + "couchdb-repl-validation"
+)
+
+// Schema is the subset of JSON-Schema that can be enforced by a generated validate_doc_update function.
+type Schema struct {
+	Type                 []string           `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// ValidationSchema is the schema that all documents of a database must match.
+type ValidationSchema struct {
+	Database string // Name of the database as given in DatabaseNames (or discovered)
+	Schema   *Schema
+}
+
+// ignoredSchemaKeywords are JSON-Schema keywords that do not affect validation.
+var ignoredSchemaKeywords = map[string]bool{"$schema": true, "$id": true, "id": true, "title": true, "description": true, "default": true, "examples": true}
+
+// ParseValidationSchema parses a validation schema formatted as `db=path-of-schema-file`.
+func ParseValidationSchema(value string) (ValidationSchema, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ValidationSchema{}, maskAny(errgo.Newf("invalid schema '%s', expected 'db=path'", value))
+	}
+	data, err := ioutil.ReadFile(parts[1])
+	if err != nil {
+		return ValidationSchema{}, maskAny(err)
+	}
+	schema, err := ParseSchema(data)
+	if err != nil {
+		return ValidationSchema{}, maskAny(errgo.Notef(err, "invalid schema '%s': %s", parts[1], err.Error()))
+	}
+	return ValidationSchema{Database: parts[0], Schema: schema}, nil
+}
+
+// ParseSchema parses a JSON-Schema. Keywords that cannot be enforced result in an error.
+func ParseSchema(data []byte) (*Schema, error) {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, maskAny(err)
+	}
+	return schemaFromJSON(raw, "#")
+}
+
+func schemaFromJSON(raw interface{}, path string) (*Schema, error) {
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, maskAny(errgo.Newf("%s: schema must be an object", path))
+	}
+	s := &Schema{}
+	for key, value := range obj {
+		var err error
+		switch key {
+		case "type":
+			switch t := value.(type) {
+			case string:
+				s.Type = []string{t}
+			case []interface{}:
+				for _, x := range t {
+					name, _ := x.(string)
+					s.Type = append(s.Type, name)
+				}
+			default:
+				return nil, maskAny(errgo.Newf("%s/type: must be a string or an array of strings", path))
+			}
+			for _, t := range s.Type {
+				switch t {
+				case "object", "array", "string", "number", "integer", "boolean", "null":
+				default:
+					return nil, maskAny(errgo.Newf("%s: unknown type '%s'", path, t))
+				}
+			}
+		case "properties":
+			props, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, maskAny(errgo.Newf("%s/properties: must be an object", path))
+			}
+			s.Properties = make(map[string]*Schema)
+			for name, p := range props {
+				if s.Properties[name], err = schemaFromJSON(p, path+"/properties/"+name); err != nil {
+					return nil, maskAny(err)
+				}
+			}
+		case "items":
+			if s.Items, err = schemaFromJSON(value, path+"/items"); err != nil {
+				return nil, maskAny(err)
+			}
+		case "additionalProperties":
+			b, ok := value.(bool)
+			if !ok {
+				return nil, maskAny(errgo.Newf("%s/additionalProperties: only true or false is supported", path))
+			}
+			s.AdditionalProperties = &b
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return nil, maskAny(errgo.Newf("%s/pattern: must be a string", path))
+			}
+			s.Pattern = pattern
+			if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+				return nil, maskAny(errgo.Newf("%s/pattern: %s", path, err.Error()))
+			}
+			if reason := jsIncompatiblePattern(s.Pattern); reason != "" {
+				return nil, maskAny(errgo.Newf("%s/pattern: %s", path, reason))
+			}
+		case "required", "enum", "minLength", "maxLength", "minimum", "maximum", "minItems", "maxItems":
+			// Decode using the JSON tags of Schema
+			encoded, _ := json.Marshal(map[string]interface{}{key: value})
+			if err := json.Unmarshal(encoded, s); err != nil {
+				return nil, maskAny(errgo.Newf("%s/%s: %s", path, key, err.Error()))
+			}
+		default:
+			if !ignoredSchemaKeywords[key] {
+				return nil, maskAny(errgo.Newf("%s/%s: keyword is not supported", path, key))
+			}
+		}
+	}
+	return s, nil
+}
+
+// posixClassPattern matches POSIX character classes (e.g. `[:alpha:]`), which JavaScript does not support.
+var posixClassPattern = regexp.MustCompile(`\[:\^?[a-z]+:\]`)
+
+// jsIncompatiblePattern returns why the given pattern, which is a valid RE2 expression, may match differently
+// when it is used as a JavaScript RegExp by the validate_doc_update function, or an empty string if it does not.
+// JavaScript matches UTF-16 code units, so characters outside the Basic Multilingual Plane are refused.
+// The remaining differences are that in JavaScript `.` does not match `\r`, `\u2028` & `\u2029`, and that
+// `.` and negated classes match a single half of a character outside the Basic Multilingual Plane.
+func jsIncompatiblePattern(pattern string) string {
+	if posixClassPattern.MatchString(pattern) {
+		return "POSIX character classes are not supported by JavaScript"
+	}
+	for _, r := range pattern {
+		if r > 0xFFFF {
+			return "characters outside the Basic Multilingual Plane are matched differently by JavaScript"
+		}
+	}
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if i++; i == len(pattern) {
+				break
+			}
+			switch pattern[i] {
+			case 's', 'S':
+				return fmt.Sprintf("\\%c matches other whitespace in JavaScript", pattern[i])
+			case 'p', 'P', 'A', 'z', 'Q', 'E', 'C':
+				return fmt.Sprintf("\\%c is not supported by JavaScript", pattern[i])
+			case 'x':
+				if strings.HasPrefix(pattern[i:], "x{") {
+					return "\\x{...} is not supported by JavaScript"
+				}
+			}
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '(':
+			if !inClass && strings.HasPrefix(pattern[i:], "(?") && !strings.HasPrefix(pattern[i:], "(?:") {
+				return "flags and named groups are not supported by JavaScript"
+			}
+		}
+	}
+	return ""
+}
+
+// utf16Length returns the number of UTF-16 code units of the given string, which is its length in JavaScript.
+func utf16Length(value string) int {
+	n := 0
+	for _, r := range value {
+		n++
+		if r > 0xFFFF {
+			n++
+		}
+	}
+	return n
+}
+
+// Validate returns the reasons why the given document does not match the schema (if any).
+// Fields starting with an underscore are never considered additional properties.
+func (s *Schema) Validate(doc interface{}) []string {
+	var errors []string
+	s.validate(doc, "doc", &errors)
+	return errors
+}
+
+func (s *Schema) validate(value interface{}, path string, errors *[]string) {
+	if len(s.Type) > 0 {
+		t, ok := jsonType(value), false
+		for _, x := range s.Type {
+			if x == t || (x == "integer" && t == "number" && value.(float64) == math.Trunc(value.(float64))) {
+				ok = true
+			}
+		}
+		if !ok {
+			*errors = append(*errors, path+": expected "+strings.Join(s.Type, " or "))
+			return
+		}
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, x := range s.Enum {
+			if reflect.DeepEqual(x, value) {
+				found = true
+			}
+		}
+		if !found {
+			*errors = append(*errors, path+": not one of the allowed values")
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		if s.MinLength != nil && utf16Length(v) < *s.MinLength {
+			*errors = append(*errors, fmt.Sprintf("%s: shorter than %d", path, *s.MinLength))
+		}
+		if s.MaxLength != nil && utf16Length(v) > *s.MaxLength {
+			*errors = append(*errors, fmt.Sprintf("%s: longer than %d", path, *s.MaxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			*errors = append(*errors, path+": does not match pattern")
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			*errors = append(*errors, fmt.Sprintf("%s: less than %v", path, *s.Minimum))
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			*errors = append(*errors, fmt.Sprintf("%s: greater than %v", path, *s.Maximum))
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			*errors = append(*errors, fmt.Sprintf("%s: fewer than %d items", path, *s.MinItems))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			*errors = append(*errors, fmt.Sprintf("%s: more than %d items", path, *s.MaxItems))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), errors)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, found := v[name]; !found {
+				*errors = append(*errors, path+"."+name+": is required")
+			}
+		}
+		var names []string
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if p, found := s.Properties[name]; found {
+				p.validate(v[name], path+"."+name, errors)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties && !strings.HasPrefix(name, "_") {
+				*errors = append(*errors, path+"."+name+": is not allowed")
+			}
+		}
+	}
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// validateDocUpdateTemplate is a validate_doc_update function that enforces the schema in the second `%s`,
+// using the same rules as Schema.Validate. Deleted documents, design documents and the canary documents
+// of lag measurements (with the ID prefix in the first `%s`) are not validated.
+const validateDocUpdateTemplate = `function(newDoc, oldDoc, userCtx, secObj) {
+  if (newDoc._deleted || newDoc._id.indexOf('_design/') === 0 || newDoc._id.indexOf(%s) === 0) {
+    return;
+  }
+  var schema = %s;
+  var errors = [];
+  function typeOf(v) {
+    if (v === null) { return 'null'; }
+    if (Array.isArray(v)) { return 'array'; }
+    return typeof v;
+  }
+  function check(s, v, path) {
+    var i, k, t = typeOf(v);
+    if (s.type) {
+      var ok = false;
+      for (i = 0; i < s.type.length; i++) {
+        if (s.type[i] === t || (s.type[i] === 'integer' && t === 'number' && v %% 1 === 0)) { ok = true; }
+      }
+      if (!ok) { errors.push(path + ': expected ' + s.type.join(' or ')); return; }
+    }
+    if (s['enum']) {
+      var found = false;
+      for (i = 0; i < s['enum'].length; i++) {
+        if (JSON.stringify(s['enum'][i]) === JSON.stringify(v)) { found = true; }
+      }
+      if (!found) { errors.push(path + ': not one of the allowed values'); }
+    }
+    if (t === 'string') {
+      if (s.minLength !== undefined && v.length < s.minLength) { errors.push(path + ': shorter than ' + s.minLength); }
+      if (s.maxLength !== undefined && v.length > s.maxLength) { errors.push(path + ': longer than ' + s.maxLength); }
+      if (s.pattern !== undefined && !(new RegExp(s.pattern)).test(v)) { errors.push(path + ': does not match pattern'); }
+    } else if (t === 'number') {
+      if (s.minimum !== undefined && v < s.minimum) { errors.push(path + ': less than ' + s.minimum); }
+      if (s.maximum !== undefined && v > s.maximum) { errors.push(path + ': greater than ' + s.maximum); }
+    } else if (t === 'array') {
+      if (s.minItems !== undefined && v.length < s.minItems) { errors.push(path + ': fewer than ' + s.minItems + ' items'); }
+      if (s.maxItems !== undefined && v.length > s.maxItems) { errors.push(path + ': more than ' + s.maxItems + ' items'); }
+      if (s.items) {
+        for (i = 0; i < v.length; i++) { check(s.items, v[i], path + '[' + i + ']'); }
+      }
+    } else if (t === 'object') {
+      var props = s.properties || {};
+      for (i = 0; s.required && i < s.required.length; i++) {
+        if (!v.hasOwnProperty(s.required[i])) { errors.push(path + '.' + s.required[i] + ': is required'); }
+      }
+      var names = [];
+      for (k in v) { if (v.hasOwnProperty(k)) { names.push(k); } }
+      names.sort();
+      for (i = 0; i < names.length; i++) {
+        k = names[i];
+        if (props.hasOwnProperty(k)) {
+          check(props[k], v[k], path + '.' + k);
+        } else if (s.additionalProperties === false && k.charAt(0) !== '_') {
+          errors.push(path + '.' + k + ': is not allowed');
+        }
+      }
+    }
+  }
+  check(schema, newDoc, 'doc');
+  if (errors.length > 0) {
+    throw({forbidden: errors.join('; ')});
+  }
+}`
+
+// DesignDocument returns the design document with the validate_doc_update function that enforces the schema.
+func (v ValidationSchema) DesignDocument() DesignDocument {
+	// The schema only contains decoded JSON values, so encoding cannot fail
+	encoded, _ := json.Marshal(v.Schema)
+	prefix, _ := json.Marshal(canaryDocPrefix)
+	return DesignDocument{
+		Database: v.Database,
+		ID:       validationDesignDocID,
+		Fields: map[string]interface{}{
+			"language":            "javascript",
+			"validate_doc_update": fmt.Sprintf(validateDocUpdateTemplate, string(prefix), string(encoded)),
+		},
+	}
+}
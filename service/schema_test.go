@@ -0,0 +1,196 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+	"$schema": "http://json-schema.org/draft-04/schema#",
+	"title": "person",
+	"type": "object",
+	"required": ["name"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "pattern": "^[A-Z]"},
+		"age": {"type": "integer", "minimum": 0},
+		"kind": {"enum": ["admin", "user"]},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}}
+	}
+}`
+
+func mustParseTestSchema(t *testing.T) *Schema {
+	schema, err := ParseSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatalf("ParseSchema failed: %s", err)
+	}
+	return schema
+}
+
+func TestParseSchemaUnsupported(t *testing.T) {
+	for _, value := range []string{
+		`{"oneOf": [{"type": "string"}]}`,
+		`{"type": "text"}`,
+		`{"type": 1}`,
+		`{"properties": {"x": {"$ref": "#/definitions/x"}}}`,
+		`{"additionalProperties": {"type": "string"}}`,
+		`{"pattern": 1}`,
+		`{"pattern": "("}`,
+		`{"pattern": "(?i)^a"}`,
+		`{"pattern": "(?P<x>a)"}`,
+		`{"pattern": "^\\s+$"}`,
+		`{"pattern": "\\pL"}`,
+		`{"pattern": "\\Aa\\z"}`,
+		`{"pattern": "[[:alpha:]]"}`,
+		`{"pattern": "\\x{41}"}`,
+		`{"pattern": "😀"}`,
+		`[]`,
+	} {
+		if _, err := ParseSchema([]byte(value)); err == nil {
+			t.Errorf("Expected error for '%s'", value)
+		}
+	}
+}
+
+func TestParseSchemaJavaScriptPatterns(t *testing.T) {
+	for _, pattern := range []string{`^\\(?[0-9]{3}\\)?$`, `^(?:a|b)$`, `[(?i)]`, `\\\\s`, `\\x41`} {
+		if _, err := ParseSchema([]byte(`{"pattern": "` + pattern + `"}`)); err != nil {
+			t.Errorf("Expected pattern %s to be accepted, got %s", pattern, err)
+		}
+	}
+}
+
+func TestSchemaValidateCountsUTF16CodeUnits(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{"type": "string", "maxLength": 2}`))
+	if err != nil {
+		t.Fatalf("ParseSchema failed: %s", err)
+	}
+	if errors := schema.Validate("éé"); len(errors) != 0 {
+		t.Errorf("Expected 2 code units to be valid, got %v", errors)
+	}
+	if errors := schema.Validate("a😀"); !reflect.DeepEqual(errors, []string{"doc: longer than 2"}) {
+		t.Errorf("Expected 3 code units to be too long, got %v", errors)
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schema := mustParseTestSchema(t)
+	tests := []struct {
+		doc      string
+		expected []string
+	}{
+		{`{"_id": "a", "_rev": "1-x", "name": "Alice", "age": 3, "kind": "user", "tags": ["x"]}`, nil},
+		{`{"_id": "a"}`, []string{"doc.name: is required"}},
+		{`{"name": "alice", "age": 1.5}`, []string{"doc.age: expected integer", "doc.name: does not match pattern"}},
+		{`{"name": "", "age": -1}`, []string{"doc.age: less than 0", "doc.name: shorter than 1", "doc.name: does not match pattern"}},
+		{`{"name": "Bob", "kind": "root", "extra": true}`, []string{"doc.extra: is not allowed", "doc.kind: not one of the allowed values"}},
+		{`{"name": "Bob", "tags": ["a", 2, "c"]}`, []string{"doc.tags: more than 2 items", "doc.tags[1]: expected string"}},
+	}
+	for _, test := range tests {
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(test.doc), &doc); err != nil {
+			t.Fatalf("Unmarshal failed: %s", err)
+		}
+		if errors := schema.Validate(doc); !reflect.DeepEqual(errors, test.expected) {
+			t.Errorf("Expected %v for %s, got %v", test.expected, test.doc, errors)
+		}
+	}
+}
+
+func TestValidationSchemaDesignDocument(t *testing.T) {
+	v := ValidationSchema{Database: "db1", Schema: mustParseTestSchema(t)}
+	d := v.DesignDocument()
+	if d.Database != "db1" || d.ID != validationDesignDocID || d.Fields["language"] != "javascript" {
+		t.Fatalf("Unexpected design document %+v", d)
+	}
+	fn, _ := d.Fields["validate_doc_update"].(string)
+	encoded, _ := json.Marshal(v.Schema)
+	if !strings.HasPrefix(fn, "function(newDoc, oldDoc, userCtx, secObj) {") || !strings.Contains(fn, "var schema = "+string(encoded)+";") {
+		t.Errorf("Expected function with embedded schema, got %s", fn)
+	}
+	if !strings.Contains(fn, `newDoc._id.indexOf("`+canaryDocPrefix+`") === 0`) {
+		t.Errorf("Expected canary documents to be exempted, got %s", fn)
+	}
+	if strings.Contains(fn, "%!") || !strings.Contains(fn, "v % 1 === 0") {
+		t.Errorf("Unexpected formatting of function %s", fn)
+	}
+}
+
+func TestRunInstallsValidationAndValidateDocuments(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1", "db2")
+	defer closeFakeCouches(servers)
+	s := newTestService(servers, "db1", "db2")
+	s.ValidationSchemas = []ValidationSchema{{Database: "db1", Schema: mustParseTestSchema(t)}}
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	for _, fc := range servers {
+		if _, found := fc.Docs("db1")[validationDesignDocID]; !found {
+			t.Errorf("Expected validation design document in db1, got %v", fc.Docs("db1"))
+		}
+		if _, found := fc.Docs("db2")[validationDesignDocID]; found {
+			t.Errorf("Expected no validation design document in db2")
+		}
+	}
+	if drifts, err := s.Diff(); err != nil || len(drifts) != 0 {
+		t.Errorf("Expected no drift, got %v (%v)", drifts, err)
+	}
+
+	servers[1].PutDoc("db1", "bad", map[string]interface{}{"name": "bob"})
+	servers[0].PutDoc("db1", "good", map[string]interface{}{"name": "Bob"})
+	servers[0].PutDoc("db2", "other", map[string]interface{}{"x": 1})
+	servers[0].PutDoc("db1", canaryDocumentID(servers[0].Host()), map[string]interface{}{"type": canaryDocType})
+	failures, err := s.ValidateDocuments()
+	if err != nil {
+		t.Fatalf("ValidateDocuments failed: %s", err)
+	}
+	expected := []ValidationFailure{{Server: servers[1].Host(), Database: "db1", ID: "bad", Errors: []string{"doc.name: does not match pattern"}}}
+	if !reflect.DeepEqual(failures, expected) {
+		t.Errorf("Expected %v, got %v", expected, failures)
+	}
+}
+
+func TestValidateDocumentsInBatches(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	s := newTestService(servers, "db1")
+	s.ValidationSchemas = []ValidationSchema{{Database: "db1", Schema: mustParseTestSchema(t)}}
+	s.ValidateBatchSize = 2
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		name := "Bob"
+		if id == "b" || id == "d" {
+			name = "bob"
+		}
+		servers[0].PutDoc("db1", id, map[string]interface{}{"name": name})
+	}
+	failures, err := s.ValidateDocuments()
+	if err != nil {
+		t.Fatalf("ValidateDocuments failed: %s", err)
+	}
+	var ids []string
+	for _, f := range failures {
+		ids = append(ids, f.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"b", "d"}) {
+		t.Errorf("Expected failures for b & d, got %v", failures)
+	}
+	if requests := servers[0].Requests("GET", "/db1/_all_docs"); len(requests) != 3 {
+		t.Errorf("Expected 3 pages of documents, got %v", requests)
+	}
+}
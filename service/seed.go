@@ -0,0 +1,231 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	DefaultSeedTimeout      = time.Hour
+	DefaultSeedPollInterval = time.Second * 5
+
+	// seedDocumentPrefix is the prefix of the IDs of one-shot seeding replication documents.
+	seedDocumentPrefix = "seed_"
+)
+
+// Seed specifies that the databases of a server are seeded from a single peer,
+// before the continuous replications are created.
+type Seed struct {
+	Server string // Host of the server to seed
+	Peer   string // Host of the server to copy the data from
+}
+
+// ParseSeed parses a seed formatted as `host=peer`.
+func ParseSeed(value string) (Seed, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || parts[0] == parts[1] {
+		return Seed{}, maskAny(errgo.Newf("invalid seed '%s', expected 'host=peer'", value))
+	}
+	return Seed{Server: parts[0], Peer: parts[1]}, nil
+}
+
+// seedServers performs all configured seeds.
+func (s *service) seedServers(conns map[string]*serverConn) error {
+	for _, seed := range s.Seeds {
+		target, _ := s.serverURL(seed.Server)
+		peer, _ := s.serverURL(seed.Peer)
+		if err := s.seedServer(conns[target.String()], conns[peer.String()]); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// seedServer copies all replicated databases that are empty on the target server from the peer,
+// using one-shot replications that run on the target. Databases that already contain documents are skipped,
+// so seeding only happens the first time a server joins.
+func (s *service) seedServer(target, peer *serverConn) error {
+	if !s.flavor(target.URL.Host).HostsReplications() {
+		return maskAny(errgo.Newf("cannot seed '%s': it cannot run replications", target.URL.Host))
+	}
+	// Whether a database must be seeded is read from its database info, which the legacy client cannot fetch
+	for _, conn := range []*serverConn{target, peer} {
+		if err := requireHTTPClient(conn, "seeding"); err != nil {
+			return maskAny(err)
+		}
+	}
+	for _, name := range s.replicatedDatabases() {
+		if !s.isReplicatedOn(target.URL.Host, name) || !s.isReplicatedOn(peer.URL.Host, name) {
+			continue
+		}
+		e := edge{
+			Source:         peer.URL,
+			Target:         target.URL,
+			Database:       name,
+			SourceDatabase: s.databaseName(peer.URL.Host, name),
+			TargetDatabase: s.databaseName(target.URL.Host, name),
+			Placement:      PlacementPull,
+		}
+		log := s.log(LogFields{
+			Server:    target.URL.Host,
+			Database:  e.TargetDatabase,
+			Edge:      e.String(),
+			Operation: "seed",
+		})
+		var seed bool
+		if err := s.Retry.Database.do(log, func() error {
+			var err error
+			seed, err = s.needsSeeding(target, peer, e)
+			return maskAny(err)
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "cannot check whether '%s' must be seeded: %s", e.TargetDatabase, err.Error()))
+		}
+		if !seed {
+			log.Debugf("Database '%s' does not need seeding", e.TargetDatabase)
+			continue
+		}
+		// The seed itself is not retried, seedDatabase waits at most SeedTimeout
+		if err := s.record(log, KindSeed, e.TargetDatabase, RetryPolicy{MaxTries: 1}, func() (ActionResult, error) {
+			if err := s.seedDatabase(log, target, e); err != nil {
+				return "", maskAny(err)
+			}
+			return ActionCreated, nil
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "failed to seed '%s' from '%s': %s", e.TargetDatabase, e.Source.Host, err.Error()))
+		}
+	}
+	return nil
+}
+
+// needsSeeding returns true if the target database of the given edge is empty and the source database is not.
+func (s *service) needsSeeding(target, peer *serverConn, e edge) (bool, error) {
+	targetInfo, err := target.Admin.DatabaseInfo(e.TargetDatabase)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	if targetInfo.DocCount > 0 {
+		return false, nil
+	}
+	peerInfo, err := peer.Admin.DatabaseInfo(e.SourceDatabase)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	return peerInfo.DocCount > 0, nil
+}
+
+// seedDatabase runs a one-shot replication for the given edge and waits until it has completed.
+// The replication document is removed afterwards, also when the replication fails or does not complete in time.
+func (s *service) seedDatabase(log fieldLogger, target *serverConn, e edge) error {
+	replDoc, err := s.replicationDocument(e)
+	if err != nil {
+		return maskAny(err)
+	}
+	replDoc.Continuous = false
+	id := seedDocumentPrefix + createId(replDoc)
+
+	log.Infof("Seeding '%s' from '%s'", e.TargetDatabase, e.Source.Host)
+	// Remove a document left over from an earlier (interrupted) seed
+	if err := s.removeSeedDocument(target, id); err != nil {
+		return maskAny(err)
+	}
+	if _, err := target.Replicator.SaveDocument(replicatorDbName, id, "", replDoc); err != nil {
+		return maskAny(err)
+	}
+
+	deadline := time.Now().Add(s.SeedTimeout)
+	for {
+		state, reason, err := s.seedState(target, id)
+		if err != nil {
+			return maskAny(err)
+		}
+		switch state {
+		case "completed":
+			log.Infof("Seeding '%s' completed", e.TargetDatabase)
+			return maskAny(s.removeSeedDocument(target, id))
+		case "error", "failed":
+			s.abortSeed(log, target, id)
+			return maskAny(errgo.Newf("seed replication %s: %s", state, reason))
+		}
+		if time.Now().After(deadline) {
+			s.abortSeed(log, target, id)
+			return maskAny(errgo.Newf("seed replication did not complete within %s", s.SeedTimeout))
+		}
+		s.logSeedProgress(log, target, id)
+		time.Sleep(s.SeedPollInterval)
+	}
+}
+
+// seedState returns the state of the seed replication with given document ID, and the reason of a failure.
+// The state is taken from the scheduler (CouchDB 2.x and up), or from the replication document on servers
+// without scheduler. It is empty as long as the replication has not been started.
+func (s *service) seedState(target *serverConn, id string) (string, string, error) {
+	docs, err := target.Admin.SchedulerDocs()
+	if err == nil {
+		for _, d := range docs {
+			if d.DocID == id {
+				return d.State, string(d.Info), nil
+			}
+		}
+		return "", "", nil
+	} else if !isNotSupported(err) {
+		return "", "", maskAny(err)
+	}
+	var doc map[string]interface{}
+	if _, err := target.Replicator.ReadDocument(replicatorDbName, id, &doc); err != nil {
+		return "", "", maskAny(err)
+	}
+	state, _ := doc["_replication_state"].(string)
+	reason, _ := doc["_replication_state_reason"].(string)
+	return state, reason, nil
+}
+
+// abortSeed removes the seed replication document with given ID after a failed seed, so the replication stops.
+func (s *service) abortSeed(log fieldLogger, target *serverConn, id string) {
+	if err := s.Retry.Document.do(log, func() error {
+		return maskAny(s.removeSeedDocument(target, id))
+	}); err != nil {
+		log.Warningf("Cannot remove seed replication document '%s': %s", id, err.Error())
+	}
+}
+
+// removeSeedDocument removes the seed replication document with given ID, if it exists.
+func (s *service) removeSeedDocument(target *serverConn, id string) error {
+	var doc map[string]interface{}
+	rev, err := target.Replicator.ReadDocument(replicatorDbName, id, &doc)
+	if isCouchNotFound(err) {
+		return nil
+	} else if err != nil {
+		return maskAny(err)
+	}
+	return maskAny(target.Replicator.DeleteDocument(replicatorDbName, id, rev))
+}
+
+// logSeedProgress logs the progress of the seed replication with given document ID (if available).
+func (s *service) logSeedProgress(log fieldLogger, target *serverConn, id string) {
+	tasks, err := target.Admin.ActiveTasks()
+	if err != nil {
+		return
+	}
+	for _, t := range tasks {
+		if t.Type == "replication" && t.DocID == id {
+			log.Infof("Seeding in progress: %d%%, %d documents written", t.Progress, t.DocsWritten)
+			return
+		}
+	}
+}
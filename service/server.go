@@ -0,0 +1,126 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// Server describes a single database server.
+type Server struct {
+	URL url.URL
+	// Name is an alias of the server that can be used instead of its host in the topology (optional)
+	Name string
+	// AdminUser & ReplicatorUser override ServiceConfig.AdminUser & ServiceConfig.ReplicatorUser when set
+	AdminUser      UserInfo
+	ReplicatorUser UserInfo
+	TLS            TLSConfig
+	Labels         map[string]string
+	Flavor         Flavor // Kind of endpoint (default couchdb)
+}
+
+// TLSConfig specifies how TLS connections to a server are made.
+type TLSConfig struct {
+	CAFile             string // PEM file with the certificates of the CAs that are trusted to sign the server certificate
+	CertFile           string // PEM file with the client certificate
+	KeyFile            string // PEM file with the key of the client certificate
+	InsecureSkipVerify bool   // Do not verify the server certificate
+}
+
+// IsDefault returns true if no TLS settings are specified.
+func (c TLSConfig) IsDefault() bool {
+	return c == TLSConfig{}
+}
+
+// Config creates a TLS configuration from the settings, or nil if no settings are specified.
+func (c TLSConfig) Config() (*tls.Config, error) {
+	if c.IsDefault() {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, maskAny(errgo.Newf("no certificates found in '%s'", c.CAFile))
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// ParseServerLabel parses a server label formatted as `host=key=value`.
+func ParseServerLabel(value string) (string, string, string, error) {
+	parts := strings.SplitN(value, "=", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", maskAny(errgo.Newf("invalid server label '%s', expected 'host=key=value'", value))
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// ParseServerOption parses a server specific option formatted as `host=value`.
+func ParseServerOption(value string) (string, string, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", maskAny(errgo.Newf("invalid server option '%s', expected 'host=value'", value))
+	}
+	return parts[0], parts[1], nil
+}
+
+// server returns the server with the given host or name.
+func (s *service) server(hostOrName string) (Server, bool) {
+	for _, srv := range s.Servers {
+		if srv.URL.Host == hostOrName {
+			return srv, true
+		}
+	}
+	for _, srv := range s.Servers {
+		if srv.Name != "" && srv.Name == hostOrName {
+			return srv, true
+		}
+	}
+	return Server{}, false
+}
+
+// adminUser returns the admin user for the server with given host.
+func (s *service) adminUser(host string) UserInfo {
+	if srv, found := s.server(host); found && srv.AdminUser.UserName != "" {
+		return srv.AdminUser
+	}
+	return s.AdminUser
+}
+
+// replicatorUser returns the replicator user for the server with given host.
+func (s *service) replicatorUser(host string) UserInfo {
+	if srv, found := s.server(host); found && srv.ReplicatorUser.UserName != "" {
+		return srv.ReplicatorUser
+	}
+	return s.ReplicatorUser
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateTopologyResolvesNames(t *testing.T) {
+	s := NewService(ServiceConfig{
+		Servers: []Server{
+			{URL: url.URL{Scheme: "http", Host: "dc1:5984"}, Name: "dc1"},
+			{URL: url.URL{Scheme: "http", Host: "dc2:5984"}, Name: "dc2"},
+		},
+		EdgePlacements:    []EdgePlacement{{Source: "dc1", Target: "dc2:5984", Placement: PlacementPush}},
+		DatabaseOverrides: []DatabaseOverride{{Server: "dc2", Database: "db1", Name: "db1_eu"}},
+	}, ServiceDependencies{})
+	if err := s.validateTopology(); err != nil {
+		t.Fatalf("validateTopology failed: %s", err)
+	}
+	if e := s.EdgePlacements[0]; e.Source != "dc1:5984" || e.Target != "dc2:5984" {
+		t.Errorf("Expected names to be resolved to hosts, got %+v", e)
+	}
+	if name := s.databaseName("dc2:5984", "db1"); name != "db1_eu" {
+		t.Errorf("Expected override of dc2 to apply, got '%s'", name)
+	}
+
+	s.Pairs = []ServerPair{{Host: "dc1", Peer: "dc3"}}
+	if err := s.validateTopology(); err == nil {
+		t.Errorf("Expected unknown server name to fail")
+	}
+	s.Pairs = nil
+	s.Servers[1].Name = "dc1"
+	if err := s.validateTopology(); err == nil {
+		t.Errorf("Expected duplicate server name to fail")
+	}
+}
+
+func TestServerCredentials(t *testing.T) {
+	s := NewService(ServiceConfig{
+		Servers: []Server{
+			{URL: url.URL{Scheme: "http", Host: "dc1:5984"}},
+			{URL: url.URL{Scheme: "http", Host: "dc2:5984"}, AdminUser: UserInfo{UserName: "admin2", Password: "secret2"}},
+		},
+		AdminUser: UserInfo{UserName: "admin", Password: "secret"},
+	}, ServiceDependencies{})
+	if u := s.adminUser("dc1:5984"); u.UserName != "admin" {
+		t.Errorf("Expected default admin user, got '%s'", u.UserName)
+	}
+	if u := s.adminUser("dc2:5984"); u.UserName != "admin2" {
+		t.Errorf("Expected server specific admin user, got '%s'", u.UserName)
+	}
+}
+
+func TestParseServerUserHidesPassword(t *testing.T) {
+	for _, value := range []string{"admin:s3cret", "dc1=admin:", "=admin:s3cret", "dc1=:s3cret"} {
+		_, _, err := ParseServerUser(value)
+		if err == nil {
+			t.Errorf("Expected error for '%s'", value)
+		} else if strings.Contains(err.Error(), "s3cret") || strings.Contains(err.Error(), "admin") {
+			t.Errorf("Expected error without credentials, got '%s'", err)
+		}
+	}
+}
+
+func TestHTTPClientTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	client, err := NewHTTPClient(Server{URL: *u}, UserInfo{}, time.Second*5)
+	if err != nil {
+		t.Fatalf("NewHTTPClient failed: %s", err)
+	}
+	if err := client.Ping(); err == nil {
+		t.Errorf("Expected ping with unknown certificate to fail")
+	}
+	client, err = NewHTTPClient(Server{URL: *u, TLS: TLSConfig{InsecureSkipVerify: true}}, UserInfo{}, time.Second*5)
+	if err != nil {
+		t.Fatalf("NewHTTPClient failed: %s", err)
+	}
+	if err := client.Ping(); err != nil {
+		t.Errorf("Expected ping without verification to succeed, got %s", err)
+	}
+	if _, err := NewHTTPClient(Server{URL: *u, TLS: TLSConfig{CAFile: "/does/not/exist"}}, UserInfo{}, time.Second*5); err == nil {
+		t.Errorf("Expected missing CA file to fail")
+	}
+	if _, err := NewLegacyClient(Server{URL: *u, TLS: TLSConfig{InsecureSkipVerify: true}}, UserInfo{}, time.Second*5); !isNotSupported(err) {
+		t.Errorf("Expected TLS settings to be unsupported by legacy client, got %v", err)
+	}
+}
@@ -15,14 +15,13 @@
 package service
 
 import (
-	"net/url"
 	"time"
 
 	"github.com/op/go-logging"
 )
 
 const (
-	couchdbTimeout = time.Millisecond * 500
+	DefaultRequestTimeout = time.Millisecond * 500
 )
 
 type UserInfo struct {
@@ -31,35 +30,216 @@ type UserInfo struct {
 }
 
 type ServiceConfig struct {
-	ServerURLs     []url.URL
+	// Servers are the servers to configure
+	Servers []Server
+	// AdminUser & ReplicatorUser are used for all servers that do not specify their own
 	AdminUser      UserInfo
 	ReplicatorUser UserInfo
 	EditorUser     UserInfo
 	DatabaseNames  []string
+	// DefaultPlacement is the placement of all edges not covered by EdgePlacements or Pairs (default pull)
+	DefaultPlacement Placement
+	EdgePlacements   []EdgePlacement
+	Pairs            []ServerPair
+	// DatabaseMappings are explicit replications between (differently named) databases
+	DatabaseMappings []DatabaseMapping
+	// DatabaseOverrides rename databases of DatabaseNames on specific servers
+	DatabaseOverrides []DatabaseOverride
+	// DatabasePatterns select existing databases (on any server) that are replicated in addition to DatabaseNames
+	DatabasePatterns []DatabasePattern
+	// AllDatabases selects all existing non-system databases (on any server) for replication
+	AllDatabases bool
+	// ExcludeDatabases excludes databases from DatabasePatterns, AllDatabases and PerUserDatabases
+	ExcludeDatabases []DatabasePattern
+	// PerUserDatabases selects the per-user databases (created by couch_peruser) of all existing users (on any server)
+	PerUserDatabases bool
+	PerUserPrefix    string // Prefix of per-user databases (default DefaultPerUserPrefix)
+	// DatabaseLabels add labels to databases, which are used by Rules
+	DatabaseLabels []DatabaseLabel
+	// Rules select the servers that each database is replicated between (default all servers)
+	Rules []ReplicationRule
+	// DesignDocuments are installed in the replicated databases on all servers
+	DesignDocuments []DesignDocument
+	// Filters limit the documents that are replicated for the databases they match
+	Filters    []ReplicationFilter
+	FilterMode FilterMode // How filters are passed to CouchDB (default selector)
+	// ValidationSchemas are enforced on all servers by a generated validate_doc_update design document
+	ValidationSchemas []ValidationSchema
+	ValidateBatchSize int // Number of documents read per request when validating documents (default DefaultValidateBatchSize)
+	// Seeds copy the databases of new servers from a single peer, before the continuous replications are created
+	Seeds            []Seed
+	SeedTimeout      time.Duration // Maximum time to wait for a single database to be seeded
+	SeedPollInterval time.Duration // Time between checks of the state of a seed replication
+	RequestTimeout   time.Duration
+	Retry            RetryConfig
+	// LagInterval is the time between replication lag measurements while watching (0 disables measurements)
+	LagInterval time.Duration
 }
 
 type ServiceDependencies struct {
 	Logger *logging.Logger
+	// ClientFactory creates the clients used to access the servers (default NewLegacyClient)
+	ClientFactory ClientFactory
+	// ReportHandler (if set) is called with the report of every Run
+	ReportHandler func(Report)
+	// LagHandler (if set) is called with the measurements of every replication lag measurement while watching
+	LagHandler func([]LagMeasurement)
 }
 type service struct {
 	ServiceConfig
 	ServiceDependencies
+
+	discovered []string                   // Names of databases found by discovery
+	existing   map[string]map[string]bool // host -> database names that exist on that server
+	users      map[string]bool            // Names of users found on any server (only when PerUserDatabases is set)
+	report     Report                     // Report of the current run
 }
 
 func NewService(config ServiceConfig, deps ServiceDependencies) *service {
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = DefaultRequestTimeout
+	}
+	if config.SeedTimeout == 0 {
+		config.SeedTimeout = DefaultSeedTimeout
+	}
+	if config.SeedPollInterval == 0 {
+		config.SeedPollInterval = DefaultSeedPollInterval
+	}
+	if config.ValidateBatchSize <= 0 {
+		config.ValidateBatchSize = DefaultValidateBatchSize
+	}
+	if config.Retry.Ping.MaxTries == 0 {
+		config.Retry.Ping = DefaultPingPolicy()
+	}
+	for _, p := range []*RetryPolicy{&config.Retry.User, &config.Retry.Security, &config.Retry.Database, &config.Retry.Document} {
+		if p.MaxTries == 0 {
+			*p = DefaultRetryPolicy()
+		}
+	}
+	if config.PerUserPrefix == "" {
+		config.PerUserPrefix = DefaultPerUserPrefix
+	}
+	if config.FilterMode == "" {
+		config.FilterMode = FilterModeSelector
+	}
+	if deps.ClientFactory == nil {
+		deps.ClientFactory = NewLegacyClient
+	}
 	return &service{
 		ServiceConfig:       config,
 		ServiceDependencies: deps,
 	}
 }
 
-// Run performs a setup of the replicator databases
+// Run performs a setup of the replicator databases.
+// Returned errors never contain credentials.
 func (s *service) Run() error {
-	for _, url := range s.ServerURLs {
-		s.Logger.Infof("Configuring replication for '%s'", url.Host)
-		if err := s.setupReplication(url); err != nil {
-			s.Logger.Errorf("Configuring replication for '%s' failed: %#v", url.Host, err)
-			return maskAny(err)
+	s.startReport()
+	err := s.run()
+	s.finishReport(err)
+	return maskAny(err)
+}
+
+// run performs a setup of the replicator databases, adding all actions to the current report.
+func (s *service) run() error {
+	if err := s.validateTopology(); err != nil {
+		return maskAny(err)
+	}
+
+	// Connect to all servers
+	conns := make(map[string]*serverConn)
+	for _, srv := range s.Servers {
+		url := srv.URL
+		log := s.log(LogFields{Server: url.Host})
+		conn, err := s.connect(log, srv)
+		if err != nil {
+			log.Errorf("Connecting to '%s' failed: %s", url.Host, err.Error())
+			return maskAny(RedactError(err))
+		}
+		conns[url.String()] = conn
+	}
+	if err := s.requireClientFeatures(conns); err != nil {
+		return maskAny(err)
+	}
+
+	// Discover databases to replicate
+	if err := s.discoverDatabases(conns); err != nil {
+		s.log(LogFields{Operation: "discover-databases"}).Errorf("Discovering databases failed: %s", err.Error())
+		return maskAny(RedactError(err))
+	}
+
+	// Prepare all servers
+	for _, srv := range s.Servers {
+		url := srv.URL
+		log := s.log(LogFields{Server: url.Host})
+		log.Infof("Configuring replication for '%s'", url.Host)
+		if err := s.prepareServer(conns[url.String()]); err != nil {
+			log.Errorf("Configuring replication for '%s' failed: %s", url.Host, err.Error())
+			return maskAny(RedactError(err))
+		}
+	}
+
+	// Install design documents, before replications that may use their filters are created
+	for _, srv := range s.Servers {
+		url := srv.URL
+		if err := s.installDesignDocuments(conns[url.String()]); err != nil {
+			s.log(LogFields{Server: url.Host}).Errorf("Installing design documents failed: %s", err.Error())
+			return maskAny(RedactError(err))
+		}
+	}
+
+	// Seed new servers
+	if err := s.seedServers(conns); err != nil {
+		s.log(LogFields{Operation: "seed"}).Errorf("Seeding failed: %s", err.Error())
+		return maskAny(RedactError(err))
+	}
+
+	// Create replication documents for all edges
+	for _, e := range s.edges() {
+		host := e.Host()
+		if err := s.setupEdge(e, conns[host.String()]); err != nil {
+			s.log(LogFields{Edge: e.String(), Database: e.HostDatabase()}).Errorf("Configuring replication edge failed: %s", err.Error())
+			return maskAny(RedactError(err))
+		}
+	}
+
+	// Remove replication documents of edges that are now hosted by the other server
+	for _, srv := range s.Servers {
+		url := srv.URL
+		if err := s.removeMovedReplications(conns[url.String()]); err != nil {
+			s.log(LogFields{Server: url.Host}).Errorf("Removing moved replications failed: %s", err.Error())
+			return maskAny(RedactError(err))
+		}
+	}
+
+	// Remove replications of per-user databases of deleted users
+	if s.PerUserDatabases {
+		for _, srv := range s.Servers {
+			url := srv.URL
+			if err := s.removeDeletedUserReplications(conns[url.String()]); err != nil {
+				s.log(LogFields{Server: url.Host}).Errorf("Removing replications of deleted users failed: %s", err.Error())
+				return maskAny(RedactError(err))
+			}
+		}
+	}
+	return nil
+}
+
+// requireClientFeatures checks that the client used for the given connections supports
+// all configured features, before anything is changed.
+func (s *service) requireClientFeatures(conns map[string]*serverConn) error {
+	var features []string
+	if len(s.Seeds) > 0 {
+		features = append(features, "seeding")
+	}
+	if s.PerUserDatabases {
+		features = append(features, "replicating per-user databases")
+	}
+	for _, conn := range conns {
+		for _, feature := range features {
+			if err := requireHTTPClient(conn, feature); err != nil {
+				return maskAny(err)
+			}
 		}
 	}
 	return nil
@@ -0,0 +1,366 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// Snapshot is a normalized, credential-free description of the replication configuration of all servers.
+type Snapshot struct {
+	Servers []ServerSnapshot `json:"servers"`
+}
+
+// ServerSnapshot is the replication configuration of a single server.
+type ServerSnapshot struct {
+	Server       string                `json:"server"` // Host (and port) of the server
+	Users        []UserSnapshot        `json:"users"`
+	Databases    []DatabaseSnapshot    `json:"databases"`
+	Replications []ReplicationSnapshot `json:"replications"`
+}
+
+// UserSnapshot holds the roles of a managed (replicator or editor) user.
+type UserSnapshot struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// DatabaseSnapshot holds the security object of a database.
+type DatabaseSnapshot struct {
+	Name     string   `json:"name"`
+	Security Security `json:"security"`
+}
+
+// ReplicationSnapshot holds a document of the _replicator database, without fields managed by CouchDB
+// and without credentials.
+type ReplicationSnapshot struct {
+	ID       string                 `json:"id"`
+	Document map[string]interface{} `json:"document"`
+}
+
+// Export reads the replication documents, the security objects of the _replicator database and all
+// non-system databases and the roles of the managed users of all servers.
+func (s *service) Export() (Snapshot, error) {
+	var snapshot Snapshot
+	for _, srv := range s.Servers {
+		u := srv.URL
+		log := s.log(LogFields{Server: u.Host, Operation: "export"})
+		conn, err := s.connect(log, srv)
+		if err != nil {
+			return Snapshot{}, maskAny(RedactError(err))
+		}
+		var server ServerSnapshot
+		if err := s.Retry.Database.do(log, func() error {
+			var err error
+			server, err = s.exportServer(conn)
+			return maskAny(err)
+		}); err != nil {
+			log.Errorf("Exporting '%s' failed: %s", u.Host, err.Error())
+			return Snapshot{}, maskAny(RedactError(err))
+		}
+		snapshot.Servers = append(snapshot.Servers, server)
+	}
+	return snapshot, nil
+}
+
+// exportServer reads the replication configuration of a single server.
+func (s *service) exportServer(conn *serverConn) (ServerSnapshot, error) {
+	host := conn.URL.Host
+	server := ServerSnapshot{
+		Server:       host,
+		Users:        []UserSnapshot{},
+		Databases:    []DatabaseSnapshot{},
+		Replications: []ReplicationSnapshot{},
+	}
+
+	// Managed users
+	for _, name := range s.managedUserNames(host) {
+		user, err := conn.Admin.GetUser(name)
+		if isCouchNotFound(err) {
+			continue
+		} else if err != nil {
+			return ServerSnapshot{}, maskAny(errgo.Notef(err, "cannot read user '%s': %s", name, err.Error()))
+		}
+		server.Users = append(server.Users, UserSnapshot{Name: name, Roles: sortedCopy(user.Roles)})
+	}
+
+	// Database security
+	dbNames, err := conn.Admin.ListDatabases()
+	if err != nil {
+		return ServerSnapshot{}, maskAny(errgo.Notef(err, "cannot list databases: %s", err.Error()))
+	}
+	sort.Strings(dbNames)
+	for _, dbName := range dbNames {
+		if strings.HasPrefix(dbName, "_") && dbName != replicatorDbName {
+			continue
+		}
+		sec, err := conn.Admin.GetSecurity(dbName)
+		if err != nil {
+			return ServerSnapshot{}, maskAny(errgo.Notef(err, "cannot read security of '%s': %s", dbName, err.Error()))
+		}
+		server.Databases = append(server.Databases, DatabaseSnapshot{Name: dbName, Security: normalizeSecurity(sec)})
+	}
+
+	// Replication documents
+	ids, err := conn.Admin.ListDocumentIDs(replicatorDbName)
+	if err != nil {
+		return ServerSnapshot{}, maskAny(errgo.Notef(err, "cannot list replication documents: %s", err.Error()))
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if strings.HasPrefix(id, "_design/") {
+			continue
+		}
+		var doc map[string]interface{}
+		if _, err := conn.Admin.ReadDocument(replicatorDbName, id, &doc); err != nil {
+			return ServerSnapshot{}, maskAny(errgo.Notef(err, "cannot read replication document '%s': %s", id, err.Error()))
+		}
+		doc = userFields(doc)
+		stripCredentials(doc)
+		server.Replications = append(server.Replications, ReplicationSnapshot{ID: id, Document: doc})
+	}
+	return server, nil
+}
+
+// Import applies the given snapshot to the servers. Every server of the snapshot must be one of the
+// configured servers. Users that are missing are created with the configured passwords,
+// missing databases are created, security objects are replaced and replication documents are
+// created or updated by the replicator user, using the configured replicator credentials for remote databases.
+// Nothing is removed.
+func (s *service) Import(snapshot Snapshot) error {
+	s.startReport()
+	err := s.importSnapshot(snapshot)
+	s.finishReport(err)
+	return maskAny(err)
+}
+
+func (s *service) importSnapshot(snapshot Snapshot) error {
+	// Check servers before changing anything
+	for _, server := range snapshot.Servers {
+		if _, found := s.server(server.Server); !found {
+			return maskAny(errgo.Newf("server '%s' of snapshot is not a configured server", server.Server))
+		}
+		for _, user := range server.Users {
+			if _, found := s.managedUser(server.Server, user.Name); !found {
+				return maskAny(errgo.Newf("user '%s' of server '%s' is not a configured replicator or editor user", user.Name, server.Server))
+			}
+		}
+	}
+
+	for _, server := range snapshot.Servers {
+		srv, _ := s.server(server.Server)
+		u := srv.URL
+		log := s.log(LogFields{Server: u.Host, Operation: "import"})
+		conn, err := s.connect(log, srv)
+		if err != nil {
+			return maskAny(RedactError(err))
+		}
+		if err := s.importServer(log, conn, server); err != nil {
+			log.Errorf("Importing '%s' failed: %s", u.Host, err.Error())
+			return maskAny(RedactError(err))
+		}
+	}
+	return nil
+}
+
+// importServer applies the snapshot of a single server.
+func (s *service) importServer(log fieldLogger, conn *serverConn, server ServerSnapshot) error {
+	for _, userSnapshot := range server.Users {
+		user, _ := s.managedUser(server.Server, userSnapshot.Name)
+		roles := userSnapshot.Roles
+		userLog := log.With(operation("ensure-user"))
+		if err := s.record(userLog, KindUser, user.UserName, s.Retry.User, func() (ActionResult, error) {
+			return s.ensureUser(userLog, user, roles, conn.Admin)
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "failed to import user '%s': %s", user.UserName, err.Error()))
+		}
+	}
+
+	for _, db := range server.Databases {
+		dbName, sec := db.Name, db.Security
+		dbLog := log.With(func(f *LogFields) {
+			f.Database = dbName
+			f.Operation = "create-database"
+		})
+		if !strings.HasPrefix(dbName, "_") {
+			if err := s.record(dbLog, KindDatabase, dbName, s.Retry.Database, func() (ActionResult, error) {
+				if err := conn.Admin.CreateDatabase(dbName); isCouchPreconditionFailed(err) {
+					return ActionUnchanged, nil
+				} else if err != nil {
+					return "", maskAny(err)
+				}
+				return ActionCreated, nil
+			}); err != nil {
+				return maskAny(errgo.Notef(err, "cannot create database '%s': %s", dbName, err.Error()))
+			}
+		}
+		securityLog := dbLog.With(operation("configure-security"))
+		if err := s.record(securityLog, KindSecurity, dbName, s.Retry.Security, func() (ActionResult, error) {
+			current, err := conn.Admin.GetSecurity(dbName)
+			if err != nil {
+				return "", maskAny(err)
+			}
+			if reflect.DeepEqual(normalizeSecurity(current), normalizeSecurity(sec)) {
+				return ActionUnchanged, nil
+			}
+			if err := conn.Admin.SaveSecurity(dbName, sec); err != nil {
+				return "", maskAny(err)
+			}
+			return ActionUpdated, nil
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "cannot import security of '%s': %s", dbName, err.Error()))
+		}
+	}
+
+	for _, repl := range server.Replications {
+		id, doc := repl.ID, s.addCredentials(repl.Document)
+		docLog := log.With(func(f *LogFields) {
+			f.Database = replicatorDbName
+			f.Operation = "update-replication-document"
+		})
+		if err := s.record(docLog, KindDocument, id, s.Retry.Document, func() (ActionResult, error) {
+			return s.updateOrCreate(docLog, conn.Replicator, replicatorDbName, id, doc)
+		}); err != nil {
+			return maskAny(errgo.Notef(err, "cannot import replication document '%s': %s", id, err.Error()))
+		}
+	}
+	return nil
+}
+
+// managedUserNames returns the names of the users that are managed on the server with given host.
+func (s *service) managedUserNames(host string) []string {
+	names := []string{s.replicatorUser(host).UserName}
+	if s.EditorUser.UserName != names[0] {
+		names = append(names, s.EditorUser.UserName)
+	}
+	return names
+}
+
+// managedUser returns the credentials of the managed user with given name on the server with given host.
+func (s *service) managedUser(host, name string) (UserInfo, bool) {
+	if user := s.replicatorUser(host); user.UserName == name {
+		return user, true
+	}
+	if s.EditorUser.UserName == name {
+		return s.EditorUser, true
+	}
+	return UserInfo{}, false
+}
+
+// normalizeSecurity returns a copy of the given security object with sorted names, roles & Cloudant permissions.
+func normalizeSecurity(sec Security) Security {
+	result := Security{
+		Members: SecurityGroup{Names: sortedCopy(sec.Members.Names), Roles: sortedCopy(sec.Members.Roles)},
+		Admins:  SecurityGroup{Names: sortedCopy(sec.Admins.Names), Roles: sortedCopy(sec.Admins.Roles)},
+	}
+	if len(sec.Cloudant) > 0 {
+		result.Cloudant = make(map[string][]string)
+		for key, permissions := range sec.Cloudant {
+			result.Cloudant[key] = sortedCopy(permissions)
+		}
+	}
+	return result
+}
+
+// sortedCopy returns a sorted copy of the given list, or nil if the list is empty.
+func sortedCopy(list []string) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	result := append([]string{}, list...)
+	sort.Strings(result)
+	return result
+}
+
+// stripCredentials removes all credentials from the source & target of the given replication document.
+func stripCredentials(doc map[string]interface{}) {
+	for _, key := range []string{"source", "target"} {
+		switch endpoint := doc[key].(type) {
+		case string:
+			doc[key] = withoutUserInfo(endpoint)
+		case map[string]interface{}:
+			if u, ok := endpoint["url"].(string); ok {
+				endpoint["url"] = withoutUserInfo(u)
+			}
+			if headers, ok := endpoint["headers"].(map[string]interface{}); ok {
+				// Header names are case-insensitive
+				for name := range headers {
+					if strings.EqualFold(name, "Authorization") {
+						delete(headers, name)
+					}
+				}
+				if len(headers) == 0 {
+					delete(endpoint, "headers")
+				}
+			}
+			delete(endpoint, "auth")
+		}
+	}
+}
+
+// addCredentials returns a copy of the given replication document in which all remote
+// databases include the credentials of the replicator user of their server.
+func (s *service) addCredentials(doc map[string]interface{}) map[string]interface{} {
+	result := copyFields(doc)
+	for _, key := range []string{"source", "target"} {
+		switch endpoint := result[key].(type) {
+		case string:
+			result[key] = s.withReplicatorUser(endpoint)
+		case map[string]interface{}:
+			endpoint = copyFields(endpoint)
+			if u, ok := endpoint["url"].(string); ok {
+				endpoint["url"] = s.withReplicatorUser(u)
+			}
+			result[key] = endpoint
+		}
+	}
+	return result
+}
+
+// withoutUserInfo removes the credentials from the given URL.
+// Values that are not absolute URLs (local database names) are returned as is.
+func withoutUserInfo(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return value
+	}
+	u.User = nil
+	return u.String()
+}
+
+// withReplicatorUser adds the credentials of the replicator user of the server to the given URL.
+// Values that are not absolute URLs (local database names) are returned as is.
+func (s *service) withReplicatorUser(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return value
+	}
+	user := s.replicatorUser(u.Host)
+	u.User = url.UserPassword(user.UserName, user.Password)
+	return u.String()
+}
+
+func copyFields(doc map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for k, v := range doc {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	servers[0].replicatorState = true
+
+	s := newTestService(servers, "db1")
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	exported, err := s.Export()
+	if err != nil {
+		t.Fatalf("Export failed: %s", err)
+	}
+	encoded, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatalf("Cannot encode snapshot: %s", err)
+	}
+	if strings.Contains(string(encoded), testReplPass) || strings.Contains(string(encoded), "_replication_state") {
+		t.Errorf("Snapshot contains credentials or CouchDB managed fields: %s", encoded)
+	}
+	if len(exported.Servers) != 2 {
+		t.Fatalf("Expected 2 servers, got %d", len(exported.Servers))
+	}
+	for _, server := range exported.Servers {
+		if len(server.Users) != 2 || len(server.Databases) != 2 || len(server.Replications) != 1 {
+			t.Errorf("Expected 2 users, 2 databases & 1 replication, got %+v", server)
+		}
+	}
+
+	// Wipe the configuration of the first server
+	fc := servers[0]
+	fc.mutex.Lock()
+	fc.dbs = map[string]*fakeDB{usersDbName: newFakeDB(), replicatorDbName: newFakeDB()}
+	fc.users = make(map[string]string)
+	fc.mutex.Unlock()
+
+	if err := s.Import(exported); err != nil {
+		t.Fatalf("Import failed: %s", err)
+	}
+	if roles := fc.UserRoles(testReplName); !reflect.DeepEqual(roles, []string{roleReplicator}) {
+		t.Errorf("Expected replicator roles %v, got %v", []string{roleReplicator}, roles)
+	}
+	expected := map[string]string{remoteURL(servers[1], "db1"): "db1"}
+	if docs := replicationDocs(fc); !reflect.DeepEqual(docs, expected) {
+		t.Errorf("Expected replication documents %v, got %v", expected, docs)
+	}
+	reimported, err := s.Export()
+	if err != nil {
+		t.Fatalf("Export failed: %s", err)
+	}
+	if !reflect.DeepEqual(exported, reimported) {
+		t.Errorf("Expected identical snapshot after import, got %+v", reimported)
+	}
+
+	// A second import changes nothing
+	fc.ResetRequests()
+	if err := s.Import(exported); err != nil {
+		t.Fatalf("Import failed: %s", err)
+	}
+	for _, prefix := range []string{"/" + replicatorDbName + "/", "/" + usersDbName + "/", "/db1/"} {
+		if writes := fc.Requests("PUT", prefix); len(writes) > 0 {
+			t.Errorf("Expected no writes in second import, got %v", writes)
+		}
+	}
+}
+
+func TestExportImportCloudantSecurity(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	cloudant := servers[1]
+	cloudant.AddUser(testReplName, testReplPass)
+	s := newTestService(servers, "db1")
+	s.Servers[1].Flavor = FlavorCloudant
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	exported, err := s.Export()
+	if err != nil {
+		t.Fatalf("Export failed: %s", err)
+	}
+	expected := []string{cloudantReader, cloudantReplicator, cloudantWriter}
+	var found bool
+	for _, server := range exported.Servers {
+		for _, db := range server.Databases {
+			if server.Server == cloudant.Host() && db.Name == "db1" {
+				found = true
+				if !reflect.DeepEqual(db.Security.Cloudant[testReplName], expected) {
+					t.Errorf("Expected exported cloudant permissions %v, got %v", expected, db.Security.Cloudant)
+				}
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Expected db1 of %s in snapshot, got %+v", cloudant.Host(), exported)
+	}
+
+	// Wipe the permissions & import them again
+	cloudant.mutex.Lock()
+	cloudant.dbs["db1"].security = make(map[string]interface{})
+	cloudant.mutex.Unlock()
+	cloudant.ResetRequests()
+	if err := s.Import(exported); err != nil {
+		t.Fatalf("Import failed: %s", err)
+	}
+	if writes := cloudant.Requests("PUT", "/db1/_security"); len(writes) != 1 {
+		t.Errorf("Expected wiped cloudant permissions to be imported, got %v", writes)
+	}
+	reimported, err := s.Export()
+	if err != nil {
+		t.Fatalf("Export failed: %s", err)
+	}
+	if !reflect.DeepEqual(exported, reimported) {
+		t.Errorf("Expected identical snapshot after import, got %+v", reimported)
+	}
+}
+
+func TestStripCredentials(t *testing.T) {
+	doc := map[string]interface{}{
+		"source": "http://user:secret@a:5984/db",
+		"target": map[string]interface{}{
+			"url":     "http://user:secret@b:5984/db",
+			"headers": map[string]interface{}{"authorization": "Basic c2VjcmV0", "X-Other": "value"},
+			"auth":    map[string]interface{}{"basic": map[string]interface{}{"password": "secret"}},
+		},
+	}
+	stripCredentials(doc)
+	expected := map[string]interface{}{
+		"source": "http://a:5984/db",
+		"target": map[string]interface{}{
+			"url":     "http://b:5984/db",
+			"headers": map[string]interface{}{"X-Other": "value"},
+		},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("Expected %v, got %v", expected, doc)
+	}
+}
+
+func TestImportRejectsUnknownServer(t *testing.T) {
+	fc := newFakeCouch(t)
+	defer fc.Close()
+
+	s := newTestService([]*fakeCouch{fc})
+	snapshot := Snapshot{Servers: []ServerSnapshot{{Server: "unknown:5984"}}}
+	if err := s.Import(snapshot); err == nil {
+		t.Errorf("Expected import of unknown server to fail")
+	}
+	if reqs := fc.Requests("PUT", "/"); len(reqs) > 0 {
+		t.Errorf("Expected no writes, got %v", reqs)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// Placement specifies on which server the replication document of an edge is stored,
+// which is also the server that runs the replication job.
+type Placement string
+
+const (
+	// PlacementPull stores the document on the target server, which pulls from the source.
+	PlacementPull Placement = "pull"
+	// PlacementPush stores the document on the source server, which pushes to the target.
+	PlacementPush Placement = "push"
+)
+
+// ParsePlacement parses a placement name.
+func ParsePlacement(value string) (Placement, error) {
+	switch p := Placement(strings.ToLower(value)); p {
+	case PlacementPull, PlacementPush:
+		return p, nil
+	default:
+		return "", maskAny(errgo.Newf("invalid placement '%s', expected '%s' or '%s'", value, PlacementPull, PlacementPush))
+	}
+}
+
+// EdgePlacement overrides the placement for the edge(s) from a source to a target server.
+// Servers are identified by their host (host:port).
+type EdgePlacement struct {
+	Source    string
+	Target    string
+	Placement Placement
+}
+
+// ParseEdgePlacement parses an edge placement formatted as `source->target=placement`.
+func ParseEdgePlacement(value string) (EdgePlacement, error) {
+	parts := strings.SplitN(value, "=", 2)
+	hosts := strings.SplitN(parts[0], "->", 2)
+	if len(parts) != 2 || len(hosts) != 2 || hosts[0] == "" || hosts[1] == "" {
+		return EdgePlacement{}, maskAny(errgo.Newf("invalid edge '%s', expected 'source->target=placement'", value))
+	}
+	placement, err := ParsePlacement(parts[1])
+	if err != nil {
+		return EdgePlacement{}, maskAny(err)
+	}
+	return EdgePlacement{Source: hosts[0], Target: hosts[1], Placement: placement}, nil
+}
+
+// ServerPair specifies that the edges in both directions between Host and Peer
+// are stored on (and run by) Host. This is useful when Peer cannot host
+// replication jobs, or when it cannot reach Host.
+// Servers are identified by their host (host:port).
+type ServerPair struct {
+	Host string
+	Peer string
+}
+
+// ParseServerPair parses a server pair formatted as `host<->peer`.
+func ParseServerPair(value string) (ServerPair, error) {
+	hosts := strings.SplitN(value, "<->", 2)
+	if len(hosts) != 2 || hosts[0] == "" || hosts[1] == "" {
+		return ServerPair{}, maskAny(errgo.Newf("invalid pair '%s', expected 'host<->peer'", value))
+	}
+	return ServerPair{Host: hosts[0], Peer: hosts[1]}, nil
+}
+
+// edge is a single replication of a database from a source to a target server.
+type edge struct {
+	Source         url.URL
+	Target         url.URL
+	Database       string // Name of the database as given in DatabaseNames (or discovered), empty for mappings
+	SourceDatabase string
+	TargetDatabase string
+	Placement      Placement
+}
+
+// Host returns the URL of the server that stores the replication document of the edge.
+func (e edge) Host() url.URL {
+	if e.Placement == PlacementPush {
+		return e.Source
+	}
+	return e.Target
+}
+
+// HostDatabase returns the name of the database on the server that stores the replication document.
+func (e edge) HostDatabase() string {
+	if e.Placement == PlacementPush {
+		return e.SourceDatabase
+	}
+	return e.TargetDatabase
+}
+
+// String returns a human readable representation of the edge (without credentials).
+func (e edge) String() string {
+	if e.SourceDatabase != e.TargetDatabase {
+		return fmt.Sprintf("%s@%s->%s@%s", e.SourceDatabase, e.Source.Host, e.TargetDatabase, e.Target.Host)
+	}
+	return fmt.Sprintf("%s->%s", e.Source.Host, e.Target.Host)
+}
+
+// placement returns the placement of the edge from source to target.
+// Servers that cannot run replications (see Flavor) never host an edge, when the other server can.
+func (s *service) placement(source, target url.URL) Placement {
+	p := s.configuredPlacement(source, target)
+	if p == PlacementPull && !s.flavor(target.Host).HostsReplications() && s.flavor(source.Host).HostsReplications() {
+		return PlacementPush
+	}
+	if p == PlacementPush && !s.flavor(source.Host).HostsReplications() && s.flavor(target.Host).HostsReplications() {
+		return PlacementPull
+	}
+	return p
+}
+
+// configuredPlacement returns the placement of the edge(s) from source to target, as configured
+// by Pairs, EdgePlacements & DefaultPlacement.
+func (s *service) configuredPlacement(source, target url.URL) Placement {
+	for _, p := range s.Pairs {
+		if (p.Host == source.Host && p.Peer == target.Host) || (p.Host == target.Host && p.Peer == source.Host) {
+			if p.Host == source.Host {
+				return PlacementPush
+			}
+			return PlacementPull
+		}
+	}
+	for _, e := range s.EdgePlacements {
+		if e.Source == source.Host && e.Target == target.Host {
+			return e.Placement
+		}
+	}
+	if s.DefaultPlacement != "" {
+		return s.DefaultPlacement
+	}
+	return PlacementPull
+}
+
+// TopologyEdge is a single replication of the topology, as shown to users.
+type TopologyEdge struct {
+	Source         string    `json:"source"`
+	Target         string    `json:"target"`
+	SourceDatabase string    `json:"source_database"`
+	TargetDatabase string    `json:"target_database"`
+	Placement      Placement `json:"placement"`
+}
+
+// String returns the edge formatted as `db@source-host->db@target-host (placement)`.
+func (e TopologyEdge) String() string {
+	return fmt.Sprintf("%s@%s->%s@%s (%s)", e.SourceDatabase, e.Source, e.TargetDatabase, e.Target, e.Placement)
+}
+
+// topology returns all edges of the topology.
+func (s *service) topology() []TopologyEdge {
+	var result []TopologyEdge
+	for _, e := range s.edges() {
+		result = append(result, TopologyEdge{
+			Source:         e.Source.Host,
+			Target:         e.Target.Host,
+			SourceDatabase: e.SourceDatabase,
+			TargetDatabase: e.TargetDatabase,
+			Placement:      e.Placement,
+		})
+	}
+	return result
+}
+
+// edges returns all replication edges between all servers, for all databases.
+func (s *service) edges() []edge {
+	var result []edge
+	for _, targetServer := range s.Servers {
+		for _, sourceServer := range s.Servers {
+			source, target := sourceServer.URL, targetServer.URL
+			if source.String() == target.String() {
+				// Do not replicate with myself
+				continue
+			}
+			placement := s.placement(source, target)
+			for _, dbName := range s.replicatedDatabases() {
+				if !s.isReplicatedOn(source.Host, dbName) || !s.isReplicatedOn(target.Host, dbName) {
+					// Not selected by the replication rules
+					continue
+				}
+				result = append(result, edge{
+					Source:         source,
+					Target:         target,
+					Database:       dbName,
+					SourceDatabase: s.databaseName(source.Host, dbName),
+					TargetDatabase: s.databaseName(target.Host, dbName),
+					Placement:      placement,
+				})
+			}
+		}
+	}
+	for _, m := range s.DatabaseMappings {
+		source, _ := s.serverURL(m.SourceServer)
+		target, _ := s.serverURL(m.TargetServer)
+		result = append(result, edge{
+			Source:         source,
+			Target:         target,
+			SourceDatabase: m.SourceDatabase,
+			TargetDatabase: m.TargetDatabase,
+			Placement:      s.placement(source, target),
+		})
+	}
+	return result
+}
+
+// serverURL returns the URL of the server with given host or name.
+func (s *service) serverURL(hostOrName string) (url.URL, bool) {
+	srv, found := s.server(hostOrName)
+	return srv.URL, found
+}
+
+// validateTopology checks that all servers are unique and that all servers referenced in edge placements,
+// pairs, mappings and server specific settings are known. References by server name are replaced by
+// the host of the server.
+func (s *service) validateTopology() error {
+	seen := make(map[string]bool)
+	for _, srv := range s.Servers {
+		if seen[srv.URL.Host] {
+			return maskAny(errgo.Newf("duplicate server '%s'", srv.URL.Host))
+		}
+		seen[srv.URL.Host] = true
+	}
+	for _, srv := range s.Servers {
+		if srv.Name == "" || srv.Name == srv.URL.Host {
+			continue
+		}
+		if seen[srv.Name] {
+			return maskAny(errgo.Newf("duplicate server name '%s'", srv.Name))
+		}
+		seen[srv.Name] = true
+	}
+	resolve := func(ref *string) error {
+		srv, found := s.server(*ref)
+		if !found {
+			return maskAny(errgo.Newf("unknown server '%s' in topology, expected one of the server hosts or names", *ref))
+		}
+		*ref = srv.URL.Host
+		return nil
+	}
+	var refs []*string
+	for i := range s.EdgePlacements {
+		refs = append(refs, &s.EdgePlacements[i].Source, &s.EdgePlacements[i].Target)
+	}
+	for i := range s.Pairs {
+		refs = append(refs, &s.Pairs[i].Host, &s.Pairs[i].Peer)
+	}
+	for i := range s.DatabaseMappings {
+		refs = append(refs, &s.DatabaseMappings[i].SourceServer, &s.DatabaseMappings[i].TargetServer)
+	}
+	for i := range s.DatabaseOverrides {
+		refs = append(refs, &s.DatabaseOverrides[i].Server)
+	}
+	for i := range s.Seeds {
+		refs = append(refs, &s.Seeds[i].Server, &s.Seeds[i].Peer)
+	}
+	for _, ref := range refs {
+		if err := resolve(ref); err != nil {
+			return maskAny(err)
+		}
+	}
+	for _, m := range s.DatabaseMappings {
+		if m.SourceServer == m.TargetServer && m.SourceDatabase == m.TargetDatabase {
+			return maskAny(errgo.Newf("database mapping of '%s' on '%s' replicates with itself", m.SourceDatabase, m.SourceServer))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	// DefaultValidateBatchSize is the default number of documents read per request when validating documents.
+	DefaultValidateBatchSize = 1000
+)
+
+// ValidationFailure is an existing document that does not match the validation schema of its database.
+type ValidationFailure struct {
+	Server   string   `json:"server"`
+	Database string   `json:"database"`
+	ID       string   `json:"id"`
+	Errors   []string `json:"errors"`
+}
+
+// String returns the failure as a single line of space separated `key=value` pairs.
+func (f ValidationFailure) String() string {
+	return fmt.Sprintf("server=%s database=%s id=%s errors=%q", f.Server, f.Database, f.ID, strings.Join(f.Errors, "; "))
+}
+
+// ValidateDocuments checks all existing documents of the databases with a validation schema
+// against that schema and returns the documents that would be rejected by the generated
+// validate_doc_update function, sorted by server, database & id.
+// Design documents and deleted documents are not validated. ValidateDocuments never changes anything.
+func (s *service) ValidateDocuments() ([]ValidationFailure, error) {
+	if err := s.validateTopology(); err != nil {
+		return nil, maskAny(err)
+	}
+	var failures []ValidationFailure
+	for _, srv := range s.Servers {
+		host := srv.URL.Host
+		log := s.log(LogFields{Server: host, Operation: "validate"})
+		conn, err := s.connect(log, srv)
+		if err != nil {
+			return nil, maskAny(RedactError(err))
+		}
+		for _, v := range s.ValidationSchemas {
+			if !s.isReplicatedOn(host, v.Database) {
+				continue
+			}
+			dbName := s.databaseName(host, v.Database)
+			dbFailures, err := s.validateDatabase(conn, dbName, v.Schema)
+			if err != nil {
+				return nil, maskAny(RedactError(errgo.Notef(err, "cannot list documents of '%s' on '%s': %s", dbName, host, err.Error())))
+			}
+			failures = append(failures, dbFailures...)
+		}
+	}
+	sort.Sort(failuresByKey(failures))
+	return failures, nil
+}
+
+// validateDatabase checks all documents of the given database against the given schema,
+// reading ValidateBatchSize documents at a time. A database that does not exist has no failures.
+func (s *service) validateDatabase(conn *serverConn, dbName string, schema *Schema) ([]ValidationFailure, error) {
+	var failures []ValidationFailure
+	startID := ""
+	for {
+		docs, next, err := conn.Admin.ListDocuments(dbName, startID, s.ValidateBatchSize)
+		if isCouchNotFound(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, maskAny(err)
+		}
+		for _, doc := range docs {
+			id, _ := doc["_id"].(string)
+			if deleted, _ := doc["_deleted"].(bool); deleted || strings.HasPrefix(id, designDocPrefix) || strings.HasPrefix(id, canaryDocPrefix) {
+				continue
+			}
+			if errors := schema.Validate(doc); len(errors) > 0 {
+				failures = append(failures, ValidationFailure{Server: conn.URL.Host, Database: dbName, ID: id, Errors: errors})
+			}
+		}
+		if next == "" {
+			return failures, nil
+		}
+		startID = next
+	}
+}
+
+type failuresByKey []ValidationFailure
+
+func (l failuresByKey) Len() int      { return len(l) }
+func (l failuresByKey) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l failuresByKey) Less(i, j int) bool {
+	a, b := l[i], l[j]
+	if a.Server != b.Server {
+		return a.Server < b.Server
+	}
+	if a.Database != b.Database {
+		return a.Database < b.Database
+	}
+	return a.ID < b.ID
+}
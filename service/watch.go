@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	// dbUpdatesTimeout is the time a longpoll request on _db_updates waits for changes
+	dbUpdatesTimeout = time.Minute
+)
+
+// Watch performs a setup of the replicator databases and then keeps watching all servers
+// for newly created databases. When a database is created that must be replicated
+// (see DatabasePatterns & AllDatabases), the setup is performed again.
+// With PerUserDatabases, the setup is also performed again when a per-user database is created
+// or deleted, or when the users change.
+// With LagInterval, the replication lag is measured periodically as well.
+// Watch only returns when the initial setup fails, or when database updates cannot be watched
+// (e.g. because the client does not support it).
+func (s *service) Watch() error {
+	if err := s.Run(); err != nil {
+		return maskAny(err)
+	}
+	events := make(chan DatabaseEvent)
+	errs := make(chan error, len(s.Servers))
+	for _, srv := range s.Servers {
+		go s.watchDatabaseUpdates(srv, events, errs)
+	}
+	var lagTicks <-chan time.Time
+	if s.LagInterval > 0 {
+		lagTicks = time.NewTicker(s.LagInterval).C
+	}
+	for {
+		var ev DatabaseEvent
+		select {
+		case ev = <-events:
+		case err := <-errs:
+			return maskAny(err)
+		case <-lagTicks:
+			s.measureLag()
+			continue
+		}
+		dbName := ev.DbName
+		log := s.log(LogFields{Database: dbName, Operation: "watch"})
+		if _, perUser := s.perUserOwner(dbName); perUser || (s.PerUserDatabases && dbName == usersDbName) {
+			if perUser && ev.Type == "updated" {
+				continue
+			}
+			log.Infof("Database '%s' %s, configuring replication", dbName, ev.Type)
+			if err := s.Run(); err != nil {
+				log.Errorf("Configuring replication after change of '%s' failed: %s", dbName, err.Error())
+			}
+			continue
+		}
+		if ev.Type != "created" {
+			continue
+		}
+		if !s.isDiscoverable(dbName) || s.isReplicated(dbName) {
+			log.Debugf("Ignoring created database '%s'", dbName)
+			continue
+		}
+		log.Infof("Database '%s' created, configuring replication", dbName)
+		if err := s.Run(); err != nil {
+			log.Errorf("Configuring replication after creation of '%s' failed: %s", dbName, err.Error())
+		}
+	}
+}
+
+// measureLag measures the replication lag, logs it and passes it to the lag handler (if any).
+func (s *service) measureLag() {
+	timeout := DefaultLagTimeout
+	if s.LagInterval < timeout {
+		timeout = s.LagInterval
+	}
+	measurements, err := s.Lag(LagOptions{Timeout: timeout})
+	if err != nil {
+		s.log(LogFields{Operation: "lag"}).Errorf("Measuring replication lag failed: %s", err.Error())
+		return
+	}
+	s.logLag(measurements)
+	if s.LagHandler != nil {
+		s.LagHandler(measurements)
+	}
+}
+
+// isReplicated returns true if the database with given name is already replicated.
+func (s *service) isReplicated(dbName string) bool {
+	for _, name := range s.replicatedDatabases() {
+		if name == dbName {
+			return true
+		}
+	}
+	return false
+}
+
+// watchDatabaseUpdates follows the _db_updates feed of the given server and sends
+// all events into the given channel, using the logical name of the database.
+// It only returns when the feed cannot be watched at all, after sending the reason into errs.
+func (s *service) watchDatabaseUpdates(server Server, events chan<- DatabaseEvent, errs chan<- error) {
+	serverURL := server.URL
+	log := s.log(LogFields{Server: serverURL.Host, Operation: "watch"})
+	since := "now"
+	var client CouchClient
+	for {
+		if client == nil {
+			var err error
+			if client, err = s.ClientFactory(server, s.adminUser(serverURL.Host), s.RequestTimeout); err != nil {
+				errs <- maskAny(errgo.Notef(err, "cannot create database client for '%s': %s", serverURL.Host, err.Error()))
+				return
+			}
+		}
+		updates, next, err := client.DatabaseUpdates(since, dbUpdatesTimeout)
+		if isNotSupported(err) {
+			errs <- maskAny(errgo.WithCausef(err, NotSupportedError, "cannot watch database updates of '%s', use the http client", serverURL.Host))
+			return
+		} else if err != nil {
+			log.Warningf("Watching database updates failed: %s", err.Error())
+			time.Sleep(s.Retry.Ping.delay(1))
+			continue
+		}
+		for _, ev := range updates {
+			ev.DbName = s.logicalDatabaseName(serverURL.Host, ev.DbName)
+			events <- ev
+		}
+		since = next
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+)
+
+func TestWatchFailsWhenUpdatesCannotBeWatched(t *testing.T) {
+	servers := startFakeCouches(t, 2, "db1")
+	defer closeFakeCouches(servers)
+	s := newTestService(servers, "db1")
+	s.ClientFactory = NewLegacyClient
+	if err := s.Watch(); !isNotSupported(err) {
+		t.Errorf("Expected Watch to fail with an unsupported error, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/couchdb-repl/service"
+)
+
+var (
+	cmdExport = &cobra.Command{
+		Use:   "export",
+		Short: "Export the replication configuration of all servers",
+		Long:  "Export the replication documents, database security objects and the roles of the replicator & editor users of all servers, as a credential-free JSON snapshot",
+		Run:   cmdExportRun,
+	}
+	cmdImport = &cobra.Command{
+		Use:   "import",
+		Short: "Import a replication configuration snapshot into the servers",
+		Run:   cmdImportRun,
+	}
+	snapshotFlags struct {
+		file string
+	}
+)
+
+func init() {
+	cmdExport.Flags().StringVar(&snapshotFlags.file, "file", "-", "Path of the file the snapshot is written to ('-' for stdout)")
+	cmdImport.Flags().StringVar(&snapshotFlags.file, "file", "-", "Path of the file the snapshot is read from ('-' for stdin)")
+	cmdMain.AddCommand(cmdExport)
+	cmdMain.AddCommand(cmdImport)
+}
+
+func cmdExportRun(cmd *cobra.Command, args []string) {
+	logger := setupCommandLogging()
+	assertServerArgs()
+	config, deps := parseServiceArgs(logger)
+	snapshot, err := service.NewService(config, deps).Export()
+	if err != nil {
+		Exitf("Export failed: %s\n", err.Error())
+	}
+	encoded, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		Exitf("Cannot encode snapshot: %s\n", err.Error())
+	}
+	encoded = append(encoded, '\n')
+	if snapshotFlags.file == "-" {
+		os.Stdout.Write(encoded)
+	} else if err := ioutil.WriteFile(snapshotFlags.file, encoded, 0644); err != nil {
+		Exitf("Cannot write snapshot: %s\n", err.Error())
+	}
+}
+
+func cmdImportRun(cmd *cobra.Command, args []string) {
+	logger := setupCommandLogging()
+	assertServerArgs()
+	var data []byte
+	var err error
+	if snapshotFlags.file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(snapshotFlags.file)
+	}
+	if err != nil {
+		Exitf("Cannot read snapshot: %s\n", err.Error())
+	}
+	var snapshot service.Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		Exitf("Cannot decode snapshot: %s\n", err.Error())
+	}
+	config, deps := parseServiceArgs(logger)
+	if err := service.NewService(config, deps).Import(snapshot); err != nil {
+		Exitf("Import failed: %s\n", err.Error())
+	}
+	logger.Info("Import succeeded")
+}
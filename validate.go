@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/couchdb-repl/service"
+)
+
+var (
+	cmdValidate = &cobra.Command{
+		Use:   "validate",
+		Short: "Show which existing documents do not match the validation schemas",
+		Long:  "Check all existing documents of the databases given in --schema against their schema, without changing anything. Exits with code 2 when documents would be rejected.",
+		Run:   cmdValidateRun,
+	}
+)
+
+func init() {
+	addTopologyFlags(cmdValidate.Flags())
+	cmdValidate.Flags().IntVar(&appFlags.ValidateBatchSize, "batch-size", service.DefaultValidateBatchSize, "Number of documents read per request")
+	cmdValidate.Flags().StringVar(&appFlags.output, "output", outputText, "Format of the failing documents printed to stdout (text|json)")
+	cmdMain.AddCommand(cmdValidate)
+}
+
+func cmdValidateRun(cmd *cobra.Command, args []string) {
+	logger := setupCommandLogging()
+	assertServerArgs()
+	if appFlags.output != outputText && appFlags.output != outputJSON {
+		Exitf("--output must be '%s' or '%s'\n", outputText, outputJSON)
+	}
+	parseTopologyArgs()
+	if len(appFlags.ValidationSchemas) == 0 {
+		Exitf("--schema must be set\n")
+	}
+	config, deps := parseServiceArgs(logger)
+	failures, err := service.NewService(config, deps).ValidateDocuments()
+	if err != nil {
+		Exitf("Validation failed: %s\n", err.Error())
+	}
+	if appFlags.output == outputJSON {
+		if failures == nil {
+			failures = []service.ValidationFailure{}
+		}
+		encoded, err := json.MarshalIndent(failures, "", "  ")
+		if err != nil {
+			Exitf("Cannot encode failures: %s\n", err.Error())
+		}
+		fmt.Println(string(encoded))
+	} else {
+		for _, f := range failures {
+			fmt.Println(f.String())
+		}
+	}
+	if len(failures) > 0 {
+		logger.Warningf("Found %d documents that do not match their schema", len(failures))
+		os.Exit(exitCodeDrift)
+	}
+	logger.Info("All documents match their schema")
+}